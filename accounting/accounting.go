@@ -0,0 +1,231 @@
+// Package accounting aggregates the stats of measured connections (see
+// listeners.NewMeasuredListener) by keys from the measured context, like a user
+// or device ID, and periodically flushes the totals to a Sink such as a CSV
+// file, a JSON lines file, a SQLite database or a StatsD server.
+package accounting
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+)
+
+const (
+	defaultFlushInterval = 1 * time.Minute
+	defaultMaxRecords    = 10000
+)
+
+var (
+	log = golog.LoggerFor("accounting")
+)
+
+// Record is the usage aggregated for one combination of keys over one period.
+type Record struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Keys holds the values of the reporter's keys. Keys missing from the
+	// measured context have empty values.
+	Keys      map[string]string `json:"keys"`
+	BytesSent int64             `json:"bytes_sent"`
+	BytesRecv int64             `json:"bytes_recv"`
+	// ConnsClosed is the number of connections that were closed in the
+	// period.
+	ConnsClosed int64 `json:"conns_closed"`
+}
+
+// A Sink stores flushed records.
+type Sink interface {
+	// Write stores a batch of records.
+	Write(records []*Record) error
+
+	// Close releases any resources held by the Sink.
+	Close() error
+}
+
+// Opts configures a Reporter.
+type Opts struct {
+	// Keys are the keys of the measured context to aggregate by, for example
+	// "user" or "quota_key".
+	Keys []string
+
+	// Sink receives the aggregated records.
+	Sink Sink
+
+	// FlushInterval is how often records are flushed to the Sink. Defaults to
+	// 1 minute.
+	FlushInterval time.Duration
+
+	// MaxRecords bounds the number of records held in memory. Once reached,
+	// records are flushed early. If the Sink can't keep up, stats are dropped
+	// rather than buffered. Defaults to 10000.
+	MaxRecords int
+}
+
+type batch struct {
+	start   time.Time
+	end     time.Time
+	records map[string]*Record
+}
+
+// Reporter aggregates measured stats and flushes them to a Sink.
+type Reporter struct {
+	opts    *Opts
+	current *batch
+	dropped int64
+	mx      sync.Mutex
+
+	full      chan *batch
+	flushNow  chan chan error
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// New constructs a new Reporter and starts flushing periodically.
+func New(opts *Opts) *Reporter {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = defaultMaxRecords
+	}
+	r := &Reporter{
+		opts:     opts,
+		current:  newBatch(),
+		full:     make(chan *batch, 1),
+		flushNow: make(chan chan error),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func newBatch() *batch {
+	return &batch{start: time.Now(), records: make(map[string]*Record)}
+}
+
+// Report is a listeners.MeasuredReportFN that adds deltaStats to the record
+// for the keys in ctx.
+func (r *Reporter) Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	values := make([]string, len(r.opts.Keys))
+	for i, key := range r.opts.Keys {
+		if value, found := ctx[key]; found && value != nil {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	id := strings.Join(values, "\x00")
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	rec := r.current.records[id]
+	if rec == nil {
+		if len(r.current.records) >= r.opts.MaxRecords {
+			r.current.end = time.Now()
+			select {
+			case r.full <- r.current:
+				r.current = newBatch()
+			default:
+				// The prior full batch hasn't been written yet
+				r.dropped++
+				return
+			}
+		}
+		rec = &Record{Keys: make(map[string]string, len(values))}
+		for i, key := range r.opts.Keys {
+			rec.Keys[key] = values[i]
+		}
+		r.current.records[id] = rec
+	}
+	rec.BytesSent += int64(deltaStats.SentTotal)
+	rec.BytesRecv += int64(deltaStats.RecvTotal)
+	if final {
+		rec.ConnsClosed++
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case b := <-r.full:
+			r.write(b)
+		case <-ticker.C:
+			r.write(r.rotate())
+		case errCh := <-r.flushNow:
+			errCh <- r.write(r.rotate())
+		case <-r.stop:
+			select {
+			case b := <-r.full:
+				r.write(b)
+			default:
+			}
+			r.write(r.rotate())
+			return
+		}
+	}
+}
+
+func (r *Reporter) rotate() *batch {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	b := r.current
+	b.end = time.Now()
+	r.current = newBatch()
+	if r.dropped > 0 {
+		log.Errorf("Dropped stats %d times because the sink couldn't keep up", r.dropped)
+		r.dropped = 0
+	}
+	return b
+}
+
+func (r *Reporter) write(b *batch) error {
+	if len(b.records) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(b.records))
+	for id := range b.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	records := make([]*Record, 0, len(ids))
+	for _, id := range ids {
+		rec := b.records[id]
+		rec.Start = b.start
+		rec.End = b.end
+		records = append(records, rec)
+	}
+	err := r.opts.Sink.Write(records)
+	if err != nil {
+		log.Errorf("Unable to write %d records: %v", len(records), err)
+	}
+	return err
+}
+
+// Flush immediately writes the records aggregated so far to the Sink.
+func (r *Reporter) Flush() error {
+	errCh := make(chan error, 1)
+	select {
+	case r.flushNow <- errCh:
+		return <-errCh
+	case <-r.stopped:
+		return nil
+	}
+}
+
+// Close flushes any remaining records and closes the Sink.
+func (r *Reporter) Close() (err error) {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		<-r.stopped
+		err = r.opts.Sink.Close()
+	})
+	return
+}
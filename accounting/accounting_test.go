@@ -0,0 +1,221 @@
+package accounting
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+)
+
+type memorySink struct {
+	batches [][]*Record
+	writing chan struct{}
+	block   chan struct{}
+	mx      sync.Mutex
+}
+
+func (s *memorySink) Write(records []*Record) error {
+	if s.block != nil {
+		s.writing <- struct{}{}
+		<-s.block
+	}
+	s.mx.Lock()
+	s.batches = append(s.batches, records)
+	s.mx.Unlock()
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (s *memorySink) getBatches() [][]*Record {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.batches
+}
+
+func report(r *Reporter, user string, sent int, recv int, final bool) {
+	ctx := map[string]interface{}{"other": "ignored"}
+	if user != "" {
+		ctx["user"] = user
+	}
+	r.Report(ctx, &measured.Stats{}, &measured.Stats{SentTotal: sent, RecvTotal: recv}, final)
+}
+
+func TestAggregation(t *testing.T) {
+	sink := &memorySink{}
+	r := New(&Opts{Keys: []string{"user"}, Sink: sink, FlushInterval: time.Hour})
+	report(r, "alice", 10, 20, false)
+	report(r, "alice", 1, 2, true)
+	report(r, "bob", 5, 5, false)
+	report(r, "", 7, 7, true)
+	if !assert.NoError(t, r.Flush()) {
+		return
+	}
+	batches := sink.getBatches()
+	if assert.Len(t, batches, 1) && assert.Len(t, batches[0], 3) {
+		unknown, alice, bob := batches[0][0], batches[0][1], batches[0][2]
+		assert.Equal(t, map[string]string{"user": ""}, unknown.Keys)
+		assert.EqualValues(t, 1, unknown.ConnsClosed)
+		assert.Equal(t, map[string]string{"user": "alice"}, alice.Keys)
+		assert.EqualValues(t, 11, alice.BytesSent)
+		assert.EqualValues(t, 22, alice.BytesRecv)
+		assert.EqualValues(t, 1, alice.ConnsClosed)
+		assert.EqualValues(t, 5, bob.BytesSent)
+		assert.False(t, alice.End.Before(alice.Start))
+	}
+
+	report(r, "alice", 1, 1, false)
+	assert.NoError(t, r.Close())
+	assert.Len(t, sink.getBatches(), 2, "close should flush remaining records")
+}
+
+func TestBoundedMemory(t *testing.T) {
+	sink := &memorySink{writing: make(chan struct{}, 10), block: make(chan struct{})}
+	r := New(&Opts{Keys: []string{"user"}, Sink: sink, FlushInterval: time.Hour, MaxRecords: 2})
+	report(r, "a", 1, 1, false)
+	report(r, "b", 1, 1, false)
+	// Full, hands off the batch for writing, which blocks in the sink
+	report(r, "c", 1, 1, false)
+	<-sink.writing
+	report(r, "d", 1, 1, false)
+	// Full again, the batch is queued
+	report(r, "e", 1, 1, false)
+	report(r, "f", 1, 1, false)
+	// Full again, but there's no room in the queue
+	report(r, "g", 1, 1, false)
+	report(r, "e", 1, 1, false)
+	r.mx.Lock()
+	assert.EqualValues(t, 1, r.dropped)
+	assert.Len(t, r.current.records, 2)
+	r.mx.Unlock()
+	close(sink.block)
+	assert.NoError(t, r.Close())
+
+	var users []string
+	for _, batch := range sink.getBatches() {
+		for _, rec := range batch {
+			users = append(users, rec.Keys["user"])
+		}
+	}
+	sort.Strings(users)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, users)
+}
+
+func TestFileSinks(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "usage.csv")
+	jsonlFile := filepath.Join(dir, "usage.jsonl")
+	for i := 0; i < 2; i++ {
+		csvSink, err := NewCSVSink(csvFile, []string{"user", "device"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		jsonlSink, err := NewJSONLSink(jsonlFile)
+		if !assert.NoError(t, err) {
+			return
+		}
+		records := []*Record{{
+			Start:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			End:       time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC),
+			Keys:      map[string]string{"user": "alice", "device": "a,b"},
+			BytesSent: 10,
+			BytesRecv: 20,
+		}}
+		assert.NoError(t, csvSink.Write(records))
+		assert.NoError(t, csvSink.Close())
+		assert.NoError(t, jsonlSink.Write(records))
+		assert.NoError(t, jsonlSink.Close())
+	}
+
+	b, _ := ioutil.ReadFile(csvFile)
+	assert.Equal(t, `start,end,user,device,bytes_sent,bytes_recv,conns_closed
+2020-01-01T00:00:00Z,2020-01-01T00:01:00Z,alice,"a,b",10,20,0
+2020-01-01T00:00:00Z,2020-01-01T00:01:00Z,alice,"a,b",10,20,0
+`, string(b), "header should only be written once")
+
+	b, _ = ioutil.ReadFile(jsonlFile)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 2) {
+		var rec Record
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &rec))
+		assert.Equal(t, "a,b", rec.Keys["device"])
+		assert.EqualValues(t, 20, rec.BytesRecv)
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "usage.db")
+	sink, err := NewSQLiteSink(file, "usage", []string{"user", `odd "key"`})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r := New(&Opts{Keys: []string{"user", `odd "key"`}, Sink: sink, FlushInterval: time.Hour})
+	report(r, "alice", 10, 20, true)
+	report(r, "bob", 1, 2, false)
+	assert.NoError(t, r.Close())
+
+	db, err := sql.Open("sqlite", file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+	var user string
+	var sent, recv, closed int64
+	err = db.QueryRow(`SELECT user, bytes_sent, bytes_recv, conns_closed FROM usage WHERE user = 'alice'`).Scan(&user, &sent, &recv, &closed)
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 10, sent)
+		assert.EqualValues(t, 20, recv)
+		assert.EqualValues(t, 1, closed)
+	}
+	var count int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM usage`).Scan(&count))
+	assert.Equal(t, 2, count)
+}
+
+func TestStatsDSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	sink, err := NewStatsDSink(pc.LocalAddr().String(), "proxy", []string{"user"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sink.Close()
+
+	var records []*Record
+	for i := 0; i < 100; i++ {
+		records = append(records, &Record{Keys: map[string]string{"user": "a.l:ice"}, BytesSent: 1, BytesRecv: 2})
+	}
+	records[0].ConnsClosed = 3
+	if !assert.NoError(t, sink.Write(records)) {
+		return
+	}
+
+	var lines []string
+	buf := make([]byte, 65536)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < 201 {
+		n, _, err := pc.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, n <= maxStatsDPacketSize, "packet too big: %d", n)
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	assert.Equal(t, "proxy.a_l_ice.bytes_sent:1|c", lines[0])
+	assert.Equal(t, "proxy.a_l_ice.bytes_recv:2|c", lines[1])
+	assert.Equal(t, "proxy.a_l_ice.conns_closed:3|c", lines[2])
+}
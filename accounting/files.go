@@ -0,0 +1,102 @@
+package accounting
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+type csvSink struct {
+	file *os.File
+	w    *csv.Writer
+	keys []string
+}
+
+// NewCSVSink constructs a Sink that appends records to the CSV file at path,
+// with a column for each of keys. A header row is written if the file is new.
+func NewCSVSink(path string, keys []string) (Sink, error) {
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &csvSink{file: file, w: csv.NewWriter(file), keys: keys}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errors.New("Unable to stat %v: %v", path, err)
+	}
+	if info.Size() == 0 {
+		header := append([]string{"start", "end"}, keys...)
+		header = append(header, "bytes_sent", "bytes_recv", "conns_closed")
+		s.w.Write(header)
+		s.w.Flush()
+		if err := s.w.Error(); err != nil {
+			file.Close()
+			return nil, errors.New("Unable to write header to %v: %v", path, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *csvSink) Write(records []*Record) error {
+	row := make([]string, 0, len(s.keys)+5)
+	for _, rec := range records {
+		row = append(row[:0], rec.Start.UTC().Format(time.RFC3339), rec.End.UTC().Format(time.RFC3339))
+		for _, key := range s.keys {
+			row = append(row, rec.Keys[key])
+		}
+		row = append(row,
+			strconv.FormatInt(rec.BytesSent, 10),
+			strconv.FormatInt(rec.BytesRecv, 10),
+			strconv.FormatInt(rec.ConnsClosed, 10))
+		s.w.Write(row)
+	}
+	s.w.Flush()
+	return s.w.Error()
+}
+
+func (s *csvSink) Close() error {
+	return s.file.Close()
+}
+
+type jsonlSink struct {
+	file *os.File
+}
+
+// NewJSONLSink constructs a Sink that appends records to the file at path, as
+// one JSON object per line.
+func NewJSONLSink(path string) (Sink, error) {
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{file}, nil
+}
+
+func (s *jsonlSink) Write(records []*Record) error {
+	w := bufio.NewWriter(s.file)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *jsonlSink) Close() error {
+	return s.file.Close()
+}
+
+func openAppend(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.New("Unable to open %v: %v", path, err)
+	}
+	return file, nil
+}
@@ -0,0 +1,83 @@
+package accounting
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/getlantern/errors"
+
+	// Registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+type sqliteSink struct {
+	db     *sql.DB
+	insert string
+	keys   []string
+}
+
+// NewSQLiteSink constructs a Sink that inserts records into table in the
+// SQLite database at path, creating the table if necessary. The table has a
+// text column for each of keys.
+func NewSQLiteSink(path string, table string, keys []string) (Sink, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, errors.New("Unable to open %v: %v", path, err)
+	}
+	columns := []string{"start_time TEXT NOT NULL", "end_time TEXT NOT NULL"}
+	names := []string{"start_time", "end_time"}
+	for _, key := range keys {
+		columns = append(columns, quoteIdentifier(key)+" TEXT NOT NULL")
+		names = append(names, quoteIdentifier(key))
+	}
+	columns = append(columns, "bytes_sent INTEGER NOT NULL", "bytes_recv INTEGER NOT NULL", "conns_closed INTEGER NOT NULL")
+	names = append(names, "bytes_sent", "bytes_recv", "conns_closed")
+
+	create := "CREATE TABLE IF NOT EXISTS " + quoteIdentifier(table) + " (" + strings.Join(columns, ", ") + ")"
+	if _, err := db.Exec(create); err != nil {
+		db.Close()
+		return nil, errors.New("Unable to create table %v: %v", table, err)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")
+	return &sqliteSink{
+		db:     db,
+		insert: "INSERT INTO " + quoteIdentifier(table) + " (" + strings.Join(names, ", ") + ") VALUES (" + placeholders + ")",
+		keys:   keys,
+	}, nil
+}
+
+func (s *sqliteSink) Write(records []*Record) error {
+	// A single transaction per batch is much faster than autocommitting each
+	// insert
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(s.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	args := make([]interface{}, 0, len(s.keys)+5)
+	for _, rec := range records {
+		args = append(args[:0], rec.Start.UTC(), rec.End.UTC())
+		for _, key := range s.keys {
+			args = append(args, rec.Keys[key])
+		}
+		args = append(args, rec.BytesSent, rec.BytesRecv, rec.ConnsClosed)
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
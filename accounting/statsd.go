@@ -0,0 +1,104 @@
+package accounting
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// Keeps packets within a typical MTU
+	maxStatsDPacketSize = 1432
+)
+
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+	keys   []string
+}
+
+// NewStatsDSink constructs a Sink that sends records as StatsD counters over
+// UDP to addr. Metric names consist of prefix, the values of keys and the
+// name of the stat, for example "proxy.alice.bytes_sent". Missing values are
+// reported as "unknown".
+func NewStatsDSink(addr string, prefix string, keys []string) (Sink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to dial StatsD at %v: %v", addr, err)
+	}
+	return &statsdSink{conn: conn, prefix: prefix, keys: keys}, nil
+}
+
+func (s *statsdSink) Write(records []*Record) error {
+	var packet bytes.Buffer
+	send := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	add := func(name string, value int64) error {
+		line := name + ":" + strconv.FormatInt(value, 10) + "|c"
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacketSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		return nil
+	}
+
+	for _, rec := range records {
+		parts := make([]string, 0, len(s.keys)+1)
+		if s.prefix != "" {
+			parts = append(parts, s.prefix)
+		}
+		for _, key := range s.keys {
+			parts = append(parts, sanitizeMetricPart(rec.Keys[key]))
+		}
+		name := strings.Join(parts, ".")
+		if name != "" {
+			name += "."
+		}
+		if err := add(name+"bytes_sent", rec.BytesSent); err != nil {
+			return err
+		}
+		if err := add(name+"bytes_recv", rec.BytesRecv); err != nil {
+			return err
+		}
+		if rec.ConnsClosed > 0 {
+			if err := add(name+"conns_closed", rec.ConnsClosed); err != nil {
+				return err
+			}
+		}
+	}
+	return send()
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// sanitizeMetricPart replaces characters that have special meaning to StatsD
+// or Graphite.
+func sanitizeMetricPart(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
@@ -0,0 +1,532 @@
+// Package admin provides an HTTP API for inspecting and controlling a running
+// proxy. It is meant to be served on its own address, separate from the proxy
+// itself.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/pool"
+	"github.com/getlantern/http-proxy/quota"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/server"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+var (
+	log = golog.LoggerFor("admin")
+)
+
+// Opts configures the admin API.
+type Opts struct {
+	// Server is the proxy server being administered.
+	Server *server.Server
+
+	// Username and Password, if set, require HTTP basic authentication.
+	Username string
+	Password string
+
+	// Token, if set, requires an "Authorization: Bearer <token>" header. If
+	// neither Token nor Username and Password are set, only requests from
+	// loopback addresses are allowed, and ListenAndServe refuses to listen on
+	// other addresses.
+	Token string
+
+	// Quota, if set, is exposed under /quotas.
+	Quota *quota.Quota
+
+	// Reload is invoked to reload the proxy's configuration. If nil, reloading
+	// is not supported.
+	Reload func() error
+
+	// Version, RevisionDate and InstanceID are reported by /version.
+	Version      string
+	RevisionDate string
+	InstanceID   string
+}
+
+// Admin is the admin API, usable as an http.Handler.
+type Admin struct {
+	opts    *Opts
+	mux     *http.ServeMux
+	started time.Time
+}
+
+// New constructs a new Admin API.
+func New(opts *Opts) *Admin {
+	a := &Admin{
+		opts:    opts,
+		mux:     http.NewServeMux(),
+		started: time.Now(),
+	}
+	a.mux.HandleFunc("/connections", a.connections)
+	a.mux.HandleFunc("/connections/", a.connection)
+	a.mux.HandleFunc("/limits", a.limits)
+	a.mux.HandleFunc("/slowclients", a.slowClients)
+	a.mux.HandleFunc("/pause", a.pause)
+	a.mux.HandleFunc("/resume", a.resume)
+	a.mux.HandleFunc("/drain", a.drain)
+	a.mux.HandleFunc("/quotas", a.quotas)
+	a.mux.HandleFunc("/quotas/", a.quotaFor)
+	a.mux.HandleFunc("/resolver", a.resolverStats)
+	a.mux.HandleFunc("/dialer", a.dialerStats)
+	a.mux.HandleFunc("/pool", a.poolStats)
+	a.mux.HandleFunc("/circuits", a.circuits)
+	a.mux.HandleFunc("/backends", a.backends)
+	a.mux.HandleFunc("/reload", a.reload)
+	a.mux.HandleFunc("/version", a.version)
+	a.mux.Handle(healthzPath, opts.Server.HealthHandler())
+	a.mux.Handle(readyzPath, opts.Server.HealthHandler())
+	return a
+}
+
+// Handle registers an additional handler on the admin API, protected by the
+// same authentication.
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// ListenAndServe serves the admin API at the given address, which has to be a
+// loopback address unless credentials are configured.
+func (a *Admin) ListenAndServe(addr string, readyCb func(addr string)) error {
+	if !a.hasCredentials() && !isLoopback(addr) {
+		return fmt.Errorf("refusing to serve the admin API on %v without credentials, configure them or listen on a loopback address", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Listen admin on %s", l.Addr())
+	if readyCb != nil {
+		readyCb(l.Addr().String())
+	}
+	return http.Serve(l, a)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Load balancers need to be able to check health without credentials
+	isHealthCheck := req.URL.Path == healthzPath || req.URL.Path == readyzPath
+	if !isHealthCheck && !a.authorized(req) {
+		if a.opts.Token == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="http-proxy admin"`)
+		}
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	a.mux.ServeHTTP(w, req)
+}
+
+func (a *Admin) authorized(req *http.Request) bool {
+	if a.opts.Token != "" {
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		return secureEquals(strings.TrimPrefix(auth, "Bearer "), a.opts.Token)
+	}
+	if a.opts.Username != "" || a.opts.Password != "" {
+		username, password, ok := req.BasicAuth()
+		return ok && secureEquals(username, a.opts.Username) && secureEquals(password, a.opts.Password)
+	}
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *Admin) hasCredentials() bool {
+	return a.opts.Token != "" || a.opts.Username != "" || a.opts.Password != ""
+}
+
+// isLoopback determines whether addr only listens on loopback interfaces.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// GET lists connections, POST applies control messages to them. Connections
+// can be selected with the client_ip and user query parameters.
+func (a *Admin) connections(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodPost) {
+		return
+	}
+	query := req.URL.Query()
+	sel := server.ConnSelector{
+		ClientIP: query.Get("client_ip"),
+		User:     query.Get("user"),
+	}
+	if req.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, a.opts.Server.SelectConnections(sel))
+		return
+	}
+	if sel == (server.ConnSelector{}) && query.Get("all") != "true" {
+		writeError(w, http.StatusBadRequest, "specify client_ip or user, or all=true to control all connections")
+		return
+	}
+	a.control(w, req, sel)
+}
+
+// POST /connections/<id> applies control messages to the connection, DELETE
+// closes it
+func (a *Admin) connection(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(req.URL.Path, "/connections/"), 10, 64)
+	if err != nil || id == 0 {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	if req.Method == http.MethodPost {
+		a.control(w, req, server.ConnSelector{ID: id})
+		return
+	}
+	if !a.opts.Server.CloseConnection(id) {
+		writeError(w, http.StatusNotFound, "no such connection")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"closed": id})
+}
+
+// control is the body accepted when controlling connections, for example
+// {"bandwidth": 125000, "idle_timeout": "30s", "tags": {"plan": "free"}}
+type control struct {
+	Bandwidth   *int64            `json:"bandwidth"`
+	IdleTimeout string            `json:"idle_timeout"`
+	Tags        map[string]string `json:"tags"`
+	Close       bool              `json:"close"`
+}
+
+func (a *Admin) control(w http.ResponseWriter, req *http.Request, sel server.ConnSelector) {
+	var c control
+	if err := json.NewDecoder(req.Body).Decode(&c); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid control message: "+err.Error())
+		return
+	}
+	var msgs []server.ControlMessage
+	if c.Bandwidth != nil {
+		msgs = append(msgs, server.SetBandwidth{BytesPerSecond: *c.Bandwidth})
+	}
+	if c.IdleTimeout != "" {
+		timeout, err := time.ParseDuration(c.IdleTimeout)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid idle_timeout: "+err.Error())
+			return
+		}
+		msgs = append(msgs, server.SetIdleTimeout{Timeout: timeout})
+	}
+	for key, value := range c.Tags {
+		msgs = append(msgs, server.Tag{Key: key, Value: value})
+	}
+	if c.Close {
+		msgs = append(msgs, server.CloseConn{})
+	}
+	if len(msgs) == 0 {
+		writeError(w, http.StatusBadRequest, "no control messages specified")
+		return
+	}
+	n, err := a.opts.Server.Control(sel, msgs...)
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "no matching connections")
+		return
+	}
+	if err != nil {
+		// Messages may have been applied partially, e.g. when some
+		// connections aren't throttled
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	log.Debugf("Applied %d control messages to %d connections", len(msgs), n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"connections": n})
+}
+
+type limits struct {
+	MaxConns uint64 `json:"max_conns"`
+	NumConns uint64 `json:"num_conns"`
+	Stopped  bool   `json:"stopped"`
+	Paused   bool   `json:"paused"`
+}
+
+// GET shows limits, PUT or POST {"max_conns": n} changes them
+func (a *Admin) limits(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodPut, http.MethodPost) {
+		return
+	}
+	limited := a.opts.Server.LimitedListeners()
+	if len(limited) == 0 {
+		writeError(w, http.StatusNotFound, "server has no limited listener")
+		return
+	}
+	if req.Method != http.MethodGet {
+		var update struct {
+			MaxConns *uint64 `json:"max_conns"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&update); err != nil || update.MaxConns == nil {
+			writeError(w, http.StatusBadRequest, "expected {\"max_conns\": <number>}")
+			return
+		}
+		for _, l := range limited {
+			l.SetMaxConns(*update.MaxConns)
+		}
+		log.Debugf("Set max conns to %d", *update.MaxConns)
+	}
+	result := make([]*limits, 0, len(limited))
+	for _, l := range limited {
+		result = append(result, &limits{
+			MaxConns: l.MaxConns(),
+			NumConns: l.NumConns(),
+			Stopped:  l.IsStopped(),
+			Paused:   l.IsPaused(),
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GET shows how many connections were closed for being too slow
+func (a *Admin) slowClients(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	stats, ok := a.opts.Server.SlowClientStats()
+	if !ok {
+		writeError(w, http.StatusNotFound, "server doesn't close slow clients")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *Admin) pause(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	if len(a.opts.Server.LimitedListeners()) == 0 {
+		writeError(w, http.StatusNotFound, "server has no limited listener")
+		return
+	}
+	a.opts.Server.Pause()
+	log.Debug("Paused accepting connections")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"paused": true})
+}
+
+func (a *Admin) resume(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	if len(a.opts.Server.LimitedListeners()) == 0 {
+		writeError(w, http.StatusNotFound, "server has no limited listener")
+		return
+	}
+	a.opts.Server.Resume()
+	log.Debug("Resumed accepting connections")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"paused": false})
+}
+
+// POST marks the server as draining so that it reports not-ready
+func (a *Admin) drain(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	a.opts.Server.Drain()
+	log.Debug("Draining")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"draining": true})
+}
+
+// GET lists the quota status of all known clients
+func (a *Admin) quotas(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	if a.opts.Quota == nil {
+		writeError(w, http.StatusNotFound, "quotas are not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.opts.Quota.All())
+}
+
+// GET /quotas/<key> shows the quota status of a client, like ip:127.0.0.1 or
+// user:alice, DELETE resets it
+func (a *Admin) quotaFor(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if a.opts.Quota == nil {
+		writeError(w, http.StatusNotFound, "quotas are not enabled")
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/quotas/")
+	if req.Method == http.MethodDelete {
+		if !a.opts.Quota.Reset(key) {
+			writeError(w, http.StatusNotFound, "no usage for "+key)
+			return
+		}
+		log.Debugf("Reset quota of %v", key)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"reset": key})
+		return
+	}
+	status, found := a.opts.Quota.Status(key)
+	if !found {
+		writeError(w, http.StatusNotFound, "no usage for "+key)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// GET shows the stats of the default DNS resolver
+func (a *Admin) resolverStats(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	stats := resolver.Default().Stats()
+	writeJSON(w, http.StatusOK, struct {
+		resolver.Stats
+		HitRate float64 `json:"hit_rate"`
+	}{stats, stats.HitRate()})
+}
+
+// GET shows how many upstream connections were established over each address
+// family
+func (a *Admin) dialerStats(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	d := a.opts.Server.Dialer()
+	if d == nil {
+		writeError(w, http.StatusNotFound, "the server uses a custom dial function")
+		return
+	}
+	writeJSON(w, http.StatusOK, d.Stats())
+}
+
+// GET shows how often upstream connections are reused
+func (a *Admin) poolStats(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	p := a.opts.Server.Pool()
+	if p == nil {
+		writeError(w, http.StatusNotFound, "upstream connection pooling is not enabled")
+		return
+	}
+	stats := p.Stats()
+	writeJSON(w, http.StatusOK, struct {
+		pool.Stats
+		ReuseRate float64 `json:"reuse_rate"`
+	}{stats, stats.ReuseRate()})
+}
+
+// GET shows the retries of upstream dials and the circuits to destinations that
+// recently failed
+func (a *Admin) circuits(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	b := a.opts.Server.Breakers()
+	if b == nil {
+		writeError(w, http.StatusNotFound, "circuit breaking is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, b.Stats())
+}
+
+// GET shows the health and load of the reverse proxy's backends
+func (a *Admin) backends(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	r := a.opts.Server.Reverse()
+	if r == nil {
+		writeError(w, http.StatusNotFound, "reverse proxying is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, r.Stats())
+}
+
+func (a *Admin) reload(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodPost) {
+		return
+	}
+	if a.opts.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reloading is not supported")
+		return
+	}
+	if err := a.opts.Reload(); err != nil {
+		log.Errorf("Unable to reload configuration: %v", err)
+		writeError(w, http.StatusInternalServerError, "unable to reload configuration")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reloaded": true})
+}
+
+func (a *Admin) version(w http.ResponseWriter, req *http.Request) {
+	if !allowMethods(w, req, http.MethodGet) {
+		return
+	}
+	info := map[string]interface{}{
+		"version":       a.opts.Version,
+		"revision_date": a.opts.RevisionDate,
+		"instance_id":   a.opts.InstanceID,
+		"go_version":    runtime.Version(),
+		"started":       a.started,
+		"uptime":        time.Since(a.started).String(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info["module_version"] = bi.Main.Version
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info["revision"] = setting.Value
+			case "vcs.time":
+				info["revision_time"] = setting.Value
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func allowMethods(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write admin response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]interface{}{"error": msg})
+}
+
+func secureEquals(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,223 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/quota"
+	"github.com/getlantern/http-proxy/server"
+)
+
+const token = "sekrit"
+
+func TestAdmin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	srv := server.New(&server.Opts{})
+	srv.AddListenerWrappers(
+		func(ls net.Listener) net.Listener {
+			return listeners.NewLimitedListener(ls, 10)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, time.Hour, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {})
+		},
+	)
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	proxyAddr := <-ready
+
+	reloaded := false
+	a := httptest.NewServer(New(&Opts{
+		Server:  srv,
+		Token:   token,
+		Version: "1.2.3",
+		Reload: func() error {
+			if reloaded {
+				return errors.New("already reloaded")
+			}
+			reloaded = true
+			return nil
+		},
+	}))
+	defer a.Close()
+
+	// Unauthorized
+	resp, err := http.Get(a.URL + "/connections")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Open a connection through the proxy
+	conn, err := net.Dial("tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	originHost := origin.Listener.Addr().String()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + originHost + "\r\n\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	proxyResp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ioutil.ReadAll(proxyResp.Body)
+	proxyResp.Body.Close()
+
+	var conns []*server.ConnInfo
+	doRequest(t, a.URL, http.MethodGet, "/connections", "", http.StatusOK, &conns)
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, conn.LocalAddr().String(), conns[0].Client)
+		assert.Equal(t, originHost, conns[0].Target)
+		assert.EqualValues(t, 1, conns[0].Requests)
+		assert.True(t, conns[0].BytesRecv > 0, "should have measured received bytes")
+	}
+
+	if len(conns) == 1 {
+		id := strconv.FormatUint(conns[0].ID, 10)
+		doRequest(t, a.URL, http.MethodPost, "/connections/"+id, `{"tags": {"plan": "pro"}}`, http.StatusOK, nil)
+		doRequest(t, a.URL, http.MethodPost, "/connections/"+id, `{"bandwidth": 1000}`, http.StatusUnprocessableEntity, nil)
+		doRequest(t, a.URL, http.MethodPost, "/connections/"+id, `{}`, http.StatusBadRequest, nil)
+		doRequest(t, a.URL, http.MethodPost, "/connections/"+id, `{"idle_timeout": "forever"}`, http.StatusBadRequest, nil)
+		doRequest(t, a.URL, http.MethodPost, "/connections", `{"tags": {"plan": "free"}}`, http.StatusBadRequest, nil)
+		doRequest(t, a.URL, http.MethodPost, "/connections?user=nobody", `{"tags": {"plan": "free"}}`, http.StatusNotFound, nil)
+		doRequest(t, a.URL, http.MethodGet, "/connections?client_ip=127.0.0.1", "", http.StatusOK, &conns)
+		if assert.Len(t, conns, 1) {
+			assert.Equal(t, map[string]string{"plan": "pro"}, conns[0].Tags)
+		}
+	}
+
+	var lim []*limits
+	doRequest(t, a.URL, http.MethodPut, "/limits", `{"max_conns": 5}`, http.StatusOK, &lim)
+	if assert.Len(t, lim, 1) {
+		assert.EqualValues(t, 5, lim[0].MaxConns)
+		assert.EqualValues(t, 1, lim[0].NumConns)
+	}
+	doRequest(t, a.URL, http.MethodPut, "/limits", `{}`, http.StatusBadRequest, nil)
+
+	doRequest(t, a.URL, http.MethodPost, "/pause", "", http.StatusOK, nil)
+	doRequest(t, a.URL, http.MethodGet, "/limits", "", http.StatusOK, &lim)
+	if assert.Len(t, lim, 1) {
+		assert.True(t, lim[0].Paused)
+	}
+	doRequest(t, a.URL, http.MethodPost, "/resume", "", http.StatusOK, nil)
+	doRequest(t, a.URL, http.MethodGet, "/limits", "", http.StatusOK, &lim)
+	if assert.Len(t, lim, 1) {
+		assert.False(t, lim[0].Paused)
+	}
+
+	if len(conns) == 1 {
+		doRequest(t, a.URL, http.MethodDelete, "/connections/"+strconv.FormatUint(conns[0].ID, 10), "", http.StatusOK, nil)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = br.ReadByte()
+		assert.Error(t, err, "connection should have been closed")
+		doRequest(t, a.URL, http.MethodDelete, "/connections/"+strconv.FormatUint(conns[0].ID, 10), "", http.StatusNotFound, nil)
+	}
+
+	doRequest(t, a.URL, http.MethodPost, "/reload", "", http.StatusOK, nil)
+	assert.True(t, reloaded)
+	doRequest(t, a.URL, http.MethodPost, "/reload", "", http.StatusInternalServerError, nil)
+
+	resp, err = http.Get(a.URL + "/readyz")
+	if assert.NoError(t, err, "health checks should not require authentication") {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	doRequest(t, a.URL, http.MethodPost, "/drain", "", http.StatusOK, nil)
+	resp, err = http.Get(a.URL + "/readyz")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	doRequest(t, a.URL, http.MethodGet, "/quotas", "", http.StatusNotFound, nil)
+
+	var dnsStats map[string]interface{}
+	doRequest(t, a.URL, http.MethodGet, "/resolver", "", http.StatusOK, &dnsStats)
+	assert.Contains(t, dnsStats, "lookups")
+	assert.Contains(t, dnsStats, "hit_rate")
+
+	var dialStats map[string]interface{}
+	doRequest(t, a.URL, http.MethodGet, "/dialer", "", http.StatusOK, &dialStats)
+	assert.EqualValues(t, 1, dialStats["ipv4"])
+
+	doRequest(t, a.URL, http.MethodGet, "/pool", "", http.StatusNotFound, nil)
+	doRequest(t, a.URL, http.MethodGet, "/circuits", "", http.StatusNotFound, nil)
+	doRequest(t, a.URL, http.MethodGet, "/slowclients", "", http.StatusNotFound, nil)
+
+	var version map[string]interface{}
+	doRequest(t, a.URL, http.MethodGet, "/version", "", http.StatusOK, &version)
+	assert.Equal(t, "1.2.3", version["version"])
+	assert.NotEmpty(t, version["go_version"])
+}
+
+func TestWithoutCredentials(t *testing.T) {
+	a := New(&Opts{Server: server.New(&server.Opts{})})
+	assert.Error(t, a.ListenAndServe(":0", nil), "should refuse to listen on all interfaces")
+	assert.Error(t, a.ListenAndServe("192.0.2.1:0", nil), "should refuse to listen on non-loopback addresses")
+
+	for remoteAddr, expectedStatus := range map[string]int{
+		"127.0.0.1:51000": http.StatusOK,
+		"[::1]:51000":     http.StatusOK,
+		"192.0.2.1:51000": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/version", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		assert.Equal(t, expectedStatus, rec.Code, remoteAddr)
+	}
+}
+
+func doRequest(t *testing.T, baseURL string, method string, path string, body string, expectedStatus int, result interface{}) {
+	req, _ := http.NewRequest(method, baseURL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, expectedStatus, resp.StatusCode, "%v %v", method, path)
+	if result != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	q, err := quota.New(&quota.Opts{Daily: quota.Limits{Requests: 10}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	a := httptest.NewServer(New(&Opts{
+		Server: server.New(&server.Opts{}),
+		Token:  token,
+		Quota:  q,
+	}))
+	defer a.Close()
+
+	var all []*quota.Status
+	doRequest(t, a.URL, http.MethodGet, "/quotas", "", http.StatusOK, &all)
+	assert.Empty(t, all)
+	doRequest(t, a.URL, http.MethodGet, "/quotas/ip:127.0.0.1", "", http.StatusNotFound, nil)
+	doRequest(t, a.URL, http.MethodDelete, "/quotas/ip:127.0.0.1", "", http.StatusNotFound, nil)
+}
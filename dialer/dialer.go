@@ -0,0 +1,437 @@
+// Package dialer dials upstream connections for the proxy. It resolves hosts
+// with the resolver package and races connection attempts to the resolved
+// addresses using Happy Eyeballs v2 (RFC 8305), optionally restricted to one
+// address family and bound to a given source address or interface.
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/tracing"
+)
+
+const (
+	// IPv4 and IPv6 name the address families.
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+
+	defaultTimeout = 30 * time.Second
+
+	// defaultFallbackDelay is the Connection Attempt Delay recommended by RFC
+	// 8305.
+	defaultFallbackDelay = 250 * time.Millisecond
+)
+
+var (
+	log = golog.LoggerFor("dialer")
+)
+
+// Mode controls which address families are dialed and in which order.
+type Mode string
+
+const (
+	// PreferIPv4 tries IPv4 addresses first, falling back to IPv6. This is
+	// the default.
+	PreferIPv4 Mode = "prefer-ipv4"
+	// PreferIPv6 tries IPv6 addresses first, falling back to IPv4.
+	PreferIPv6 Mode = "prefer-ipv6"
+	// IPv4Only only dials IPv4 addresses.
+	IPv4Only Mode = "ipv4"
+	// IPv6Only only dials IPv6 addresses.
+	IPv6Only Mode = "ipv6"
+)
+
+// ParseMode parses a Mode, treating the empty string as PreferIPv4.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "":
+		return PreferIPv4, nil
+	case PreferIPv4, PreferIPv6, IPv4Only, IPv6Only:
+		return Mode(s), nil
+	default:
+		return "", errors.New("Unknown address family mode %v", s)
+	}
+}
+
+// Opts configures a Dialer.
+type Opts struct {
+	// Mode controls which address families are dialed. Defaults to
+	// PreferIPv4.
+	Mode Mode
+
+	// FallbackDelay is how long to wait for a connection attempt before
+	// starting the next one in parallel. Defaults to 250ms.
+	FallbackDelay time.Duration
+
+	// Timeout limits how long a dial may take, including DNS resolution.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// LocalAddrs are source addresses to dial from. For each dial, one
+	// address of the matching family is picked using SourceStrategy, and
+	// addresses of families without a source address aren't dialed.
+	LocalAddrs []net.IP
+
+	// Interface, if set, is the name of a network interface to dial from,
+	// using its addresses as LocalAddrs. Ignored if LocalAddrs is set.
+	Interface string
+
+	// SourceStrategy picks among multiple LocalAddrs of the same family.
+	// Defaults to Failover.
+	SourceStrategy Strategy
+
+	// MaxSourceFailures is how many consecutive failed connection attempts
+	// mark a source address as unhealthy. Defaults to 3.
+	MaxSourceFailures int
+
+	// SourceRetryInterval is how long unhealthy source addresses are avoided.
+	// Defaults to 1 minute.
+	SourceRetryInterval time.Duration
+
+	// Resolver resolves host names. Defaults to resolver.Default.
+	Resolver *resolver.Resolver
+}
+
+// Stats counts the dialer's connections by the address family that won.
+type Stats struct {
+	IPv4     int64 `json:"ipv4"`
+	IPv6     int64 `json:"ipv6"`
+	Failures int64 `json:"failures"`
+	// Fallbacks counts connections that weren't established with the first
+	// address tried.
+	Fallbacks int64 `json:"fallbacks"`
+	// Sources describes the source addresses used so far.
+	Sources []SourceStats `json:"sources,omitempty"`
+}
+
+// Dialer dials upstream connections.
+type Dialer struct {
+	opts    *Opts
+	sources *sourcePool
+
+	// dialIP dials a single address, replaceable for testing
+	dialIP func(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error)
+
+	ipv4      int64
+	ipv6      int64
+	failures  int64
+	fallbacks int64
+}
+
+// New constructs a new Dialer. opts may be nil.
+func New(opts *Opts) *Dialer {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	if opts.Mode == "" {
+		opts.Mode = PreferIPv4
+	}
+	if opts.FallbackDelay <= 0 {
+		opts.FallbackDelay = defaultFallbackDelay
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.SourceStrategy == "" {
+		opts.SourceStrategy = Failover
+	}
+	if opts.MaxSourceFailures <= 0 {
+		opts.MaxSourceFailures = defaultMaxSourceFailures
+	}
+	if opts.SourceRetryInterval <= 0 {
+		opts.SourceRetryInterval = defaultSourceRetryInterval
+	}
+	return &Dialer{opts: opts, sources: newSourcePool(opts), dialIP: dialTCP}
+}
+
+// Dial is a proxy.DialFunc.
+func (d *Dialer) Dial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialContext dials addr, racing connection attempts to all of its addresses.
+// UDP sockets, which have no handshake to race, are connected to the first
+// address in order of preference. Only TCP and UDP networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		atomic.AddInt64(&d.failures, 1)
+		return nil, err
+	}
+	family := FamilyOf(conn.RemoteAddr())
+	switch family {
+	case IPv4:
+		atomic.AddInt64(&d.ipv4, 1)
+	case IPv6:
+		atomic.AddInt64(&d.ipv6, 1)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("net.sock.family", family))
+	return conn, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	mode := d.opts.Mode
+	switch network {
+	case "tcp", "udp":
+	case "tcp4", "udp4":
+		mode = IPv4Only
+	case "tcp6", "udp6":
+		mode = IPv6Only
+	default:
+		return nil, errors.New("Unsupported network %v", network)
+	}
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, portString)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.opts.Timeout)
+	defer cancel()
+
+	ips, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	local, err := d.localAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips = order(ips, mode, local)
+	if len(ips) == 0 {
+		return nil, errors.New("No %v addresses to dial for %v", mode, host)
+	}
+	if network[:3] == "udp" {
+		return dialUDP(ctx, ips[0], port, local)
+	}
+	return d.race(ctx, ips, port, local)
+}
+
+func (d *Dialer) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	r := d.opts.Resolver
+	if r == nil {
+		r = resolver.Default()
+	}
+	_, span := tracing.Start(ctx, "dns", attribute.String("net.peer.name", host))
+	ips, err := r.LookupIP(ctx, host)
+	if err == nil {
+		span.SetAttributes(attribute.Int("dns.answers", len(ips)))
+	}
+	tracing.End(span, err)
+	return ips, err
+}
+
+// localAddrs picks the source address to use for each family, or returns nil
+// if unrestricted.
+func (d *Dialer) localAddrs(ctx context.Context, host string) (map[string]net.IP, error) {
+	addrs := d.opts.LocalAddrs
+	if len(addrs) == 0 && d.opts.Interface != "" {
+		iface, err := net.InterfaceByName(d.opts.Interface)
+		if err != nil {
+			return nil, err
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range ifaceAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, ipNet.IP)
+			}
+		}
+		if len(addrs) == 0 {
+			return nil, errors.New("Interface %v has no usable addresses", d.opts.Interface)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	byFamily := make(map[string][]net.IP, 2)
+	for _, ip := range addrs {
+		family := familyOf(ip)
+		byFamily[family] = append(byFamily[family], ip)
+	}
+	local := make(map[string]net.IP, len(byFamily))
+	for family, ips := range byFamily {
+		local[family] = d.sources.pick(ctx, ips, host)
+	}
+	return local, nil
+}
+
+// order filters ips to the families allowed by mode and local, and
+// interleaves them starting with the preferred family as described in
+// section 4 of RFC 8305.
+func order(ips []net.IP, mode Mode, local map[string]net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		family := familyOf(ip)
+		if local != nil && local[family] == nil {
+			continue
+		}
+		if family == IPv4 && mode != IPv6Only {
+			v4 = append(v4, ip)
+		} else if family == IPv6 && mode != IPv4Only {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	if mode == PreferIPv6 {
+		first, second = v6, v4
+	}
+	result := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+	return result
+}
+
+type attempt struct {
+	conn net.Conn
+	err  error
+}
+
+// race starts a connection attempt to each ip in turn, starting the next one
+// when the prior one fails or after FallbackDelay, and returns the first
+// connection established.
+func (d *Dialer) race(ctx context.Context, ips []net.IP, port int, local map[string]net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attempt, len(ips))
+	next, pending := 0, 0
+	timer := time.NewTimer(d.opts.FallbackDelay)
+	defer timer.Stop()
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		source := local[familyOf(ip)]
+		var localAddr *net.TCPAddr
+		if source != nil {
+			localAddr = &net.TCPAddr{IP: source}
+		}
+		go func() {
+			attemptCtx, span := tracing.Start(ctx, "connect", attribute.String("net.peer.ip", ip.String()))
+			conn, err := d.dialIP(attemptCtx, "tcp", localAddr, &net.TCPAddr{IP: ip, Port: port})
+			tracing.End(span, err)
+			if source != nil && ctx.Err() == nil {
+				// Attempts cancelled because another one won say nothing about
+				// the source's health
+				d.sources.result(source, err)
+			}
+			results <- attempt{conn, err}
+		}()
+		timer.Reset(d.opts.FallbackDelay)
+	}
+
+	var firstErr error
+	start()
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if next > 1 {
+					atomic.AddInt64(&d.fallbacks, 1)
+				}
+				go closeLosers(results, pending)
+				return r.conn, nil
+			}
+			log.Debugf("Unable to dial: %v", r.err)
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+			}
+		case <-ctx.Done():
+			go closeLosers(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// closeLosers closes any connections established by attempts that were still
+// pending when the race was decided.
+func closeLosers(results chan attempt, pending int) {
+	for i := 0; i < pending; i++ {
+		if r := <-results; r.conn != nil {
+			r.conn.Close()
+		}
+	}
+}
+
+func dialTCP(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error) {
+	d := &net.Dialer{}
+	if local != nil {
+		d.LocalAddr = local
+	}
+	return d.DialContext(ctx, network, remote.String())
+}
+
+func dialUDP(ctx context.Context, ip net.IP, port int, local map[string]net.IP) (net.Conn, error) {
+	d := &net.Dialer{}
+	if source := local[familyOf(ip)]; source != nil {
+		d.LocalAddr = &net.UDPAddr{IP: source}
+	}
+	return d.DialContext(ctx, "udp", (&net.UDPAddr{IP: ip, Port: port}).String())
+}
+
+// Stats returns the dialer's stats so far.
+func (d *Dialer) Stats() Stats {
+	return Stats{
+		IPv4:      atomic.LoadInt64(&d.ipv4),
+		IPv6:      atomic.LoadInt64(&d.ipv6),
+		Failures:  atomic.LoadInt64(&d.failures),
+		Fallbacks: atomic.LoadInt64(&d.fallbacks),
+		Sources:   d.sources.stats(),
+	}
+}
+
+// FamilyOf returns IPv4 or IPv6 depending on the family of addr's IP, or ""
+// if addr isn't an IP address.
+func FamilyOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return familyOf(a.IP)
+	case *net.UDPAddr:
+		return familyOf(a.IP)
+	case *net.IPAddr:
+		return familyOf(a.IP)
+	}
+	return ""
+}
+
+func familyOf(ip net.IP) string {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
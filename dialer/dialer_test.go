@@ -0,0 +1,350 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+func TestOrder(t *testing.T) {
+	ips := parseIPs("10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1", "fd00::2")
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1", "10.0.0.2", "fd00::2", "10.0.0.3"}, strs(order(ips, PreferIPv4, nil)))
+	assert.Equal(t, []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2", "10.0.0.3"}, strs(order(ips, PreferIPv6, nil)))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, strs(order(ips, IPv4Only, nil)))
+	assert.Equal(t, []string{"fd00::1", "fd00::2"}, strs(order(ips, IPv6Only, nil)))
+	assert.Equal(t, []string{"fd00::1", "fd00::2"}, strs(order(ips, PreferIPv4, map[string]net.IP{IPv6: net.ParseIP("fd00::9")})))
+
+	mode, err := ParseMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, PreferIPv4, mode)
+	mode, err = ParseMode("prefer-ipv6")
+	assert.NoError(t, err)
+	assert.Equal(t, PreferIPv6, mode)
+	_, err = ParseMode("ipv5")
+	assert.Error(t, err)
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	d := newTestDialer(t, &Opts{Mode: PreferIPv6, FallbackDelay: 50 * time.Millisecond})
+	var mx sync.Mutex
+	var dialed []string
+	// IPv6 is black holed, and the first IPv4 address refuses connections
+	d.dialIP = func(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error) {
+		mx.Lock()
+		dialed = append(dialed, remote.IP.String())
+		mx.Unlock()
+		switch remote.IP.String() {
+		case "10.0.0.1":
+			return nil, &net.OpError{Op: "dial", Err: errRefused}
+		case "10.0.0.2":
+			return fakeConn(remote), nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	start := time.Now()
+	conn, err := d.DialContext(context.Background(), "tcp", "dual.test:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	elapsed := time.Since(start)
+	assert.Equal(t, "10.0.0.2:443", conn.RemoteAddr().String())
+	// fd00::1 is given 50ms before 10.0.0.1 is tried, which fails immediately
+	// so that fd00::2 is tried right away and given 50ms before 10.0.0.2 wins
+	assert.True(t, elapsed >= 100*time.Millisecond, "took %v", elapsed)
+	assert.True(t, elapsed < time.Second, "took %v", elapsed)
+	mx.Lock()
+	assert.Equal(t, []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2"}, dialed)
+	mx.Unlock()
+
+	stats := d.Stats()
+	assert.EqualValues(t, 1, stats.IPv4)
+	assert.EqualValues(t, 0, stats.IPv6)
+	assert.EqualValues(t, 1, stats.Fallbacks)
+
+	// Only IPv6, which never connects
+	d.opts.Mode = IPv6Only
+	d.opts.Timeout = 100 * time.Millisecond
+	_, err = d.DialContext(context.Background(), "tcp", "dual.test:443")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = d.DialContext(context.Background(), "tcp", "v4only.test:443")
+	assert.Error(t, err)
+	assert.EqualValues(t, 2, d.Stats().Failures)
+}
+
+func TestAllFail(t *testing.T) {
+	d := newTestDialer(t, &Opts{FallbackDelay: time.Hour})
+	d.dialIP = func(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Addr: remote, Err: errRefused}
+	}
+	start := time.Now()
+	_, err := d.DialContext(context.Background(), "tcp", "dual.test:443")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "10.0.0.1")
+	}
+	assert.True(t, time.Since(start) < time.Second, "failures shouldn't wait for the fallback delay")
+}
+
+func TestLosersClosed(t *testing.T) {
+	d := newTestDialer(t, &Opts{FallbackDelay: 10 * time.Millisecond})
+	closed := make(chan string, 4)
+	d.dialIP = func(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error) {
+		if remote.IP.String() == "10.0.0.1" {
+			// Slow but successful
+			time.Sleep(50 * time.Millisecond)
+		}
+		return &closeRecorder{fakeConn(remote), closed}, nil
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", "dual.test:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "[fd00::1]:443", conn.RemoteAddr().String())
+	select {
+	case addr := <-closed:
+		assert.Equal(t, "10.0.0.1:443", addr)
+	case <-time.After(time.Second):
+		t.Error("losing connection wasn't closed")
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var loopback string
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+
+	for _, opts := range []*Opts{{LocalAddrs: parseIPs("127.0.0.1")}, {Interface: loopback}} {
+		d := newTestDialer(t, opts)
+		conn, err := d.DialContext(context.Background(), "tcp", "local.test:"+port)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.TCPAddr).IP.String())
+			conn.Close()
+		}
+	}
+
+	// No source address for IPv4
+	d := newTestDialer(t, &Opts{LocalAddrs: parseIPs("::1")})
+	_, err = d.DialContext(context.Background(), "tcp", "local.test:"+port)
+	assert.Error(t, err)
+
+	d = newTestDialer(t, &Opts{Interface: "nonexistent0"})
+	_, err = d.DialContext(context.Background(), "tcp", "local.test:"+port)
+	assert.Error(t, err)
+}
+
+func TestSourcePool(t *testing.T) {
+	sources := parseIPs("10.1.0.1", "10.1.0.2", "10.1.0.3", "fd01::1")
+	var mx sync.Mutex
+	var used []string
+	failing := map[string]bool{}
+	newDialer := func(strategy Strategy) *Dialer {
+		d := newTestDialer(t, &Opts{LocalAddrs: sources, SourceStrategy: strategy, SourceRetryInterval: time.Minute})
+		d.dialIP = func(ctx context.Context, network string, local, remote *net.TCPAddr) (net.Conn, error) {
+			mx.Lock()
+			defer mx.Unlock()
+			used = append(used, local.IP.String())
+			if failing[local.IP.String()] {
+				return nil, errSourceUnavailable
+			}
+			if remote.IP.Equal(net.ParseIP("192.0.2.99")) {
+				return nil, errRefused
+			}
+			return fakeConn(remote), nil
+		}
+		return d
+	}
+	dial := func(d *Dialer, clientIP, user, addr string) string {
+		mx.Lock()
+		used = nil
+		mx.Unlock()
+		ctx := WithClient(context.Background(), clientIP, user)
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		return used[len(used)-1]
+	}
+
+	d := newDialer(RoundRobin)
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, dial(d, "", "", "v4only.test:80"))
+	}
+	assert.Equal(t, []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.1"}, picked)
+
+	// Hashing strategies are sticky but spread keys across sources
+	for _, strategy := range []Strategy{ByClientIP, ByUser, ByDestination} {
+		d = newDialer(strategy)
+		distinct := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			key := string(rune('a' + i))
+			addr := "v4only.test:80"
+			if strategy == ByDestination {
+				addr = fmt.Sprintf("10.0.0.%d:80", i)
+			}
+			source := dial(d, "192.0.2."+key, key, addr)
+			assert.Equal(t, source, dial(d, "192.0.2."+key, key, addr), "%v should be sticky", strategy)
+			distinct[source] = true
+		}
+		assert.True(t, len(distinct) > 1, "%v should spread keys", strategy)
+	}
+
+	// Anonymous users are spread by client IP
+	d = newDialer(ByUser)
+	assert.Equal(t, dial(d, "192.0.2.1", "", "v4only.test:80"), newDialer(ByClientIP).sources.pick(WithClient(context.Background(), "192.0.2.1", ""), sources[:3], "").String())
+
+	// Unhealthy sources are avoided
+	d = newDialer(Failover)
+	now := time.Now()
+	d.sources.now = func() time.Time { return now }
+	mx.Lock()
+	failing["10.1.0.1"] = true
+	mx.Unlock()
+	for i := 0; i < 3; i++ {
+		_, err := d.DialContext(context.Background(), "tcp", "v4only.test:80")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, "10.1.0.2", dial(d, "", "", "v4only.test:80"))
+	stats := d.Stats()
+	if assert.Len(t, stats.Sources, 2) {
+		assert.Equal(t, SourceStats{Addr: "10.1.0.1", Dials: 3, Failures: 3, Healthy: false}, stats.Sources[0])
+		assert.Equal(t, SourceStats{Addr: "10.1.0.2", Dials: 1, Failures: 0, Healthy: true}, stats.Sources[1])
+	}
+	now = now.Add(2 * time.Minute)
+	mx.Lock()
+	failing["10.1.0.1"] = false
+	mx.Unlock()
+	assert.Equal(t, "10.1.0.1", dial(d, "", "", "v4only.test:80"), "source should be retried")
+
+	// Failing destinations don't make sources unhealthy
+	for i := 0; i < 5; i++ {
+		_, err := d.DialContext(context.Background(), "tcp", "192.0.2.99:80")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, "10.1.0.1", dial(d, "", "", "v4only.test:80"), "source should still be healthy")
+	assert.True(t, isSourceError(errSourceUnavailable))
+	assert.False(t, isSourceError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}), "unreachable destinations aren't the source's fault")
+
+	// IPv6 uses the IPv6 source
+	assert.Equal(t, "fd01::1", dial(newDialer(Failover), "", "", "[fd00::1]:80"))
+
+	_, err := ParseStrategy("random")
+	assert.Error(t, err)
+}
+
+var (
+	errRefused           = &net.AddrError{Err: "connection refused"}
+	errSourceUnavailable = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}
+)
+
+func newTestDialer(t *testing.T, opts *Opts) *Dialer {
+	r, err := resolver.New(&resolver.Opts{Hosts: map[string][]string{
+		"dual.test":   {"10.0.0.1", "10.0.0.2", "fd00::1", "fd00::2"},
+		"v4only.test": {"10.0.0.1"},
+		"local.test":  {"127.0.0.1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Resolver = r
+	return New(opts)
+}
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func fakeConn(remote *net.TCPAddr) net.Conn {
+	conn, _ := net.Pipe()
+	return &addrConn{conn, remote}
+}
+
+type closeRecorder struct {
+	net.Conn
+	closed chan string
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed <- c.RemoteAddr().String()
+	return c.Conn.Close()
+}
+
+func parseIPs(addrs ...string) []net.IP {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips
+}
+
+func strs(ips []net.IP) []string {
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	return result
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	d := newTestDialer(t, &Opts{Mode: PreferIPv6})
+	conn, err := d.DialContext(context.Background(), "udp", "local.test:"+port)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, pc.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Equal(t, int64(1), d.Stats().IPv4)
+
+	_, err = d.DialContext(context.Background(), "ip", "local.test:"+port)
+	assert.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package dialer
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	defaultMaxSourceFailures   = 3
+	defaultSourceRetryInterval = 1 * time.Minute
+)
+
+type clientKey struct{}
+
+type client struct {
+	ip   string
+	user string
+}
+
+// WithClient records the IP and user, if known, of the client on whose behalf
+// connections are dialed with ctx, for use by the ByClientIP and ByUser
+// strategies. The server does this for every upstream dial.
+func WithClient(ctx context.Context, clientIP string, user string) context.Context {
+	return context.WithValue(ctx, clientKey{}, &client{clientIP, user})
+}
+
+// Strategy picks a source address from the addresses of the family being
+// dialed.
+type Strategy string
+
+const (
+	// Failover uses the first healthy address. This is the default.
+	Failover Strategy = "failover"
+	// RoundRobin cycles through the healthy addresses.
+	RoundRobin Strategy = "round-robin"
+	// ByClientIP consistently uses the same address for the same client IP.
+	ByClientIP Strategy = "client-ip"
+	// ByUser consistently uses the same address for the same user, falling
+	// back to the client IP for anonymous clients.
+	ByUser Strategy = "user"
+	// ByDestination consistently uses the same address for the same
+	// destination host.
+	ByDestination Strategy = "destination"
+)
+
+// ParseStrategy parses a Strategy, treating the empty string as Failover.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case "":
+		return Failover, nil
+	case Failover, RoundRobin, ByClientIP, ByUser, ByDestination:
+		return Strategy(s), nil
+	default:
+		return "", errors.New("Unknown source address strategy %v", s)
+	}
+}
+
+// SourceStats describes the use of a source address.
+type SourceStats struct {
+	Addr     string `json:"addr"`
+	Dials    int64  `json:"dials"`
+	Failures int64  `json:"failures"`
+	Healthy  bool   `json:"healthy"`
+}
+
+type sourceHealth struct {
+	dials          int64
+	failures       int64
+	consecutive    int
+	unhealthyUntil time.Time
+}
+
+// sourcePool picks source addresses and tracks their health. An address is
+// marked unhealthy after MaxSourceFailures consecutive connection attempts
+// that failed because of the address itself (see isSourceError) and avoided
+// for SourceRetryInterval, unless no healthy addresses remain.
+type sourcePool struct {
+	opts   *Opts
+	next   uint64
+	health map[string]*sourceHealth
+	now    func() time.Time
+	mx     sync.Mutex
+}
+
+func newSourcePool(opts *Opts) *sourcePool {
+	return &sourcePool{opts: opts, health: make(map[string]*sourceHealth), now: time.Now}
+}
+
+// pick picks a source address from addrs, which all belong to the same family.
+func (p *sourcePool) pick(ctx context.Context, addrs []net.IP, host string) net.IP {
+	if len(addrs) == 1 {
+		return addrs[0]
+	}
+	candidates := p.healthy(addrs)
+
+	var key string
+	c, _ := ctx.Value(clientKey{}).(*client)
+	switch p.opts.SourceStrategy {
+	case Failover:
+		return candidates[0]
+	case ByClientIP:
+		if c != nil {
+			key = c.ip
+		}
+	case ByUser:
+		if c != nil {
+			key = c.user
+			if key == "" {
+				key = c.ip
+			}
+		}
+	case ByDestination:
+		key = host
+	}
+	if key == "" {
+		return candidates[int(atomic.AddUint64(&p.next, 1)-1)%len(candidates)]
+	}
+
+	// Rendezvous hashing keeps keys on the same address as long as it's
+	// healthy, and only moves the keys of addresses that become unhealthy
+	var best net.IP
+	var bestScore uint64
+	for _, ip := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(ip.String()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = ip, score
+		}
+	}
+	return best
+}
+
+func (p *sourcePool) healthy(addrs []net.IP) []net.IP {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	now := p.now()
+	healthy := make([]net.IP, 0, len(addrs))
+	for _, ip := range addrs {
+		if h := p.health[ip.String()]; h == nil || !now.Before(h.unhealthyUntil) {
+			healthy = append(healthy, ip)
+		}
+	}
+	if len(healthy) == 0 {
+		return addrs
+	}
+	return healthy
+}
+
+// result records the outcome of a connection attempt from ip.
+func (p *sourcePool) result(ip net.IP, err error) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	h := p.health[ip.String()]
+	if h == nil {
+		h = &sourceHealth{}
+		p.health[ip.String()] = h
+	}
+	h.dials++
+	if err == nil {
+		h.consecutive = 0
+		h.unhealthyUntil = time.Time{}
+		return
+	}
+	if !isSourceError(err) {
+		// Refused connections and timeouts are likely down to the
+		// destination, which mustn't take the source out of rotation for
+		// everyone else
+		return
+	}
+	h.failures++
+	h.consecutive++
+	if h.consecutive >= p.opts.MaxSourceFailures {
+		if p.now().After(h.unhealthyUntil) {
+			log.Errorf("Source address %v failed %d times in a row, avoiding it for %v", ip, h.consecutive, p.opts.SourceRetryInterval)
+		}
+		h.unhealthyUntil = p.now().Add(p.opts.SourceRetryInterval)
+	}
+}
+
+// isSourceError determines whether err is attributable to the local side of
+// a connection attempt, like the source address not being assigned anymore or
+// its network being down. Unreachable networks aren't, since that depends on
+// the destination.
+func isSourceError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	sysErr, ok := err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	if sysErr.Syscall == "bind" {
+		return true
+	}
+	switch sysErr.Err {
+	case syscall.EADDRNOTAVAIL, syscall.EADDRINUSE, syscall.ENETDOWN:
+		return true
+	}
+	return false
+}
+
+func (p *sourcePool) stats() []SourceStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	now := p.now()
+	stats := make([]SourceStats, 0, len(p.health))
+	for addr, h := range p.health {
+		stats = append(stats, SourceStats{
+			Addr:     addr,
+			Dials:    h.dials,
+			Failures: h.failures,
+			Healthy:  !now.Before(h.unhealthyUntil),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr < stats[j].Addr })
+	return stats
+}
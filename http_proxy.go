@@ -1,17 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/filters"
 
+	"github.com/getlantern/http-proxy/accounting"
+	"github.com/getlantern/http-proxy/admin"
+	"github.com/getlantern/http-proxy/dialer"
 	"github.com/getlantern/http-proxy/listeners"
 	"github.com/getlantern/http-proxy/logging"
+	"github.com/getlantern/http-proxy/pac"
+	"github.com/getlantern/http-proxy/pool"
 	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/quota"
+	"github.com/getlantern/http-proxy/resilience"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/reverse"
 	"github.com/getlantern/http-proxy/server"
+	"github.com/getlantern/http-proxy/tracing"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+// version and revisionDate are set at build time, like with
+// -ldflags "-X main.version=1.2.3 -X main.revisionDate=2020-03-02"
+var (
+	version      = "development"
+	revisionDate = "unknown"
 )
 
 var (
@@ -24,6 +48,59 @@ var (
 	addr      = flag.String("addr", ":8080", "Address to listen")
 	maxConns  = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
 	idleClose = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+
+	enableHTTP2 = flag.Bool("http2", false, "Allow clients of the TLS listener to use HTTP/2")
+	h3Addr      = flag.String("h3addr", "", "UDP address to serve HTTP/3, including CONNECT-UDP, on, disabled if empty")
+
+	transparentAddr = flag.String("transparentaddr", "", "Address to accept connections redirected by iptables on (Linux only), disabled if empty")
+	tproxy          = flag.Bool("tproxy", false, "Expect connections to transparentaddr from the TPROXY target instead of REDIRECT")
+	sniAddr         = flag.String("sniaddr", "", "Address to accept TLS connections on and tunnel them to port 443 of their server name without terminating TLS, disabled if empty")
+	pacConfig       = flag.String("pacconfig", "", "JSON file with the rules of the PAC file to serve at /proxy.pac and /wpad.dat, which the proxy enforces too if it sets enforce, disabled if empty")
+	reverseConfig   = flag.String("reverseconfig", "", "JSON file with the routes and backend pools to reverse proxy origin-form requests to, disabled if empty")
+
+	enableWebSocket  = flag.Bool("websocket", false, "Relay plain ws:// WebSockets frame by frame, enforcing the ws* limits, instead of passing them through unchanged")
+	wsMaxMessageSize = flag.Int64("wsmaxmessagesize", 16*1024*1024, "Largest WebSocket message in bytes, if -websocket is set")
+	wsMessageRate    = flag.Float64("wsmessagerate", 0, "Max WebSocket messages per second in each direction if -websocket is set, 0 means unlimited")
+	wsIdleTimeout    = flag.Duration("wsidletimeout", 10*time.Minute, "How long WebSockets may go without any frames, including pings, before closing them if -websocket is set, 0 means never")
+
+	upstreamIdleTimeout   = flag.Duration("upstreamidletimeout", 0, "How long upstream connections may be idle before closing them, 0 means never")
+	dialTimeout           = flag.Duration("dialtimeout", 30*time.Second, "How long dialing upstream, including DNS resolution, may take")
+	requestHeaderTimeout  = flag.Duration("requestheadertimeout", 10*time.Second, "How long clients may take to send a request header once they've started it, 0 means unlimited")
+	responseHeaderTimeout = flag.Duration("responseheadertimeout", 0, "How long upstreams may take to send a response header, 0 means unlimited")
+	tlsHandshakeTimeout   = flag.Duration("tlshandshaketimeout", 10*time.Second, "How long TLS handshakes with clients may take, 0 means unlimited. Also limits handshakes with -upstreampool and -reverseconfig upstreams")
+	maxTunnelLifetime     = flag.Duration("maxtunnellifetime", 0, "How long CONNECT tunnels may stay open, 0 means unlimited")
+	minClientRate         = flag.Int64("minclientrate", 0, "Min bytes per second that active client connections have to transfer, averaged over 10 seconds, 0 means unlimited")
+
+	adminAddr  = flag.String("adminaddr", "", "Address for the admin API to listen on, disabled if empty")
+	adminToken = flag.String("admintoken", "", "Bearer token required to access the admin API, which may then only listen on a loopback address if empty")
+	instanceID = flag.String("instanceid", "", "Identifies this proxy in logs and the admin API, defaults to the host name")
+
+	drainTimeout = flag.Duration("draintimeout", 30*time.Second, "How long to wait for open connections to finish on SIGTERM or SIGINT before exiting")
+
+	dailyQuota   = flag.Int64("dailyquota", 0, "Bytes that each client IP may transfer per day, unlimited if 0")
+	monthlyQuota = flag.Int64("monthlyquota", 0, "Bytes that each client IP may transfer per month, unlimited if 0")
+	quotaFile    = flag.String("quotafile", "quota.json", "File in which to persist quota usage")
+
+	usageFile = flag.String("usagefile", "", "File to log usage to, as CSV if it ends in .csv and JSON lines otherwise, disabled if empty")
+	usageKeys = flag.String("usagekeys", "quota_key", "Comma separated keys of the measured context to aggregate usage by")
+
+	dnsServers = flag.String("dnsservers", "", "Comma separated DNS servers to resolve with, like 8.8.8.8, tls://1.1.1.1 or https://dns.google/dns-query, uses the system resolver if empty")
+	dnsHosts   = flag.String("dnshosts", "", "Comma separated static host overrides, like example.com=10.0.0.1")
+
+	ipMode          = flag.String("ipmode", "prefer-ipv4", "Address families to dial upstream: prefer-ipv4, prefer-ipv6, ipv4 or ipv6")
+	sourceAddrs     = flag.String("sourceaddrs", "", "Comma separated source IP addresses to dial upstream from")
+	egressInterface = flag.String("egressinterface", "", "Network interface to dial upstream from, ignored if sourceaddrs is set")
+	sourceStrategy  = flag.String("sourcestrategy", "failover", "How to pick among several source addresses: failover, round-robin, client-ip, user or destination")
+
+	upstreamPool   = flag.Bool("upstreampool", false, "Share upstream connections for plain HTTP requests across all clients")
+	maxIdlePerHost = flag.Int("maxidleperhost", 10, "Max number of idle pooled upstream connections per destination")
+
+	dialRetries      = flag.Int("dialretries", 0, "Number of times to retry failed upstream dials for idempotent requests")
+	circuitThreshold = flag.Int("circuitthreshold", 0, "Consecutive failed dials to a destination that open its circuit, enables circuit breaking with a default of 5 if dialretries is set")
+	circuitTimeout   = flag.Duration("circuittimeout", 30*time.Second, "How long a circuit stays open before the destination is probed again")
+
+	otlpEndpoint = flag.String("otlpendpoint", "", "host:port of an OTLP/HTTP collector to export traces to, tracing is disabled if empty")
+	otlpInsecure = flag.Bool("otlpinsecure", false, "Use plain HTTP to talk to the OTLP collector")
 )
 
 func main() {
@@ -35,18 +112,136 @@ func main() {
 		return
 	}
 
+	if *instanceID == "" {
+		*instanceID, _ = os.Hostname()
+	}
+
 	// Logging
-	// TODO: use real parameters
-	err = logging.Init("instanceid", "version", "releasedate")
+	err = logging.Init(*instanceID, version, revisionDate)
 	if err != nil {
 		log.Error(err)
 	}
 
+	// Tracing
+	if *otlpEndpoint != "" {
+		shutdownTracing, err := tracing.Init(&tracing.Opts{
+			Endpoint: *otlpEndpoint,
+			Insecure: *otlpInsecure,
+		})
+		if err != nil {
+			log.Errorf("Unable to initialize tracing: %v", err)
+		} else {
+			defer shutdownTracing(context.Background())
+		}
+	}
+
+	// DNS
+	if *dnsServers != "" || *dnsHosts != "" {
+		opts := &resolver.Opts{Hosts: make(map[string][]string)}
+		if *dnsServers != "" {
+			opts.Servers = strings.Split(*dnsServers, ",")
+		}
+		if *dnsHosts != "" {
+			for _, override := range strings.Split(*dnsHosts, ",") {
+				parts := strings.SplitN(override, "=", 2)
+				if len(parts) != 2 {
+					log.Fatalf("Invalid host override %v", override)
+				}
+				opts.Hosts[parts[0]] = append(opts.Hosts[parts[0]], parts[1])
+			}
+		}
+		r, err := resolver.New(opts)
+		if err != nil {
+			log.Fatalf("Unable to initialize resolver: %v", err)
+		}
+		resolver.SetDefault(r)
+	}
+
+	// Quotas
+	filter := filters.Join(proxyfilters.BlockLocal([]string{}))
+	var q *quota.Quota
+	if *dailyQuota > 0 || *monthlyQuota > 0 {
+		q, err = quota.New(&quota.Opts{
+			Daily:   quota.Limits{Bytes: *dailyQuota},
+			Monthly: quota.Limits{Bytes: *monthlyQuota},
+			File:    *quotaFile,
+		})
+		if err != nil {
+			log.Fatalf("Unable to initialize quotas: %v", err)
+		}
+		defer q.Close()
+		filter = filter.Append(q.Filter())
+	}
+
+	// Upstream dialing
+	mode, err := dialer.ParseMode(*ipMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	strategy, err := dialer.ParseStrategy(*sourceStrategy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialerOpts := &dialer.Opts{Mode: mode, Interface: *egressInterface, SourceStrategy: strategy}
+	if *sourceAddrs != "" {
+		for _, addr := range strings.Split(*sourceAddrs, ",") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				log.Fatalf("Invalid source address %v", addr)
+			}
+			dialerOpts.LocalAddrs = append(dialerOpts.LocalAddrs, ip)
+		}
+	}
+
 	// Create server
-	srv := server.New(&server.Opts{
-		IdleTimeout: time.Duration(*idleClose),
-		Filter:      proxyfilters.BlockLocal([]string{}),
-	})
+	opts := &server.Opts{
+		IdleTimeout:           time.Duration(*idleClose) * time.Second,
+		UpstreamIdleTimeout:   *upstreamIdleTimeout,
+		DialTimeout:           *dialTimeout,
+		RequestHeaderTimeout:  *requestHeaderTimeout,
+		ResponseHeaderTimeout: *responseHeaderTimeout,
+		TLSHandshakeTimeout:   *tlsHandshakeTimeout,
+		MaxTunnelLifetime:     *maxTunnelLifetime,
+		HTTP2:                 *enableHTTP2,
+		Filter:                filter,
+		Dialer:                dialerOpts,
+	}
+	if *enableWebSocket {
+		opts.WebSocket = &websocket.Opts{
+			MaxMessageSize:    *wsMaxMessageSize,
+			MessagesPerSecond: *wsMessageRate,
+			IdleTimeout:       *wsIdleTimeout,
+		}
+	}
+	if *upstreamPool {
+		opts.UpstreamPool = &pool.Opts{
+			MaxIdlePerHost: *maxIdlePerHost,
+		}
+	}
+	if *dialRetries > 0 || *circuitThreshold > 0 {
+		opts.Resilience = &resilience.Opts{
+			Retries:          *dialRetries,
+			FailureThreshold: *circuitThreshold,
+			OpenTimeout:      *circuitTimeout,
+		}
+	}
+	if *pacConfig != "" {
+		if opts.PAC, err = loadPAC(); err != nil {
+			log.Fatalf("Unable to load PAC config: %v", err)
+		}
+	}
+	if *reverseConfig != "" {
+		if opts.Reverse, err = reverse.Load(*reverseConfig); err != nil {
+			log.Fatalf("Unable to load reverse proxy config: %v", err)
+		}
+	}
+	srv := server.New(opts)
+	if p := srv.Pool(); p != nil {
+		defer p.Close()
+	}
+	if r := srv.Reverse(); r != nil {
+		defer r.Close()
+	}
 
 	// Add net.Listener wrappers for inbound connections
 	srv.AddListenerWrappers(
@@ -59,14 +254,166 @@ func main() {
 			return listeners.NewIdleConnListener(ls, time.Duration(*idleClose)*time.Second)
 		},
 	)
+	if *minClientRate > 0 {
+		// Close connections of clients that hog connection slots by being slow
+		srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+			return listeners.NewSlowClientListener(ls, &listeners.SlowClientOpts{
+				MinBytesPerSecond: *minClientRate,
+			})
+		})
+	}
+	// Usage accounting
+	var reports []listeners.MeasuredReportFN
+	if q != nil {
+		// Count bytes against quotas
+		reports = append(reports, q.Report)
+	}
+	if *usageFile != "" {
+		keys := strings.Split(*usageKeys, ",")
+		var sink accounting.Sink
+		if strings.HasSuffix(*usageFile, ".csv") {
+			sink, err = accounting.NewCSVSink(*usageFile, keys)
+		} else {
+			sink, err = accounting.NewJSONLSink(*usageFile)
+		}
+		if err != nil {
+			log.Fatalf("Unable to open usage file: %v", err)
+		}
+		reporter := accounting.New(&accounting.Opts{Keys: keys, Sink: sink})
+		defer reporter.Close()
+		reports = append(reports, reporter.Report)
+	}
+	if len(reports) > 0 {
+		srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, 5*time.Second, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+				for _, report := range reports {
+					report(ctx, stats, deltaStats, final)
+				}
+			})
+		})
+	}
+
+	// Admin API
+	if *adminAddr != "" {
+		a := admin.New(&admin.Opts{
+			Server:       srv,
+			Token:        *adminToken,
+			Quota:        q,
+			Reload:       func() error { return reload(srv) },
+			InstanceID:   *instanceID,
+			Version:      version,
+			RevisionDate: revisionDate,
+		})
+		go func() {
+			if err := a.ListenAndServe(*adminAddr, nil); err != nil {
+				log.Errorf("Error serving admin API: %v", err)
+			}
+		}()
+	}
+
+	if *h3Addr != "" {
+		go func() {
+			if err := srv.ListenAndServeHTTP3(*h3Addr, *keyfile, *certfile, nil); err != nil {
+				log.Errorf("Error serving HTTP/3: %v", err)
+			}
+		}()
+	}
+
+	if *transparentAddr != "" {
+		go func() {
+			if err := srv.ListenAndServeTransparent(*transparentAddr, *tproxy, nil); err != nil {
+				log.Errorf("Error serving transparent proxy: %v", err)
+			}
+		}()
+	}
+
+	if *sniAddr != "" {
+		go func() {
+			if err := srv.ListenAndServeSNI(*sniAddr, nil); err != nil {
+				log.Errorf("Error serving SNI passthrough: %v", err)
+			}
+		}()
+	}
 
 	// Serve HTTP/S
-	if *https {
-		err = srv.ListenAndServeHTTPS(*addr, *keyfile, *certfile, nil)
-	} else {
-		err = srv.ListenAndServeHTTP(*addr, nil)
+	served := make(chan error, 1)
+	go func() {
+		if *https {
+			served <- srv.ListenAndServeHTTPS(*addr, *keyfile, *certfile, nil)
+		} else {
+			served <- srv.ListenAndServeHTTP(*addr, nil)
+		}
+	}()
+
+	// Return on SIGTERM or SIGINT so that deferred functions flush quotas and
+	// usage before exiting
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err = <-served:
+		log.Errorf("Error serving: %v", err)
+	case sig := <-signals:
+		log.Debugf("Received %v, draining connections for up to %v", sig, *drainTimeout)
+		srv.Drain()
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		if err := srv.AwaitDrained(ctx); err != nil {
+			log.Debugf("Shutting down with connections still open: %v", err)
+		}
+		cancel()
 	}
+}
+
+// loadPAC loads the PAC config, adding rules that tell clients to reach the
+// destinations that BlockLocal refuses to proxy directly, ahead of the
+// configured ones.
+func loadPAC() (*pac.Opts, error) {
+	opts, err := pac.Load(*pacConfig)
 	if err != nil {
-		log.Errorf("Error serving: %v", err)
+		return nil, err
+	}
+	local := []pac.Rule{{Domain: "localhost", Action: pac.Direct}}
+	for _, n := range proxyfilters.LocalNetworks() {
+		local = append(local, pac.Rule{CIDR: n.String(), Action: pac.Direct})
+	}
+	opts.Rules = append(append([]pac.Rule{}, local...), opts.Rules...)
+	for i := range opts.Variations {
+		// Variations are matched first, so they can't be allowed to override
+		// these either
+		opts.Variations[i].Rules = append(append([]pac.Rule{}, local...), opts.Variations[i].Rules...)
+	}
+	return opts, nil
+}
+
+// reload reloads the PAC and reverse proxy configuration files, applying
+// neither if either is invalid.
+func reload(srv *server.Server) error {
+	var pacOpts *pac.Opts
+	var reverseOpts *reverse.Opts
+	var err error
+	if *pacConfig != "" {
+		if pacOpts, err = loadPAC(); err != nil {
+			return err
+		}
+		if _, err = pac.New(pacOpts); err != nil {
+			return err
+		}
+	}
+	if *reverseConfig != "" && srv.Reverse() != nil {
+		if reverseOpts, err = reverse.Load(*reverseConfig); err != nil {
+			return err
+		}
+	}
+	// The reverse proxy config is validated by applying it, so apply it first
+	if reverseOpts != nil {
+		if err := srv.Reverse().Update(reverseOpts); err != nil {
+			return err
+		}
+	}
+	if pacOpts != nil {
+		if err := srv.UpdatePAC(pacOpts); err != nil {
+			return err
+		}
 	}
+	log.Debug("Reloaded configuration")
+	return nil
 }
@@ -0,0 +1,140 @@
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/getlantern/netx"
+)
+
+// ErrUnhandled is returned by Send when no connection in the wrapped chain
+// handled a message.
+var ErrUnhandled = errors.New("unhandled control message")
+
+// A Message is a typed control message for connections. See Send.
+type Message interface {
+	// MessageType is the type used for this message by the string-based
+	// WrapConn.ControlMessage API.
+	MessageType() string
+}
+
+// A MessageHandler is a connection that handles typed control messages.
+type MessageHandler interface {
+	// HandleMessage handles msg, returning handled=false if it's not a message
+	// this connection understands. The result, if any, is reported in the Ack.
+	HandleMessage(msg Message) (result interface{}, handled bool, err error)
+}
+
+// An Ack acknowledges that a connection handled a message.
+type Ack struct {
+	// Conn is the connection within the wrapped chain that handled the
+	// message.
+	Conn net.Conn
+	// Result is the result returned by the connection's MessageHandler.
+	Result interface{}
+}
+
+// UpdateMeasuredContext merges its entries into the context reported for
+// measured connections (see NewMeasuredListener). Its MessageType is
+// MsgMeasured.
+type UpdateMeasuredContext map[string]interface{}
+
+func (msg UpdateMeasuredContext) MessageType() string { return MsgMeasured }
+
+// SetBandwidth sets the bandwidth limit of throttled connections (see
+// NewThrottledListener). The result is the prior limit as an int64. Its
+// MessageType is MsgBandwidth.
+type SetBandwidth struct {
+	// BytesPerSecond is the new limit, with 0 meaning unlimited.
+	BytesPerSecond int64
+}
+
+func (msg SetBandwidth) MessageType() string { return MsgBandwidth }
+
+// SetIdleTimeout sets the idle timeout of idle timing connections (see
+// NewIdleConnListener). The result is the prior timeout as a time.Duration.
+// Its MessageType is MsgIdleTimeout.
+type SetIdleTimeout struct {
+	// Timeout is the new idle timeout, with 0 meaning never.
+	Timeout time.Duration
+}
+
+func (msg SetIdleTimeout) MessageType() string { return MsgIdleTimeout }
+
+// Send dispatches msg to every MessageHandler in conn's chain of wrapped
+// connections, from the outermost to the innermost, and returns their
+// acknowledgements. If a handler fails, Send stops and returns the
+// acknowledgements so far along with the error. If no connection handles the
+// message, the returned error wraps ErrUnhandled.
+func Send(conn net.Conn, msg Message) ([]Ack, error) {
+	var acks []Ack
+	var err error
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		handler, ok := wrapped.(MessageHandler)
+		if !ok {
+			return true
+		}
+		result, handled, handleErr := handler.HandleMessage(msg)
+		if handleErr != nil {
+			err = fmt.Errorf("%T unable to handle %v message: %w", wrapped, msg.MessageType(), handleErr)
+			return false
+		}
+		if handled {
+			acks = append(acks, Ack{Conn: wrapped, Result: result})
+		}
+		return true
+	})
+	if err == nil && len(acks) == 0 {
+		err = fmt.Errorf("%v: %w", msg.MessageType(), ErrUnhandled)
+	}
+	return acks, err
+}
+
+// ParseMessage converts a message from the string-based
+// WrapConn.ControlMessage API into a typed Message, returning an error if
+// msgType is unknown or data doesn't have the expected type.
+func ParseMessage(msgType string, data interface{}) (Message, error) {
+	switch msgType {
+	case MsgMeasured:
+		ctxUpdate, ok := data.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v message expects map[string]interface{}, got %T", msgType, data)
+		}
+		return UpdateMeasuredContext(ctxUpdate), nil
+	case MsgBandwidth:
+		bytesPerSecond, ok := data.(int64)
+		if !ok {
+			return nil, fmt.Errorf("%v message expects int64, got %T", msgType, data)
+		}
+		return SetBandwidth{BytesPerSecond: bytesPerSecond}, nil
+	case MsgIdleTimeout:
+		timeout, ok := data.(time.Duration)
+		if !ok {
+			return nil, fmt.Errorf("%v message expects time.Duration, got %T", msgType, data)
+		}
+		return SetIdleTimeout{Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("%v: %w", msgType, ErrUnhandled)
+	}
+}
+
+// handleControlMessage adapts the string-based ControlMessage API for a
+// connection that handles messages of type handles. Messages are passed down
+// to the wrapped connection regardless, as ControlMessage always has.
+func handleControlMessage(handler MessageHandler, wrapped WrapConnEmbeddable, handles string, msgType string, data interface{}) {
+	if msgType == handles {
+		msg, err := ParseMessage(msgType, data)
+		if err == nil {
+			_, _, err = handler.HandleMessage(msg)
+		}
+		if err != nil {
+			log.Errorf("Ignoring %v control message: %v", msgType, err)
+		}
+	}
+
+	if wrapped != nil {
+		wrapped.ControlMessage(msgType, data)
+	}
+}
@@ -1,8 +1,11 @@
 package listeners
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/idletiming"
@@ -31,7 +34,8 @@ func (l *idleConnListener) Accept() (c net.Conn, err error) {
 }
 
 // WrapIdleConn wraps the given conn in an idletiming conn using the given
-// idleTimeout.
+// idleTimeout. The timeout can be changed later with the MsgIdleTimeout control
+// message.
 func WrapIdleConn(conn net.Conn, idleTimeout time.Duration) net.Conn {
 	iConn := idletiming.Conn(conn, idleTimeout, nil)
 
@@ -39,6 +43,10 @@ func WrapIdleConn(conn net.Conn, idleTimeout time.Duration) net.Conn {
 	return &idleConn{
 		WrapConnEmbeddable: sac,
 		Conn:               iConn,
+		iConn:              iConn,
+		lastActivity:       time.Now().UnixNano(),
+		idleTimeout:        int64(idleTimeout),
+		closed:             make(chan struct{}),
 	}
 }
 
@@ -46,6 +54,50 @@ func WrapIdleConn(conn net.Conn, idleTimeout time.Duration) net.Conn {
 type idleConn struct {
 	WrapConnEmbeddable
 	net.Conn
+	iConn *idletiming.IdleTimingConn
+
+	lastActivity int64
+	// idleTimeout starts out as the idletiming timeout. Once it's changed by a
+	// control message, idletiming is paused and watchIdle takes over.
+	idleTimeout int64
+	unpause     func()
+	timeoutSet  chan struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+	mx          sync.Mutex
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mx.Lock()
+		if c.unpause != nil {
+			c.unpause()
+		}
+		c.mx.Unlock()
+	})
+	// IdleTimingConn.Close waits for pending reads and writes, which may take
+	// up to half the idle timeout, so close the wrapped connection first to
+	// interrupt them.
+	err := c.iConn.Wrapped().Close()
+	c.Conn.Close()
+	return err
 }
 
 func (c *idleConn) OnState(s http.ConnState) {
@@ -54,10 +106,75 @@ func (c *idleConn) OnState(s http.ConnState) {
 	}
 }
 
+// Responds to the MsgIdleTimeout message type
 func (c *idleConn) ControlMessage(msgType string, data interface{}) {
-	// Simply pass down the control message to the wrapped connection
-	if c.WrapConnEmbeddable != nil {
-		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	handleControlMessage(c, c.WrapConnEmbeddable, MsgIdleTimeout, msgType, data)
+}
+
+// Handles SetIdleTimeout
+func (c *idleConn) HandleMessage(msg Message) (interface{}, bool, error) {
+	setIdleTimeout, ok := msg.(SetIdleTimeout)
+	if !ok {
+		return nil, false, nil
+	}
+	if setIdleTimeout.Timeout < 0 {
+		return nil, true, fmt.Errorf("invalid idle timeout %v", setIdleTimeout.Timeout)
+	}
+	return c.setIdleTimeout(setIdleTimeout.Timeout), true, nil
+}
+
+// setIdleTimeout sets the timeout and returns the prior one
+func (c *idleConn) setIdleTimeout(timeout time.Duration) time.Duration {
+	prior := time.Duration(atomic.SwapInt64(&c.idleTimeout, int64(timeout)))
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	select {
+	case <-c.closed:
+		return prior
+	default:
+	}
+	if c.unpause == nil {
+		// idletiming's timeout is fixed, so keep it from firing and time out
+		// the connection ourselves
+		c.unpause = c.iConn.Pause()
+		c.timeoutSet = make(chan struct{}, 1)
+		go c.watchIdle()
+		return prior
+	}
+	select {
+	case c.timeoutSet <- struct{}{}:
+	default:
+	}
+	return prior
+}
+
+func (c *idleConn) watchIdle() {
+	for {
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if timeout := time.Duration(atomic.LoadInt64(&c.idleTimeout)); timeout > 0 {
+			idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+			if idleFor >= timeout {
+				log.Debugf("Closing connection to %v after being idle for %v", c.RemoteAddr(), idleFor)
+				c.Close()
+				return
+			}
+			timer = time.NewTimer(timeout - idleFor)
+			wait = timer.C
+		}
+		select {
+		case <-wait:
+		case <-c.timeoutSet:
+		case <-c.closed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
 	}
 }
 
@@ -5,6 +5,7 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +16,37 @@ var (
 	log = golog.LoggerFor("listeners")
 )
 
+// LimitedListener is a listener that limits the number of simultaneous
+// connections and whose limits can be inspected and changed at runtime.
+type LimitedListener interface {
+	net.Listener
+
+	// NumConns returns the number of currently open connections.
+	NumConns() uint64
+
+	// MaxConns returns the maximum number of simultaneous connections, or
+	// math.MaxUint64 if unlimited.
+	MaxConns() uint64
+
+	// SetMaxConns changes the maximum number of simultaneous connections. 0
+	// means unlimited.
+	SetMaxConns(maxConns uint64)
+
+	// IsStopped indicates whether the listener is currently not accepting
+	// connections, either because it's saturated or paused.
+	IsStopped() bool
+
+	// IsPaused indicates whether the listener was paused with Pause.
+	IsPaused() bool
+
+	// Pause stops accepting new connections until Resume is called,
+	// irrespective of the number of open connections.
+	Pause()
+
+	// Resume undoes Pause.
+	Resume()
+}
+
 type limitedListener struct {
 	net.Listener
 
@@ -22,11 +54,18 @@ type limitedListener struct {
 	numConns    uint64
 	idleTimeout time.Duration
 
-	stopped int32
-	stop    chan bool
-	restart chan bool
+	// mx guards paused, stopped and restart, as connections and the admin API
+	// stop and restart the listener concurrently
+	mx      sync.Mutex
+	paused  bool
+	stopped bool
+	// restart is closed to wake up Accept when the listener is restarted
+	restart chan struct{}
 }
 
+// NewLimitedListener creates a listener that stops accepting connections while
+// maxConns connections are open. The returned listener implements
+// LimitedListener.
 func NewLimitedListener(l net.Listener, maxConns uint64) net.Listener {
 	if maxConns <= 0 {
 		maxConns = math.MaxUint64
@@ -34,19 +73,20 @@ func NewLimitedListener(l net.Listener, maxConns uint64) net.Listener {
 
 	return &limitedListener{
 		Listener:    l,
-		stopped:     0,
-		stop:        make(chan bool, 1),
-		restart:     make(chan bool),
 		maxConns:    maxConns,
 		idleTimeout: 30 * time.Second,
 	}
 }
 
 func (sl *limitedListener) Accept() (net.Conn, error) {
-	select {
-	case <-sl.stop:
-		<-sl.restart
-	default:
+	for {
+		sl.mx.Lock()
+		stopped, restart := sl.stopped, sl.restart
+		sl.mx.Unlock()
+		if !stopped {
+			break
+		}
+		<-restart
 	}
 
 	c, err := sl.Listener.Accept()
@@ -57,10 +97,10 @@ func (sl *limitedListener) Accept() (net.Conn, error) {
 	atomic.AddUint64(&sl.numConns, 1)
 
 	if log.IsTraceEnabled() {
-		if sl.maxConns == math.MaxUint64 {
-			log.Tracef("Accepted a new connection, %v in total now, of unlimited connections", sl.numConns)
+		if sl.MaxConns() == math.MaxUint64 {
+			log.Tracef("Accepted a new connection, %v in total now, of unlimited connections", sl.NumConns())
 		} else {
-			log.Tracef("Accepted a new connection, %v in total now, %v max allowed", sl.numConns, sl.maxConns)
+			log.Tracef("Accepted a new connection, %v in total now, %v max allowed", sl.NumConns(), sl.MaxConns())
 		}
 	}
 
@@ -73,21 +113,85 @@ func (sl *limitedListener) Accept() (net.Conn, error) {
 }
 
 func (sl *limitedListener) IsStopped() bool {
-	return atomic.LoadInt32(&sl.stopped) == 1
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	return sl.stopped
 }
 
 func (sl *limitedListener) Stop() {
-	if !sl.IsStopped() {
-		sl.stop <- true
-		atomic.StoreInt32(&sl.stopped, 1)
-	}
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	sl.stopLocked()
 }
 
 func (sl *limitedListener) Restart() {
-	if sl.IsStopped() {
-		sl.restart <- true
-		atomic.StoreInt32(&sl.stopped, 0)
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	sl.restartLocked()
+}
+
+// restartUnlessPaused restarts the listener if it's stopped for want of room
+// only, i.e. if it isn't paused and fewer than MaxConns connections are open.
+// The checks are made under the same lock as Pause, so that a concurrent Pause
+// isn't undone. It returns whether the listener was restarted.
+func (sl *limitedListener) restartUnlessPaused() bool {
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	if !sl.stopped || sl.paused || sl.NumConns() >= sl.MaxConns() {
+		return false
 	}
+	sl.restartLocked()
+	return true
+}
+
+func (sl *limitedListener) stopLocked() {
+	if !sl.stopped {
+		sl.stopped = true
+		sl.restart = make(chan struct{})
+	}
+}
+
+func (sl *limitedListener) restartLocked() {
+	if sl.stopped {
+		sl.stopped = false
+		close(sl.restart)
+	}
+}
+
+func (sl *limitedListener) NumConns() uint64 {
+	return atomic.LoadUint64(&sl.numConns)
+}
+
+func (sl *limitedListener) MaxConns() uint64 {
+	return atomic.LoadUint64(&sl.maxConns)
+}
+
+func (sl *limitedListener) SetMaxConns(maxConns uint64) {
+	if maxConns <= 0 {
+		maxConns = math.MaxUint64
+	}
+	atomic.StoreUint64(&sl.maxConns, maxConns)
+	sl.restartUnlessPaused()
+}
+
+func (sl *limitedListener) IsPaused() bool {
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	return sl.paused
+}
+
+func (sl *limitedListener) Pause() {
+	sl.mx.Lock()
+	defer sl.mx.Unlock()
+	sl.paused = true
+	sl.stopLocked()
+}
+
+func (sl *limitedListener) Resume() {
+	sl.mx.Lock()
+	sl.paused = false
+	sl.mx.Unlock()
+	sl.restartUnlessPaused()
 }
 
 type limitedConn struct {
@@ -105,38 +209,42 @@ func (c *limitedConn) Close() (err error) {
 	// Substract 1 by adding the two-complement of -1
 	numConns := atomic.AddUint64(&c.listener.numConns, ^uint64(0))
 	log.Tracef("Closed a connection and left %v remaining", numConns)
+	l := c.listener
+	if l.restartUnlessPaused() {
+		log.Tracef("numConns %v < maxConns %v, accept new connections again", numConns, l.MaxConns())
+	}
 	return c.Conn.Close()
 }
 
 func (c *limitedConn) OnState(s http.ConnState) {
 	l := c.listener
+	maxConns := l.MaxConns()
 	if log.IsTraceEnabled() {
-		if l.maxConns == math.MaxUint64 {
+		if maxConns == math.MaxUint64 {
 			log.Tracef("OnState(%s), numConns = %v, of unlimited connections", s, l.numConns)
 		} else {
-			log.Tracef("OnState(%s), numConns = %v, maxConns = %v", s, l.numConns, l.maxConns)
+			log.Tracef("OnState(%s), numConns = %v, maxConns = %v", s, l.numConns, maxConns)
 		}
 	}
 
 	if s == http.StateNew {
-		if atomic.LoadUint64(&l.numConns) >= l.maxConns {
+		if l.NumConns() >= maxConns {
 			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
+				if maxConns == math.MaxUint64 {
 					log.Tracef("numConns %v (unlimited connections), stop accepting new connections", l.numConns)
 				} else {
-					log.Tracef("numConns %v >= maxConns %v, stop accepting new connections", l.numConns, l.maxConns)
+					log.Tracef("numConns %v >= maxConns %v, stop accepting new connections", l.numConns, maxConns)
 				}
 			}
 			l.Stop()
-		} else if l.IsStopped() {
+		} else if l.restartUnlessPaused() {
 			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
+				if maxConns == math.MaxUint64 {
 					log.Tracef("numConns %v < maxConns (unlimited connections), accept new connections again", l.numConns)
 				} else {
-					log.Tracef("numConns %v < maxConns %v, accept new connections again", l.numConns, l.maxConns)
+					log.Tracef("numConns %v < maxConns %v, accept new connections again", l.numConns, maxConns)
 				}
 			}
-			l.Restart()
 		}
 	}
 
@@ -0,0 +1,106 @@
+package listeners
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitedPauseResume(t *testing.T) {
+	l := newTestListener(t)
+	ll := NewLimitedListener(l, 0).(*limitedListener)
+	defer ll.Close()
+
+	accepted := acceptAsync(ll)
+	first := dial(t, l)
+	defer first.Close()
+	conn := <-accepted
+	if !assert.NotNil(t, conn) {
+		return
+	}
+
+	ll.Pause()
+	assert.True(t, ll.IsPaused())
+	assert.True(t, ll.IsStopped())
+	// Closing a connection frees up room, but mustn't undo the pause
+	conn.Close()
+	conn.(WrapConn).OnState(http.StateNew)
+	ll.SetMaxConns(10)
+	assert.True(t, ll.IsStopped(), "paused listener should stay stopped")
+
+	accepted = acceptAsync(ll)
+	second := dial(t, l)
+	defer second.Close()
+	select {
+	case <-accepted:
+		assert.Fail(t, "paused listener shouldn't accept connections")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ll.Resume()
+	assert.False(t, ll.IsPaused())
+	select {
+	case conn := <-accepted:
+		if assert.NotNil(t, conn) {
+			conn.Close()
+		}
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "resumed listener should accept connections")
+	}
+}
+
+func TestLimitedSetMaxConns(t *testing.T) {
+	l := newTestListener(t)
+	ll := NewLimitedListener(l, 1).(*limitedListener)
+	defer ll.Close()
+
+	accepted := acceptAsync(ll)
+	client := dial(t, l)
+	defer client.Close()
+	conn := <-accepted
+	if !assert.NotNil(t, conn) {
+		return
+	}
+	conn.(WrapConn).OnState(http.StateNew)
+	assert.EqualValues(t, 1, ll.NumConns())
+	assert.True(t, ll.IsStopped(), "listener should stop at MaxConns")
+
+	ll.SetMaxConns(2)
+	assert.EqualValues(t, 2, ll.MaxConns())
+	assert.False(t, ll.IsStopped(), "raising MaxConns should restart the listener")
+
+	ll.SetMaxConns(1)
+	ll.Stop()
+	conn.Close()
+	assert.EqualValues(t, 0, ll.NumConns())
+	assert.False(t, ll.IsStopped(), "closing a connection should restart the listener")
+}
+
+func newTestListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// acceptAsync accepts a single connection from l, sending nil if that fails.
+func acceptAsync(l net.Listener) <-chan net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	return accepted
+}
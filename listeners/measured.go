@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/getlantern/measured"
+	"github.com/getlantern/netx"
 )
 
 const (
@@ -97,30 +98,46 @@ func (c *wrapMeasuredConn) OnState(s http.ConnState) {
 	}
 }
 
-// Responds to the "measured" message type
+// Responds to the MsgMeasured message type
 func (c *wrapMeasuredConn) ControlMessage(msgType string, data interface{}) {
-	if msgType == "measured" {
-		ctxUpdate := data.(map[string]interface{})
-		c.ctxMx.Lock()
-		newContext := make(map[string]interface{}, len(c.ctx))
-		// Copy context
-		for key, value := range c.ctx {
-			newContext[key] = value
-		}
-		// Update context
-		for key, value := range ctxUpdate {
-			newContext[key] = value
-		}
-		c.ctx = newContext
-		c.ctxMx.Unlock()
-	}
+	handleControlMessage(c, c.WrapConnEmbeddable, MsgMeasured, msgType, data)
+}
 
-	if c.WrapConnEmbeddable != nil {
-		// Pass it down too, just in case other wrapper does something with
-		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+// Handles UpdateMeasuredContext
+func (c *wrapMeasuredConn) HandleMessage(msg Message) (interface{}, bool, error) {
+	ctxUpdate, ok := msg.(UpdateMeasuredContext)
+	if !ok {
+		return nil, false, nil
 	}
+	c.ctxMx.Lock()
+	newContext := make(map[string]interface{}, len(c.ctx))
+	// Copy context
+	for key, value := range c.ctx {
+		newContext[key] = value
+	}
+	// Update context
+	for key, value := range ctxUpdate {
+		newContext[key] = value
+	}
+	c.ctx = newContext
+	c.ctxMx.Unlock()
+	return nil, true, nil
 }
 
 func (c *wrapMeasuredConn) Wrapped() net.Conn {
 	return c.Conn
 }
+
+// MeasuredStats returns the stats of the measured connection wrapped by conn,
+// or false if conn isn't measured.
+func MeasuredStats(conn net.Conn) (*measured.Stats, bool) {
+	var mc measured.Conn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		mc, _ = wrapped.(measured.Conn)
+		return mc == nil
+	})
+	if mc == nil {
+		return nil, false
+	}
+	return mc.Stats(), true
+}
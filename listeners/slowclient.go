@@ -0,0 +1,200 @@
+package listeners
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSlowClientWindow = 10 * time.Second
+
+	// slowClientWriteChunk is how much is written at a time so that progress
+	// of large writes to slow readers is accounted for while they're blocked
+	slowClientWriteChunk = 32 * 1024
+)
+
+// SlowClientOpts configures NewSlowClientListener. Clients that are slow to
+// send request headers are left to the server's request header timeout, which
+// counts them in SlowClientStats.HeaderTimeouts.
+type SlowClientOpts struct {
+	// MinBytesPerSecond, if positive, is the minimum rate at which connections
+	// have to transfer data, counting both directions, averaged over Window.
+	// Windows in which a connection neither transfers any data nor waits to
+	// write some are exempt, leaving idle connections to the idle timeout.
+	MinBytesPerSecond int64
+
+	// Window is the period over which the data rate is averaged. Defaults to
+	// 10 seconds.
+	Window time.Duration
+}
+
+// SlowClientStats counts the connections closed by a SlowClientListener.
+type SlowClientStats struct {
+	// HeaderTimeouts counts connections that didn't send a complete request
+	// header within the server's request header timeout. These are counted
+	// by the server rather than the listener.
+	HeaderTimeouts int64 `json:"header_timeouts"`
+	// SlowTransfers counts connections that transferred data too slowly.
+	SlowTransfers int64 `json:"slow_transfers"`
+}
+
+// SlowClientListener is a listener that closes the connections of clients
+// that are too slow, which would otherwise keep connections open for very
+// little data (slowloris and slow read attacks).
+type SlowClientListener interface {
+	net.Listener
+
+	// Stats returns the number of connections closed so far.
+	Stats() SlowClientStats
+}
+
+type slowClientListener struct {
+	net.Listener
+	opts *SlowClientOpts
+
+	conns     map[*slowClientConn]bool
+	mx        sync.Mutex
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	slowTransfers int64
+}
+
+// NewSlowClientListener creates a listener that closes connections whose
+// clients are too slow to transfer data, as configured by opts. The returned
+// listener implements SlowClientListener.
+func NewSlowClientListener(l net.Listener, opts *SlowClientOpts) net.Listener {
+	if opts.Window <= 0 {
+		opts.Window = defaultSlowClientWindow
+	}
+	sl := &slowClientListener{
+		Listener: l,
+		opts:     opts,
+		conns:    make(map[*slowClientConn]bool),
+		closed:   make(chan struct{}),
+	}
+	if opts.MinBytesPerSecond > 0 {
+		go sl.watchRates()
+	}
+	return sl
+}
+
+func (sl *slowClientListener) Accept() (net.Conn, error) {
+	conn, err := sl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	sac, _ := conn.(WrapConnEmbeddable)
+	c := &slowClientConn{
+		WrapConnEmbeddable: sac,
+		Conn:               conn,
+		listener:           sl,
+		windowStart:        time.Now(),
+	}
+	if sl.opts.MinBytesPerSecond > 0 {
+		sl.mx.Lock()
+		sl.conns[c] = true
+		sl.mx.Unlock()
+	}
+	return c, nil
+}
+
+func (sl *slowClientListener) Close() error {
+	sl.closeOnce.Do(func() {
+		close(sl.closed)
+	})
+	return sl.Listener.Close()
+}
+
+func (sl *slowClientListener) Stats() SlowClientStats {
+	return SlowClientStats{
+		SlowTransfers: atomic.LoadInt64(&sl.slowTransfers),
+	}
+}
+
+// watchRates periodically closes connections whose data rate over the last
+// window was too low.
+func (sl *slowClientListener) watchRates() {
+	window := sl.opts.Window
+	minBytes := int64(float64(sl.opts.MinBytesPerSecond) * window.Seconds())
+	ticker := time.NewTicker(window / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sl.closed:
+			return
+		case now := <-ticker.C:
+			var slow []*slowClientConn
+			sl.mx.Lock()
+			for c := range sl.conns {
+				if now.Sub(c.windowStart) < window {
+					continue
+				}
+				c.windowStart = now
+				transferred := atomic.SwapInt64(&c.transferred, 0)
+				active := transferred > 0 || atomic.LoadInt32(&c.writing) > 0
+				if active && transferred < minBytes {
+					slow = append(slow, c)
+				}
+			}
+			sl.mx.Unlock()
+			for _, c := range slow {
+				log.Debugf("Closing connection from %v that transferred less than %d bytes in %v", c.RemoteAddr(), minBytes, window)
+				atomic.AddInt64(&sl.slowTransfers, 1)
+				c.Close()
+			}
+		}
+	}
+}
+
+type slowClientConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	listener *slowClientListener
+
+	transferred int64
+	writing     int32
+	// windowStart is guarded by the listener's mutex
+	windowStart time.Time
+	closeOnce   sync.Once
+}
+
+func (c *slowClientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.transferred, int64(n))
+	return n, err
+}
+
+func (c *slowClientConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writing, 1)
+	defer atomic.AddInt32(&c.writing, -1)
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > slowClientWriteChunk {
+			chunk = chunk[:slowClientWriteChunk]
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		atomic.AddInt64(&c.transferred, int64(n))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *slowClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.listener.mx.Lock()
+		delete(c.listener.conns, c)
+		c.listener.mx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *slowClientConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,68 @@
+package listeners
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowClient(t *testing.T) {
+	l := newTestListener(t)
+	sl := NewSlowClientListener(l, &SlowClientOpts{
+		MinBytesPerSecond: 100,
+		Window:            100 * time.Millisecond,
+	}).(*slowClientListener)
+	defer sl.Close()
+
+	trickle := func() ([]byte, error) {
+		accepted := acceptAsync(sl)
+		client := dial(t, l)
+		defer client.Close()
+		conn := <-accepted
+		if conn == nil {
+			t.Fatal("unable to accept connection")
+		}
+		go func() {
+			// Trickle a byte at a time, well below the minimum rate
+			for i := 0; i < 20; i++ {
+				time.Sleep(50 * time.Millisecond)
+				if _, err := client.Write([]byte{'a'}); err != nil {
+					return
+				}
+			}
+		}()
+		var received []byte
+		b := make([]byte, 1)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				return received, err
+			}
+			received = append(received, b[0])
+		}
+	}
+
+	received, err := trickle()
+	assert.Error(t, err, "slow connection should be closed")
+	assert.True(t, len(received) < 20, "slow connection should be closed before it finishes")
+	assert.Equal(t, SlowClientStats{SlowTransfers: 1}, sl.Stats())
+
+	// Idle connections are left alone
+	accepted := acceptAsync(sl)
+	client := dial(t, l)
+	defer client.Close()
+	conn := <-accepted
+	if !assert.NotNil(t, conn) {
+		return
+	}
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	_, err = client.Write([]byte("hello"))
+	assert.NoError(t, err)
+	b := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	assert.NoError(t, err, "idle connection should be kept open")
+	assert.Equal(t, "hello", string(b[:n]))
+	assert.Equal(t, SlowClientStats{SlowTransfers: 1}, sl.Stats())
+}
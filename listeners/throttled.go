@@ -0,0 +1,145 @@
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// Wrapped throttledListener that generates the wrapped throttledConn
+type throttledListener struct {
+	net.Listener
+	bytesPerSecond int64
+}
+
+// NewThrottledListener wraps the given listener so that each accepted
+// connection is limited to bytesPerSecond in each direction. 0 means
+// unlimited. The limit of individual connections can be changed at runtime
+// with the MsgBandwidth control message.
+func NewThrottledListener(l net.Listener, bytesPerSecond int64) net.Listener {
+	return &throttledListener{l, bytesPerSecond}
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tc := &throttledConn{
+		Conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	tc.WrapConnEmbeddable, _ = conn.(WrapConnEmbeddable)
+	tc.setBandwidth(l.bytesPerSecond)
+	return tc, nil
+}
+
+// Wrapped conn that limits its bandwidth
+type throttledConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	// holds a *rate.Limiter, which is replaced rather than modified so that
+	// each read or write sees a consistent rate and burst
+	limiter        atomic.Value
+	bytesPerSecond int64
+	ctx            context.Context
+	cancel         context.CancelFunc
+}
+
+// setBandwidth sets the limit and returns the prior one
+func (c *throttledConn) setBandwidth(bytesPerSecond int64) int64 {
+	prior := atomic.SwapInt64(&c.bytesPerSecond, bytesPerSecond)
+	if bytesPerSecond <= 0 {
+		c.limiter.Store(rate.NewLimiter(rate.Inf, 0))
+		return prior
+	}
+	// Allow bursts of up to one second's worth of data
+	burst := bytesPerSecond
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	c.limiter.Store(rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst)))
+	return prior
+}
+
+func (c *throttledConn) getLimiter() *rate.Limiter {
+	return c.limiter.Load().(*rate.Limiter)
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	limiter := c.getLimiter()
+	if limiter.Limit() != rate.Inf && len(b) > limiter.Burst() {
+		b = b[:limiter.Burst()]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if waitErr := limiter.WaitN(c.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	limiter := c.getLimiter()
+	if limiter.Limit() == rate.Inf {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := limiter.Burst()
+		if chunk > len(b) {
+			chunk = len(b)
+		}
+		if err := limiter.WaitN(c.ctx, chunk); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(b[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[chunk:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+// Responds to the MsgBandwidth message type
+func (c *throttledConn) ControlMessage(msgType string, data interface{}) {
+	handleControlMessage(c, c.WrapConnEmbeddable, MsgBandwidth, msgType, data)
+}
+
+// Handles SetBandwidth
+func (c *throttledConn) HandleMessage(msg Message) (interface{}, bool, error) {
+	setBandwidth, ok := msg.(SetBandwidth)
+	if !ok {
+		return nil, false, nil
+	}
+	if setBandwidth.BytesPerSecond < 0 {
+		return nil, true, fmt.Errorf("invalid bandwidth %d", setBandwidth.BytesPerSecond)
+	}
+	return c.setBandwidth(setBandwidth.BytesPerSecond), true, nil
+}
+
+func (c *throttledConn) Wrapped() net.Conn {
+	return c.Conn
+}
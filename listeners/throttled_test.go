@@ -0,0 +1,44 @@
+package listeners
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottled(t *testing.T) {
+	l := newTestListener(t)
+	tl := NewThrottledListener(l, 1000)
+	defer tl.Close()
+
+	accepted := acceptAsync(tl)
+	client := dial(t, l)
+	defer client.Close()
+	conn := <-accepted
+	if !assert.NotNil(t, conn) {
+		return
+	}
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	// The first second's worth of data is allowed as a burst
+	start := time.Now()
+	_, err := conn.Write(make([]byte, 1500))
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "writes should be throttled, took %v", time.Since(start))
+
+	acks, err := Send(conn, SetBandwidth{BytesPerSecond: 0})
+	if assert.NoError(t, err) && assert.Len(t, acks, 1) {
+		assert.EqualValues(t, 1000, acks[0].Result, "the prior limit should be acknowledged")
+	}
+	start = time.Now()
+	_, err = conn.Write(make([]byte, 100000))
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "writes should be unlimited, took %v", time.Since(start))
+
+	_, err = Send(conn, SetBandwidth{BytesPerSecond: -1})
+	assert.Error(t, err, "negative bandwidth should be rejected")
+}
@@ -5,6 +5,22 @@ import (
 	"net/http"
 )
 
+// Control message types understood by the connections in this package.
+const (
+	// MsgMeasured updates the context reported for measured connections. Its
+	// data is a map[string]interface{} that's merged into the existing context.
+	MsgMeasured = "measured"
+
+	// MsgBandwidth sets the bandwidth limit of throttled connections. Its data
+	// is the limit in bytes per second as an int64, with 0 meaning unlimited.
+	MsgBandwidth = "bandwidth"
+
+	// MsgIdleTimeout sets the idle timeout of idle timing connections. Its
+	// data is a time.Duration, with 0 meaning that the connection never times
+	// out.
+	MsgIdleTimeout = "idletimeout"
+)
+
 // WrapConnEmbeddable can be embedded along net.Conn or not
 type WrapConnEmbeddable interface {
 	OnState(s http.ConnState)
@@ -16,7 +32,8 @@ type WrapConnEmbeddable interface {
 // allows control messages with ControlMessage (for things like modify the
 // connection at the wrapper level).
 // It is important that these functions, when defined, pass the arguments
-// to the wrapped connections.
+// to the wrapped connections. New code should prefer sending typed messages
+// with Send.
 type WrapConn interface {
 	net.Conn
 
@@ -0,0 +1,316 @@
+// Package pac generates Proxy Auto-Config (PAC) files that tell clients which
+// destinations to reach directly and which through the proxy. Rules match
+// destinations by domain or CIDR, and clients in particular subnets can get
+// their own variation of the rules. The same rules are available to the proxy
+// with Action, so that it can enforce what PAC files tell clients.
+package pac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// Path is where PAC files are conventionally served.
+	Path = "/proxy.pac"
+	// WPADPath is where clients using Web Proxy Auto-Discovery (WPAD) look for
+	// the PAC file.
+	WPADPath = "/wpad.dat"
+	// ContentType is the media type of PAC files.
+	ContentType = "application/x-ns-proxy-autoconfig"
+)
+
+var validDomain = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// Action is what a PAC file tells clients to do for a destination.
+type Action string
+
+const (
+	// Direct makes clients connect to the destination themselves.
+	Direct Action = "direct"
+	// Proxy makes clients connect to the destination through the proxy.
+	Proxy Action = "proxy"
+)
+
+// Rule applies an action to destinations. Exactly one of Domain and CIDR is
+// specified.
+type Rule struct {
+	// Domain matches the host and its subdomains, ignoring case.
+	Domain string `json:"domain,omitempty"`
+
+	// CIDR matches destinations addressed by an IP in it. Host names aren't
+	// resolved to match.
+	CIDR string `json:"cidr,omitempty"`
+
+	Action Action `json:"action"`
+}
+
+// Variation overrides the rules for clients in particular subnets.
+type Variation struct {
+	// Clients lists the CIDRs (or bare IPs) of the clients that get this
+	// variation.
+	Clients []string `json:"clients"`
+
+	// Rules are matched before the rules of Opts.
+	Rules []Rule `json:"rules"`
+
+	// Default, if specified, overrides the default of Opts.
+	Default Action `json:"default,omitempty"`
+}
+
+// Opts configures a Generator.
+type Opts struct {
+	// Proxy is the address advertised to clients, like proxy.example.com:8080.
+	// If unspecified, it's up to the caller of Script to provide one.
+	Proxy string `json:"proxy"`
+
+	// HTTPS advertises Proxy as a TLS proxy.
+	HTTPS bool `json:"https"`
+
+	// FallbackDirect lets clients connect directly when the proxy is
+	// unreachable.
+	FallbackDirect bool `json:"fallback_direct"`
+
+	// Rules are matched against destinations in order, the first match
+	// winning.
+	Rules []Rule `json:"rules"`
+
+	// Default is the action for destinations that match no rule. Defaults to
+	// Proxy.
+	Default Action `json:"default"`
+
+	// Variations are matched against the client in order, the first match
+	// winning. Clients that match none get the plain rules.
+	Variations []Variation `json:"variations"`
+
+	// Enforce makes the proxy refuse requests for destinations that clients
+	// are told to reach directly, see Enforced. Clients that don't use the PAC
+	// file are refused too, so it's off by default.
+	Enforce bool `json:"enforce"`
+}
+
+type variation struct {
+	clients  []*net.IPNet
+	rules    []Rule
+	fallback Action
+}
+
+// Generator generates PAC files.
+type Generator struct {
+	opts       *Opts
+	variations []*variation
+	base       *variation
+}
+
+// New constructs a new Generator, validating the rules.
+func New(opts *Opts) (*Generator, error) {
+	if opts.Default == "" {
+		opts.Default = Proxy
+	}
+	if err := validateAction(opts.Default); err != nil {
+		return nil, err
+	}
+	if err := validateRules(opts.Rules); err != nil {
+		return nil, err
+	}
+	g := &Generator{
+		opts: opts,
+		base: &variation{rules: opts.Rules, fallback: opts.Default},
+	}
+	for i, v := range opts.Variations {
+		if len(v.Clients) == 0 {
+			return nil, errors.New("Variation %d has no clients", i)
+		}
+		clients, err := parseCIDRs(v.Clients)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateRules(v.Rules); err != nil {
+			return nil, err
+		}
+		fallback := opts.Default
+		if v.Default != "" {
+			if err := validateAction(v.Default); err != nil {
+				return nil, err
+			}
+			fallback = v.Default
+		}
+		g.variations = append(g.variations, &variation{
+			clients:  clients,
+			rules:    append(append([]Rule{}, v.Rules...), opts.Rules...),
+			fallback: fallback,
+		})
+	}
+	return g, nil
+}
+
+// Load loads the options of a Generator from a JSON file.
+func Load(file string) (*Opts, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Unable to read %v: %v", file, err)
+	}
+	opts := &Opts{}
+	if err := json.Unmarshal(b, opts); err != nil {
+		return nil, errors.New("Unable to parse %v: %v", file, err)
+	}
+	return opts, nil
+}
+
+// Script generates the PAC file for a client, advertising Opts.Proxy or, if
+// that's unspecified, proxy.
+func (g *Generator) Script(clientIP net.IP, proxy string) []byte {
+	if g.opts.Proxy != "" {
+		proxy = g.opts.Proxy
+	}
+	v := g.variationFor(clientIP)
+
+	viaProxy := "PROXY " + proxy
+	if g.opts.HTTPS {
+		viaProxy = "HTTPS " + proxy
+	}
+	if g.opts.FallbackDirect {
+		viaProxy += "; DIRECT"
+	}
+	result := func(action Action) string {
+		if action == Direct {
+			return `"DIRECT"`
+		}
+		return fmt.Sprintf("%q", viaProxy)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("\thost = host.toLowerCase();\n")
+	buf.WriteString("\tvar isIP = /^[0-9.]+$/.test(host) || host.indexOf(\":\") >= 0;\n")
+	for _, rule := range v.rules {
+		if rule.Domain != "" {
+			domain := normalizeDomain(rule.Domain)
+			fmt.Fprintf(&buf, "\tif (host == %q || dnsDomainIs(host, %q)) return %v;\n", domain, "."+domain, result(rule.Action))
+			continue
+		}
+		_, ipNet, _ := net.ParseCIDR(rule.CIDR)
+		if ipNet.IP.To4() != nil {
+			fmt.Fprintf(&buf, "\tif (isIP && isInNet(host, %q, %q)) return %v;\n", ipNet.IP.String(), net.IP(ipNet.Mask).String(), result(rule.Action))
+		} else {
+			// isInNetEx is the IPv6 capable extension supported by most clients
+			fmt.Fprintf(&buf, "\tif (isIP && typeof isInNetEx == \"function\" && isInNetEx(host, %q)) return %v;\n", ipNet.String(), result(rule.Action))
+		}
+	}
+	fmt.Fprintf(&buf, "\treturn %v;\n", result(v.fallback))
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// Action returns the action that the PAC file of a client specifies for host,
+// a domain or IP. Like in PAC files, domains aren't resolved to match CIDRs.
+func (g *Generator) Action(clientIP net.IP, host string) Action {
+	host = strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+	ip := net.ParseIP(host)
+	v := g.variationFor(clientIP)
+	for _, rule := range v.rules {
+		if rule.Domain != "" {
+			domain := normalizeDomain(rule.Domain)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return rule.Action
+			}
+			continue
+		}
+		if _, ipNet, _ := net.ParseCIDR(rule.CIDR); ip != nil && ipNet.Contains(ip) {
+			return rule.Action
+		}
+	}
+	return v.fallback
+}
+
+// Enforced determines whether the proxy should refuse requests for
+// destinations that clients are told to reach directly.
+func (g *Generator) Enforced() bool {
+	return g.opts.Enforce
+}
+
+func (g *Generator) variationFor(clientIP net.IP) *variation {
+	for _, candidate := range g.variations {
+		if containsIP(candidate.clients, clientIP) {
+			return candidate
+		}
+	}
+	return g.base
+}
+
+func validateAction(action Action) error {
+	if action != Direct && action != Proxy {
+		return errors.New("Unknown action %q, expected %q or %q", action, Direct, Proxy)
+	}
+	return nil
+}
+
+func validateRules(rules []Rule) error {
+	for _, rule := range rules {
+		if err := validateAction(rule.Action); err != nil {
+			return err
+		}
+		switch {
+		case rule.Domain != "" && rule.CIDR != "":
+			return errors.New("Rule for %v and %v should have either a domain or a CIDR", rule.Domain, rule.CIDR)
+		case rule.Domain != "":
+			if !validDomain.MatchString(normalizeDomain(rule.Domain)) {
+				return errors.New("Invalid domain %q", rule.Domain)
+			}
+		case rule.CIDR != "":
+			if _, _, err := net.ParseCIDR(rule.CIDR); err != nil {
+				return errors.New("Invalid CIDR %q: %v", rule.CIDR, err)
+			}
+		default:
+			return errors.New("Rule has neither a domain nor a CIDR")
+		}
+	}
+	return nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.TrimPrefix(strings.ToLower(domain), "*."), ".")
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("Invalid IP %v", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("Invalid CIDR %v: %v", cidr, err)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package pac
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScript(t *testing.T) {
+	g, err := New(&Opts{
+		Rules: []Rule{
+			{Domain: "*.Internal.example", Action: Direct},
+			{CIDR: "10.0.0.0/8", Action: Direct},
+			{CIDR: "fd00::/8", Action: Direct},
+			{Domain: "blocked.example", Action: Proxy},
+		},
+		Default: Direct,
+		Variations: []Variation{{
+			Clients: []string{"192.168.1.0/24", "172.16.0.1"},
+			Rules:   []Rule{{Domain: "internal.example", Action: Proxy}},
+			Default: Proxy,
+		}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, `function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var isIP = /^[0-9.]+$/.test(host) || host.indexOf(":") >= 0;
+	if (host == "internal.example" || dnsDomainIs(host, ".internal.example")) return "DIRECT";
+	if (isIP && isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";
+	if (isIP && typeof isInNetEx == "function" && isInNetEx(host, "fd00::/8")) return "DIRECT";
+	if (host == "blocked.example" || dnsDomainIs(host, ".blocked.example")) return "PROXY proxy.example:8080";
+	return "DIRECT";
+}
+`, string(g.Script(net.ParseIP("10.1.1.1"), "proxy.example:8080")))
+
+	assert.Equal(t, `function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var isIP = /^[0-9.]+$/.test(host) || host.indexOf(":") >= 0;
+	if (host == "internal.example" || dnsDomainIs(host, ".internal.example")) return "PROXY proxy.example:8080";
+	if (host == "internal.example" || dnsDomainIs(host, ".internal.example")) return "DIRECT";
+	if (isIP && isInNet(host, "10.0.0.0", "255.0.0.0")) return "DIRECT";
+	if (isIP && typeof isInNetEx == "function" && isInNetEx(host, "fd00::/8")) return "DIRECT";
+	if (host == "blocked.example" || dnsDomainIs(host, ".blocked.example")) return "PROXY proxy.example:8080";
+	return "PROXY proxy.example:8080";
+}
+`, string(g.Script(net.ParseIP("192.168.1.20"), "proxy.example:8080")), "clients in a variation's subnets should get its rules first")
+	assert.Contains(t, string(g.Script(net.ParseIP("172.16.0.1"), "proxy.example:8080")), `return "PROXY proxy.example:8080";`+"\n}")
+
+	// The proxy sees the same rules
+	assert.Equal(t, Direct, g.Action(net.ParseIP("10.1.1.1"), "www.INTERNAL.example."))
+	assert.Equal(t, Direct, g.Action(net.ParseIP("10.1.1.1"), "10.2.3.4"))
+	assert.Equal(t, Direct, g.Action(net.ParseIP("10.1.1.1"), "[fd00::1]"))
+	assert.Equal(t, Proxy, g.Action(net.ParseIP("10.1.1.1"), "blocked.example"))
+	assert.Equal(t, Direct, g.Action(net.ParseIP("10.1.1.1"), "other.example"))
+	assert.Equal(t, Proxy, g.Action(net.ParseIP("192.168.1.20"), "internal.example"), "variations should apply")
+	assert.Equal(t, Proxy, g.Action(net.ParseIP("192.168.1.20"), "other.example"))
+
+	g, err = New(&Opts{Proxy: "proxy.example:443", HTTPS: true, FallbackDirect: true})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(g.Script(nil, "ignored:8080")), `return "HTTPS proxy.example:443; DIRECT";`, "configured address should be advertised")
+	}
+
+	for _, opts := range []*Opts{
+		{Default: "block"},
+		{Rules: []Rule{{Domain: "example.com"}}},
+		{Rules: []Rule{{Action: Direct}}},
+		{Rules: []Rule{{Domain: "example.com", CIDR: "10.0.0.0/8", Action: Direct}}},
+		{Rules: []Rule{{Domain: `evil"); alert("`, Action: Direct}}},
+		{Rules: []Rule{{CIDR: "10.0.0.0", Action: Direct}}},
+		{Variations: []Variation{{Clients: []string{"not an ip"}}}},
+		{Variations: []Variation{{}}},
+	} {
+		_, err := New(opts)
+		assert.Error(t, err, "%+v should be invalid", opts)
+	}
+}
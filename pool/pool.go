@@ -0,0 +1,192 @@
+// Package pool forwards plain HTTP requests over a pool of upstream
+// connections shared by all clients. Without it, every client connection gets
+// its own upstream connections, so clients that make few requests to many
+// destinations pay for a TCP and TLS handshake on almost every request.
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	defaultMaxIdle        = 1000
+	defaultMaxIdlePerHost = 10
+	defaultIdleTimeout    = 90 * time.Second
+
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// Opts configures a Pool.
+type Opts struct {
+	// Dial dials upstream connections. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSConfig configures TLS connections to https upstreams.
+	TLSConfig *tls.Config
+
+	// MaxIdle limits the number of idle connections across all destinations.
+	// Defaults to 1000.
+	MaxIdle int
+
+	// MaxIdlePerHost limits the number of idle connections to each
+	// destination. Defaults to 10.
+	MaxIdlePerHost int
+
+	// MaxPerHost, if positive, limits the number of connections to each
+	// destination, including those in use. Requests beyond the limit wait for
+	// a connection to become available.
+	MaxPerHost int
+
+	// IdleTimeout is how long a connection may be idle before it's closed.
+	// Defaults to 90 seconds.
+	IdleTimeout time.Duration
+
+	// TLSHandshakeTimeout limits how long TLS handshakes with https upstreams
+	// may take. Defaults to 10 seconds.
+	TLSHandshakeTimeout time.Duration
+}
+
+// Stats describe the use of the pool.
+type Stats struct {
+	Requests int64 `json:"requests"`
+	// Reused counts requests sent over an existing connection.
+	Reused int64 `json:"reused"`
+	// Dials counts the connections opened.
+	Dials int64 `json:"dials"`
+	// Open is the number of connections currently open, whether idle or in
+	// use.
+	Open int64 `json:"open"`
+}
+
+// ReuseRate is the fraction of requests sent over an existing connection.
+func (s Stats) ReuseRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Reused) / float64(s.Requests)
+}
+
+// Pool holds upstream connections for reuse across clients.
+type Pool struct {
+	tr *http.Transport
+
+	requests int64
+	reused   int64
+	dials    int64
+	open     int64
+}
+
+// New constructs a new Pool.
+func New(opts *Opts) *Pool {
+	if opts.Dial == nil {
+		opts.Dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = defaultMaxIdle
+	}
+	if opts.MaxIdlePerHost <= 0 {
+		opts.MaxIdlePerHost = defaultMaxIdlePerHost
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.TLSHandshakeTimeout <= 0 {
+		opts.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	p := &Pool{}
+	p.tr = &http.Transport{
+		DialContext:     p.dialer(opts.Dial),
+		TLSClientConfig: opts.TLSConfig,
+		MaxIdleConns:    opts.MaxIdle,
+		// Keep idle connections per destination rather than per client
+		MaxIdleConnsPerHost: opts.MaxIdlePerHost,
+		MaxConnsPerHost:     opts.MaxPerHost,
+		IdleConnTimeout:     opts.IdleTimeout,
+		TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+		// Pass content through as is
+		DisableCompression: true,
+	}
+	return p
+}
+
+func (p *Pool) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&p.dials, 1)
+		atomic.AddInt64(&p.open, 1)
+		return &countedConn{Conn: conn, open: &p.open}, nil
+	}
+}
+
+// Filter returns a filter that sends plain HTTP requests over the pool. It
+// needs to be the last filter in the chain. CONNECT and upgrade requests are
+// passed on to the next filter.
+func (p *Pool) Filter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect || utils.IsUpgrade(req) {
+			return next(ctx, req)
+		}
+		resp, err := p.RoundTrip(utils.PrepareRequest(req.WithContext(ctx), nil))
+		if err != nil {
+			return nil, ctx, errors.New("Unable to round-trip http request to upstream: %v", err)
+		}
+		return resp, ctx, nil
+	})
+}
+
+// RoundTrip implements http.RoundTripper.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&p.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&p.reused, 1)
+			}
+		},
+	}
+	return p.tr.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// Stats returns the pool's stats so far.
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&p.requests),
+		Reused:   atomic.LoadInt64(&p.reused),
+		Dials:    atomic.LoadInt64(&p.dials),
+		Open:     atomic.LoadInt64(&p.open),
+	}
+}
+
+// Close closes all idle connections. Connections in use are closed once
+// they're done.
+func (p *Pool) Close() {
+	p.tr.CloseIdleConnections()
+}
+
+type countedConn struct {
+	net.Conn
+	open      *int64
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(c.open, -1)
+	})
+	return c.Conn.Close()
+}
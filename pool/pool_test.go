@@ -0,0 +1,114 @@
+package pool
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	var conns int64
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range []string{"X-Hop", "Proxy-Authorization", "Proxy-Connection", "User-Agent"} {
+			if _, found := req.Header[name]; found {
+				w.Header().Set("X-Leaked", name)
+			}
+		}
+		w.Write([]byte(req.Header.Get("X-End-To-End")))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	p := New(&Opts{IdleTimeout: 100 * time.Millisecond})
+	defer p.Close()
+	filter := p.Filter()
+	nextCalled := false
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		nextCalled = true
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+
+	get := func() {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		req.Header.Set("Connection", "X-Hop, close")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Proxy-Authorization", "Basic abc")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("X-End-To-End", "kept")
+		req.Close = true
+		resp, _, err := filter.Apply(filters.BackgroundContext(), req, next)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "kept", string(body))
+		assert.Empty(t, resp.Header.Get("X-Leaked"), "hop-by-hop headers should not be forwarded")
+	}
+
+	for i := 0; i < 3; i++ {
+		get()
+	}
+	assert.False(t, nextCalled)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&conns), "connection should be reused despite the client asking to close")
+	stats := p.Stats()
+	assert.Equal(t, Stats{Requests: 3, Reused: 2, Dials: 1, Open: 1}, stats)
+	assert.InDelta(t, 2.0/3.0, stats.ReuseRate(), 0.001)
+
+	// Idle connections are evicted
+	time.Sleep(300 * time.Millisecond)
+	assert.EqualValues(t, 0, p.Stats().Open)
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt64(&conns))
+
+	// CONNECT and upgrades are left to the next filter
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+origin.Listener.Addr().String(), nil)
+	filter.Apply(filters.BackgroundContext(), req, next)
+	assert.True(t, nextCalled)
+	nextCalled = false
+	req, _ = http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	filter.Apply(filters.BackgroundContext(), req, next)
+	assert.True(t, nextCalled)
+}
+
+func TestMaxPerHost(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer origin.Close()
+
+	p := New(&Opts{MaxPerHost: 1})
+	defer p.Close()
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+			resp, err := p.RoundTrip(req)
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+			done <- struct{}{}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 1, p.Stats().Dials, "second request should wait for the connection")
+	close(release)
+	<-done
+	<-done
+	assert.EqualValues(t, 1, p.Stats().Dials)
+}
@@ -0,0 +1,104 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+var (
+	// identifyingHeaders are headers that carry the client's address or
+	// identity and are always removed by Anonymize.
+	identifyingHeaders = []string{
+		xForwardedFor,
+		forwarded,
+		"Via",
+		"From",
+		"X-Real-Ip",
+		"X-Client-Ip",
+		"True-Client-Ip",
+		"Client-Ip",
+		"Cf-Connecting-Ip",
+		"X-Cluster-Client-Ip",
+		"X-Forwarded-Host",
+		"X-Forwarded-Proto",
+		"X-Forwarded-Port",
+	}
+)
+
+// AnonymizeOpts configures the Anonymize filter.
+type AnonymizeOpts struct {
+	// UserAgent replaces the client's User-Agent. If empty, the User-Agent
+	// header is removed.
+	UserAgent string
+
+	// AcceptLanguage replaces the client's Accept-Language. If empty, the
+	// Accept-Language header is removed.
+	AcceptLanguage string
+
+	// CrossOriginRefererOnly, if true, only removes the Referer when it points
+	// to a different origin than the request. Otherwise Referer is always
+	// removed.
+	CrossOriginRefererOnly bool
+}
+
+// Anonymize strips headers that identify the client, including anything that
+// would reveal the client's IP address. It is meant to be used in the filter
+// chain in place of AddForwardedFor or Forwarded.
+func Anonymize(opts *AnonymizeOpts) filters.Filter {
+	if opts == nil {
+		opts = &AnonymizeOpts{}
+	}
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		for _, header := range identifyingHeaders {
+			req.Header.Del(header)
+		}
+
+		if referer := req.Header.Get("Referer"); referer != "" {
+			if !opts.CrossOriginRefererOnly || !sameOrigin(referer, req) {
+				req.Header.Del("Referer")
+			}
+		}
+
+		normalizeHeader(req.Header, "User-Agent", opts.UserAgent)
+		normalizeHeader(req.Header, "Accept-Language", opts.AcceptLanguage)
+
+		return next(ctx, req)
+	})
+}
+
+func normalizeHeader(header http.Header, key string, value string) {
+	if value == "" {
+		header.Del(key)
+	} else {
+		header.Set(key, value)
+	}
+}
+
+func sameOrigin(referer string, req *http.Request) bool {
+	refURL, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return strings.EqualFold(refURL.Scheme, scheme) && strings.EqualFold(withDefaultPort(refURL.Host, refURL.Scheme), withDefaultPort(host, scheme))
+}
+
+func withDefaultPort(host string, scheme string) string {
+	if strings.LastIndex(host, ":") > strings.LastIndex(host, "]") {
+		return host
+	}
+	if scheme == "https" {
+		return host + ":443"
+	}
+	return host + ":80"
+}
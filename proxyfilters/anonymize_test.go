@@ -0,0 +1,63 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymize(t *testing.T) {
+	req := doTestAnonymize(t, &AnonymizeOpts{
+		UserAgent: "Mozilla/5.0",
+	}, "http://example.com/index.html", "http://example.com/other.html")
+	for _, header := range identifyingHeaders {
+		assert.Empty(t, req.Header.Get(header), header)
+	}
+	assert.Empty(t, req.Header.Get("Referer"))
+	assert.Equal(t, "Mozilla/5.0", req.Header.Get("User-Agent"))
+	assert.Empty(t, req.Header.Get("Accept-Language"))
+}
+
+func TestAnonymizeSameOriginReferer(t *testing.T) {
+	req := doTestAnonymize(t, &AnonymizeOpts{
+		CrossOriginRefererOnly: true,
+		AcceptLanguage:         "en-US",
+	}, "http://example.com/index.html", "http://example.com:80/other.html")
+	assert.Equal(t, "http://example.com:80/other.html", req.Header.Get("Referer"))
+	assert.Empty(t, req.Header.Get("User-Agent"))
+	assert.Equal(t, "en-US", req.Header.Get("Accept-Language"))
+}
+
+func TestAnonymizeCrossOriginReferer(t *testing.T) {
+	req := doTestAnonymize(t, &AnonymizeOpts{
+		CrossOriginRefererOnly: true,
+	}, "http://example.com/index.html", "https://example.com/other.html")
+	assert.Empty(t, req.Header.Get("Referer"))
+}
+
+func TestAnonymizeNilOpts(t *testing.T) {
+	req := doTestAnonymize(t, nil, "http://example.com/index.html", "http://example.com/other.html")
+	assert.Empty(t, req.Header.Get("Referer"))
+	assert.Empty(t, req.Header.Get("User-Agent"))
+}
+
+func doTestAnonymize(t *testing.T, opts *AnonymizeOpts, urlStr string, referer string) *http.Request {
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+		}, ctx, nil
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, urlStr, nil)
+	req.RemoteAddr = "192.0.2.60:1234"
+	for _, header := range identifyingHeaders {
+		req.Header.Set(header, "192.0.2.60")
+	}
+	req.Header.Set("Referer", referer)
+	req.Header.Set("User-Agent", "Identifying Agent/1.0")
+	req.Header.Set("Accept-Language", "de-CH")
+	Anonymize(opts).Apply(filters.BackgroundContext(), req, next)
+	return req
+}
@@ -6,26 +6,15 @@ import (
 	"strings"
 
 	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/resolver"
 )
 
 // BlockLocal blocks attempted accesses to localhost unless they're one of the
-// listed exceptions.
+// listed exceptions. Host names are resolved with resolver.Default and blocked
+// if any of their addresses is local.
 func BlockLocal(exceptions []string) filters.Filter {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		log.Errorf("Error enumerating local addresses: %v\n", err)
-	}
-
-	localIPs := make([]net.IP, 0, len(addrs))
-	for _, a := range addrs {
-		str := a.String()
-		idx := strings.Index(str, "/")
-		if idx != -1 {
-			str = str[:idx]
-		}
-		ip := net.ParseIP(str)
-		localIPs = append(localIPs, ip)
-	}
+	localIPs := interfaceIPs()
 
 	isException := func(host string) bool {
 		for _, exception := range exceptions {
@@ -48,17 +37,19 @@ func BlockLocal(exceptions []string) filters.Filter {
 			host = req.URL.Host
 		}
 
-		ipAddr, err := net.ResolveIPAddr("ip", host)
+		ips, err := resolver.Default().LookupIP(req.Context(), host)
 
 		// If there was an error resolving is probably because it wasn't an address
 		// in the form host or host:port
 		if err == nil {
-			if ipAddr.IP.IsLoopback() {
-				return fail(ctx, req, http.StatusForbidden, "%v requested loopback address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
-			}
-			for _, localIP := range localIPs {
-				if ipAddr.IP.Equal(localIP) {
-					return fail(ctx, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+			for _, ip := range ips {
+				if ip.IsLoopback() {
+					return fail(ctx, req, http.StatusForbidden, "loopback_address", "%v requested loopback address %v (%v)", req.RemoteAddr, req.Host, ip)
+				}
+				for _, localIP := range localIPs {
+					if ip.Equal(localIP) {
+						return fail(ctx, req, http.StatusForbidden, "local_address", "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ip)
+					}
 				}
 			}
 		}
@@ -66,3 +57,42 @@ func BlockLocal(exceptions []string) filters.Filter {
 		return next(ctx, req)
 	})
 }
+
+// LocalNetworks returns the networks that BlockLocal blocks access to, the
+// loopback networks and the addresses of the host's network interfaces, for
+// example to tell clients to reach them directly.
+func LocalNetworks() []*net.IPNet {
+	_, loopback4, _ := net.ParseCIDR("127.0.0.0/8")
+	_, loopback6, _ := net.ParseCIDR("::1/128")
+	nets := []*net.IPNet{loopback4, loopback6}
+	for _, ip := range interfaceIPs() {
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets
+}
+
+func interfaceIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Errorf("Error enumerating local addresses: %v\n", err)
+	}
+
+	localIPs := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		str := a.String()
+		idx := strings.Index(str, "/")
+		if idx != -1 {
+			str = str[:idx]
+		}
+		ip := net.ParseIP(str)
+		localIPs = append(localIPs, ip)
+	}
+	return localIPs
+}
@@ -1,11 +1,16 @@
 package proxyfilters
 
 import (
+	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
 
 	"github.com/getlantern/proxy/filters"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/utils"
 )
 
 func TestBlockLocalBlocked(t *testing.T) {
@@ -24,6 +29,45 @@ func TestBlockLocalNotLocal(t *testing.T) {
 	doTestBlockLocal(t, []string{"localhost"}, "http://example.com/index.html", http.StatusOK)
 }
 
+func TestBlockLocalResolvesToLocal(t *testing.T) {
+	r, err := resolver.New(&resolver.Opts{Hosts: map[string][]string{"sneaky.test": {"203.0.113.1", "127.0.0.1"}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	prior := resolver.Default()
+	resolver.SetDefault(r)
+	defer resolver.SetDefault(prior)
+	doTestBlockLocal(t, []string{"localhost"}, "http://sneaky.test/index.html", http.StatusForbidden)
+}
+
+func TestLocalNetworks(t *testing.T) {
+	var blocked []string
+	for _, n := range LocalNetworks() {
+		blocked = append(blocked, n.String())
+		// Every local network is refused by BlockLocal
+		doTestBlockLocal(t, nil, "http://"+net.JoinHostPort(n.IP.String(), "80")+"/", http.StatusForbidden)
+	}
+	assert.Contains(t, blocked, "127.0.0.0/8")
+	assert.Contains(t, blocked, "::1/128")
+}
+
+func TestBlockLocalErrorPages(t *testing.T) {
+	pages := utils.NewErrorPages()
+	templates, err := utils.ParseErrorTemplates("", "", "custom {{.Status}} {{.Reason}}")
+	if !assert.NoError(t, err) {
+		return
+	}
+	pages.SetTemplates(http.StatusForbidden, templates)
+	ctx := utils.WithErrorPages(filters.BackgroundContext(), pages)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	resp, _, _ := BlockLocal(nil).Apply(ctx, req, nil)
+	if assert.Equal(t, http.StatusForbidden, resp.StatusCode) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "custom 403 loopback_address", string(body), "filters should render the error pages in the context")
+	}
+}
+
 func doTestBlockLocal(t *testing.T, exceptions []string, urlStr string, expectedStatus int) {
 	ctx := filters.BackgroundContext()
 	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
@@ -22,12 +22,12 @@ func RestrictConnectPorts(allowedPorts []int) filters.Filter {
 		if err != nil {
 			// CONNECT request should always include port in req.Host.
 			// Ref https://tools.ietf.org/html/rfc2817#section-5.2.
-			return fail(ctx, req, http.StatusBadRequest, "No port field in Request-URI / Host header")
+			return fail(ctx, req, http.StatusBadRequest, "missing_port", "No port field in Request-URI / Host header")
 		}
 
 		port, err := strconv.Atoi(portString)
 		if err != nil {
-			return fail(ctx, req, http.StatusBadRequest, "Invalid port")
+			return fail(ctx, req, http.StatusBadRequest, "invalid_port", "Invalid port")
 		}
 
 		for _, p := range allowedPorts {
@@ -35,6 +35,6 @@ func RestrictConnectPorts(allowedPorts []int) filters.Filter {
 				return next(ctx, req)
 			}
 		}
-		return fail(ctx, req, http.StatusForbidden, "Port not allowed")
+		return fail(ctx, req, http.StatusForbidden, "port_not_allowed", "Port not allowed")
 	})
 }
@@ -6,11 +6,22 @@ import (
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/utils"
 )
 
 var log = golog.LoggerFor("http-proxy.filters")
 
-func fail(ctx filters.Context, req *http.Request, statusCode int, description string, params ...interface{}) (*http.Response, filters.Context, error) {
+// fail logs the given description and responds to the client with the error
+// page for statusCode and reason, rendered with the error pages in ctx (see
+// utils.WithErrorPages). The description itself is not sent to the client.
+func fail(ctx filters.Context, req *http.Request, statusCode int, reason string, description string, params ...interface{}) (*http.Response, filters.Context, error) {
 	log.Errorf("Filter fail: "+description, params...)
-	return filters.Fail(ctx, req, statusCode, errors.New(description, params...))
+	resp := utils.ErrorPagesFor(ctx).Response(req, &utils.ErrorPage{
+		Status:    statusCode,
+		Reason:    reason,
+		RequestID: utils.RequestID(ctx),
+	})
+	resp.Close = true
+	return resp, ctx, errors.New(description, params...)
 }
@@ -0,0 +1,242 @@
+package proxyfilters
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	forwarded = "Forwarded"
+
+	clientIPKey = ctxKey("clientIP")
+)
+
+// ForwardedOpts configures the Forwarded filter.
+type ForwardedOpts struct {
+	// TrustedProxies lists the CIDRs (or bare IPs) of peers whose incoming
+	// Forwarded and X-Forwarded-For headers are trusted. Headers from any other
+	// peer are dropped before we add our own.
+	TrustedProxies []string
+
+	// EmitForwarded adds an RFC 7239 Forwarded header to upstream requests.
+	EmitForwarded bool
+
+	// EmitXForwardedFor adds an X-Forwarded-For header to upstream requests.
+	EmitXForwardedFor bool
+
+	// By is the value used for the by= parameter of the Forwarded header. If
+	// empty, the local address of the client connection is used.
+	By string
+}
+
+// Forwarded adds Forwarded and/or X-Forwarded-For headers to non-CONNECT
+// requests. Incoming forwarding headers are only kept when the peer is one of
+// the TrustedProxies, in which case they are also used to determine the
+// effective client IP (see ClientIP).
+func Forwarded(opts *ForwardedOpts) (filters.Filter, error) {
+	if opts == nil {
+		opts = &ForwardedOpts{}
+	}
+	trusted, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		peer, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return next(ctx, req)
+		}
+		clientIP := peer
+		peerIP := net.ParseIP(peer)
+		if peerIP != nil && isTrusted(peerIP) {
+			hops := forwardedHops(req.Header)
+			// Walk back from the closest hop, the first untrusted address is the
+			// client.
+			for i := len(hops) - 1; i >= 0; i-- {
+				hopIP := net.ParseIP(hops[i])
+				if hopIP == nil {
+					break
+				}
+				clientIP = hops[i]
+				if !isTrusted(hopIP) {
+					break
+				}
+			}
+		} else {
+			req.Header.Del(forwarded)
+			req.Header.Del(xForwardedFor)
+		}
+		ctx = ctx.WithValue(clientIPKey, clientIP)
+
+		if req.Method != http.MethodConnect {
+			if opts.EmitXForwardedFor {
+				xff := peer
+				if prior, ok := req.Header[xForwardedFor]; ok {
+					xff = strings.Join(prior, ", ") + ", " + peer
+				}
+				req.Header.Set(xForwardedFor, xff)
+			}
+			if opts.EmitForwarded {
+				by := opts.By
+				downstream := ctx.DownstreamConn()
+				if by == "" && downstream != nil && downstream.LocalAddr() != nil {
+					by, _, _ = net.SplitHostPort(downstream.LocalAddr().String())
+				}
+				proto := "http"
+				if isTLS(downstream) {
+					proto = "https"
+				}
+				elem := "for=" + forwardedNode(peer) + ";proto=" + proto
+				if by != "" {
+					elem += ";by=" + forwardedNode(by)
+				}
+				if req.Host != "" {
+					elem += ";host=" + forwardedValue(req.Host)
+				}
+				req.Header.Add(forwarded, elem)
+			}
+		}
+
+		return next(ctx, req)
+	}), nil
+}
+
+// ClientIP returns the effective client IP for the given request. If the
+// Forwarded filter determined the client IP from trusted forwarding headers,
+// that IP is returned, otherwise it's the IP from the request's RemoteAddr.
+func ClientIP(ctx filters.Context, req *http.Request) string {
+	if ctx != nil {
+		if clientIP, ok := ctx.Value(clientIPKey).(string); ok {
+			return clientIP
+		}
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return clientIP
+}
+
+// forwardedHops extracts the list of client addresses recorded in the
+// Forwarded header or, absent that, the X-Forwarded-For header, ordered from
+// the original client to the most recent proxy.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if values, ok := header[forwarded]; ok {
+		for _, value := range values {
+			for _, elem := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(elem, ";") {
+					parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(parts) != 2 || !strings.EqualFold(parts[0], "for") {
+						continue
+					}
+					hops = append(hops, parseForwardedNode(parts[1]))
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header[xForwardedFor] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode converts a node from a Forwarded header (e.g.
+// "\"[2001:db8::1]:4711\"") to a bare address.
+func parseForwardedNode(node string) string {
+	node = strings.Trim(node, "\"")
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end == -1 {
+			return node
+		}
+		return node[1:end]
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// forwardedNode formats an address for use in a Forwarded header, quoting and
+// bracketing IPv6 addresses as required by RFC 7239.
+func forwardedNode(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return "\"[" + addr + "]\""
+	}
+	return forwardedValue(addr)
+}
+
+// forwardedValue quotes value if it contains characters that aren't allowed in
+// an HTTP token.
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if !isTokenChar(r) {
+			return "\"" + strings.Replace(value, "\"", "\\\"", -1) + "\""
+		}
+	}
+	return value
+}
+
+func isTokenChar(r rune) bool {
+	if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+func isTLS(conn net.Conn) bool {
+	if conn == nil {
+		return false
+	}
+	result := false
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		_, result = wrapped.(*tls.Conn)
+		return !result
+	})
+	return result
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("Invalid IP %v", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("Invalid CIDR %v: %v", cidr, err)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedUntrustedPeer(t *testing.T) {
+	req, clientIP := doTestForwarded(t, &ForwardedOpts{
+		TrustedProxies:    []string{"10.0.0.0/8"},
+		EmitForwarded:     true,
+		EmitXForwardedFor: true,
+		By:                "proxy",
+	}, "192.0.2.60:1234", http.Header{
+		forwarded:     []string{"for=198.51.100.17"},
+		xForwardedFor: []string{"198.51.100.17"},
+	})
+	assert.Equal(t, "192.0.2.60", clientIP)
+	assert.Equal(t, "192.0.2.60", req.Header.Get(xForwardedFor))
+	assert.Equal(t, []string{"for=192.0.2.60;proto=http;by=proxy;host=example.com"}, req.Header[forwarded])
+}
+
+func TestForwardedTrustedPeer(t *testing.T) {
+	req, clientIP := doTestForwarded(t, &ForwardedOpts{
+		TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"},
+		EmitForwarded:  true,
+		By:             "proxy",
+	}, "[2001:db8::1]:1234", http.Header{
+		forwarded: []string{"for=198.51.100.17, for=\"10.1.1.1:4711\""},
+	})
+	assert.Equal(t, "198.51.100.17", clientIP)
+	assert.Equal(t, []string{
+		"for=198.51.100.17, for=\"10.1.1.1:4711\"",
+		"for=\"[2001:db8::1]\";proto=http;by=proxy;host=example.com",
+	}, req.Header[forwarded])
+}
+
+func TestForwardedTrustedXForwardedFor(t *testing.T) {
+	req, clientIP := doTestForwarded(t, &ForwardedOpts{
+		TrustedProxies:    []string{"10.0.0.0/8"},
+		EmitXForwardedFor: true,
+	}, "10.0.0.1:1234", http.Header{
+		xForwardedFor: []string{"198.51.100.17, 10.0.0.2"},
+	})
+	assert.Equal(t, "198.51.100.17", clientIP)
+	assert.Equal(t, "198.51.100.17, 10.0.0.2, 10.0.0.1", req.Header.Get(xForwardedFor))
+	assert.Empty(t, req.Header.Get(forwarded))
+}
+
+func TestForwardedNilOpts(t *testing.T) {
+	req, clientIP := doTestForwarded(t, nil, "192.0.2.60:1234", http.Header{
+		xForwardedFor: []string{"198.51.100.17"},
+	})
+	assert.Equal(t, "192.0.2.60", clientIP)
+	assert.Empty(t, req.Header.Get(xForwardedFor))
+	assert.Empty(t, req.Header.Get(forwarded))
+}
+
+func TestForwardedInvalidTrustedProxy(t *testing.T) {
+	_, err := Forwarded(&ForwardedOpts{TrustedProxies: []string{"not an ip"}})
+	assert.Error(t, err)
+}
+
+func doTestForwarded(t *testing.T, opts *ForwardedOpts, remoteAddr string, header http.Header) (*http.Request, string) {
+	filter, err := Forwarded(opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	var clientIP string
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		clientIP = ClientIP(ctx, req)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+		}, ctx, nil
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/index.html", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header = header
+	filter.Apply(filters.BackgroundContext(), req, next)
+	return req, clientIP
+}
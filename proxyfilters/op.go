@@ -6,6 +6,8 @@ import (
 	"github.com/getlantern/errors"
 	"github.com/getlantern/ops"
 	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/utils"
 )
 
 type ctxKey string
@@ -23,6 +25,9 @@ var RecordOp = filters.FilterFunc(func(ctx filters.Context, req *http.Request, n
 		name += "s"
 	}
 	op := ops.Begin(name)
+	if requestID := utils.RequestID(ctx); requestID != "" {
+		op.Set("request_id", requestID)
+	}
 	ctx = ctx.WithValue(opKey, op)
 	resp, nextCtx, err := next(ctx, req)
 	if err != nil {
@@ -12,6 +12,8 @@ import (
 
 // RateLimit restricts access to only specific hosts and limits the rate at
 // which clients (identified by IP address) are allowed to access thoses hosts.
+// When running behind trusted proxies, clients are identified by the effective
+// client IP determined by the Forwarded filter.
 func RateLimit(numClients int, hostPeriods map[string]time.Duration) filters.Filter {
 	if numClients <= 0 {
 		numClients = 5000
@@ -24,14 +26,14 @@ func RateLimit(numClients int, hostPeriods map[string]time.Duration) filters.Fil
 		if err != nil {
 			host = req.Host
 		}
-		client, _, _ := net.SplitHostPort(req.RemoteAddr)
+		client := ClientIP(ctx, req)
 		now := time.Now()
 
 		mx.Lock()
 		defer mx.Unlock()
 		period := hostPeriods[host]
 		if period == 0 {
-			return fail(ctx, req, http.StatusForbidden, "Access to %v not allowed", host)
+			return fail(ctx, req, http.StatusForbidden, "host_not_allowed", "Access to %v not allowed", host)
 		}
 		var hostAccesses map[string]time.Time
 		_hostAccesses, found := hostAccessesByClient.Get(client)
@@ -46,7 +48,7 @@ func RateLimit(numClients int, hostPeriods map[string]time.Duration) filters.Fil
 			hostAccessesByClient.Add(client, hostAccesses)
 		}
 		if !allowed {
-			return fail(ctx, req, http.StatusForbidden, "Rate limit for %v exceeded", host)
+			return fail(ctx, req, http.StatusForbidden, "rate_limited", "Rate limit for %v exceeded", host)
 		}
 
 		return next(ctx, req)
@@ -0,0 +1,92 @@
+package proxyfilters
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	maxRequestIDLength = 128
+)
+
+// RequestIDOpts configures the RequestID filter.
+type RequestIDOpts struct {
+	// TrustedProxies lists the CIDRs (or bare IPs) of peers whose incoming
+	// X-Request-Id headers are accepted. For all other peers a new request ID
+	// is generated.
+	TrustedProxies []string
+}
+
+// WithOp returns a copy of ctx carrying the given op, so that filters like
+// RequestID can annotate the op that's tracking the current connection.
+func WithOp(ctx context.Context, op ops.Op) context.Context {
+	return context.WithValue(ctx, opKey, op)
+}
+
+// RequestID assigns a request ID to every request and tunnel, or accepts the
+// one supplied by a trusted peer. The request ID is stored in the filter
+// context (see utils.RequestID), recorded on a per-request child of the
+// connection's op so that it shows up in ops and log lines of that request
+// only, and sent upstream in the X-Request-Id header of non-CONNECT requests.
+func RequestID(opts *RequestIDOpts) (filters.Filter, error) {
+	if opts == nil {
+		opts = &RequestIDOpts{}
+	}
+	trusted, err := parseCIDRs(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	isTrusted := func(remoteAddr string) bool {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		requestID := req.Header.Get(utils.RequestIDHeader)
+		if requestID == "" || !isValidRequestID(requestID) || !isTrusted(req.RemoteAddr) {
+			requestID = utils.NewRequestID()
+		}
+		ctx = utils.WithRequestID(ctx, requestID)
+		if op, ok := ctx.Value(opKey).(ops.Op); ok {
+			// Requests on the same connection mustn't overwrite each other's ID
+			reqOp := op.Begin("http_proxy_request").Set("request_id", requestID)
+			defer reqOp.End()
+			ctx = ctx.WithValue(opKey, reqOp)
+		}
+		if req.Method != http.MethodConnect {
+			req.Header.Set(utils.RequestIDHeader, requestID)
+		}
+		return next(ctx, req)
+	}), nil
+}
+
+func isValidRequestID(requestID string) bool {
+	if len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range requestID {
+		if !isTokenChar(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+func TestRequestIDGenerated(t *testing.T) {
+	requestID, err := RequestID(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doTestFilter(t,
+		filters.Join(requestID, RecordOp),
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			err := send(http.MethodGet, http.Header{utils.RequestIDHeader: []string{"spoofed"}}, "")
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, _, err := recv()
+			if !assert.NoError(t, err) {
+				return
+			}
+			reflected := resp.Header.Get("Reflected-" + utils.RequestIDHeader)
+			assert.Len(t, reflected, 32)
+			assert.NotEqual(t, "spoofed", reflected)
+		})
+}
+
+func TestRequestIDTrusted(t *testing.T) {
+	requestID, err := RequestID(&RequestIDOpts{TrustedProxies: []string{"127.0.0.0/8", "::1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	doTestFilter(t,
+		requestID,
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			err := send(http.MethodGet, http.Header{utils.RequestIDHeader: []string{"upstream-id"}}, "")
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, _, err := recv()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, "upstream-id", resp.Header.Get("Reflected-"+utils.RequestIDHeader))
+		})
+}
+
+func TestRequestIDInErrorResponse(t *testing.T) {
+	requestID, err := RequestID(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var assigned string
+	capture := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		assigned = utils.RequestID(ctx)
+		return next(ctx, req)
+	})
+	doTestFilter(t,
+		filters.Join(requestID, capture, RestrictConnectPorts([]int{443})),
+		func(send func(method string, headers http.Header, body string) error, recv func() (*http.Response, string, error)) {
+			err := send(http.MethodConnect, nil, "")
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp, body, err := recv()
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			assert.NotEmpty(t, assigned)
+			assert.Equal(t, assigned, resp.Header.Get(utils.RequestIDHeader))
+			assert.Contains(t, body, assigned)
+		})
+}
+
+func TestRequestIDPerRequestOp(t *testing.T) {
+	requestID, err := RequestID(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var mx sync.Mutex
+	var reported []string
+	ops.RegisterReporter(func(failure error, ctx map[string]interface{}) {
+		if ctx["op"] == "http_proxy_request" && ctx["root_op"] == "test_connection" {
+			mx.Lock()
+			reported = append(reported, ctx["request_id"].(string))
+			mx.Unlock()
+		}
+	})
+
+	connOp := ops.Begin("test_connection")
+	defer connOp.End()
+	ctx := filters.BackgroundContext().WithValue(opKey, connOp)
+	var assigned []string
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		assigned = append(assigned, utils.RequestID(ctx))
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		requestID.Apply(ctx, req, next)
+	}
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Len(t, assigned, 2)
+	assert.NotEqual(t, assigned[0], assigned[1])
+	assert.Equal(t, assigned, reported, "each request should be reported with its own ID")
+}
@@ -0,0 +1,524 @@
+// Package quota enforces daily and monthly traffic quotas per client IP or
+// user. Requests are counted by a filter (see Quota.Filter) and bytes are
+// counted from the reports of measured connections (see Quota.Report), so
+// byte quotas require listeners.NewMeasuredListener. Byte quotas are also
+// enforced on connections that are already open, like tunnels, as soon as
+// they're exceeded. Usage can be persisted to a file so that restarting the
+// proxy doesn't reset it.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/server"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	// RemainingHeader is the response header reporting the remaining quota,
+	// like "daily-bytes=1000, monthly-requests=20".
+	RemainingHeader = "X-Quota-Remaining"
+
+	// measuredKey is the key in the measured context that identifies whose
+	// quota a connection's bytes count against.
+	measuredKey = "quota_key"
+	// measuredConnKey is the key in the measured context holding the ID of
+	// the connection, see server.ConnID.
+	measuredConnKey = "quota_conn"
+
+	defaultSaveInterval = 1 * time.Minute
+	dayFormat           = "2006-01-02"
+	monthFormat         = "2006-01"
+)
+
+var (
+	log = golog.LoggerFor("quota")
+)
+
+// Limits are the limits for one period. 0 means unlimited.
+type Limits struct {
+	Bytes    int64
+	Requests int64
+}
+
+// Opts configures a Quota.
+type Opts struct {
+	Daily   Limits
+	Monthly Limits
+
+	// ByUser keys quotas by the user set with server.SetUser, falling back to
+	// the client IP for connections without a user. Otherwise quotas are keyed
+	// by client IP only.
+	ByUser bool
+
+	// ThrottleBytesPerSecond, if positive, throttles clients that exceeded
+	// their quota to the given bandwidth instead of rejecting their requests
+	// and closing their connections. This requires
+	// listeners.NewThrottledListener. Throttled connections stay throttled
+	// until they're closed.
+	ThrottleBytesPerSecond int64
+
+	// File, if specified, is where usage is persisted.
+	File string
+
+	// SaveInterval is how often usage is saved to File and usage from past
+	// periods is forgotten. Defaults to 1 minute.
+	SaveInterval time.Duration
+
+	// ErrorPages renders the response for rejected requests. Defaults to the
+	// server's error pages (see utils.ErrorPagesFor).
+	ErrorPages *utils.ErrorPages
+}
+
+// Counts are the bytes and requests used or remaining in a period.
+type Counts struct {
+	Bytes    int64 `json:"bytes"`
+	Requests int64 `json:"requests"`
+}
+
+// Usage is the usage of a single client IP or user.
+type Usage struct {
+	// Key identifies the client, like "ip:127.0.0.1" or "user:alice".
+	Key     string `json:"key"`
+	Day     string `json:"day"`
+	Daily   Counts `json:"daily"`
+	Month   string `json:"month"`
+	Monthly Counts `json:"monthly"`
+}
+
+// Status is a client's usage along with its remaining quota.
+type Status struct {
+	Usage
+	// Remaining is the remaining quota. Unlimited counts are reported as -1.
+	RemainingDaily   Counts `json:"remaining_daily"`
+	RemainingMonthly Counts `json:"remaining_monthly"`
+	Exceeded         bool   `json:"exceeded"`
+}
+
+// Header formats the remaining quota for RemainingHeader. Unlimited counts are
+// omitted.
+func (s *Status) Header() string {
+	var parts []string
+	add := func(name string, remaining int64) {
+		if remaining >= 0 {
+			parts = append(parts, name+"="+strconv.FormatInt(remaining, 10))
+		}
+	}
+	add("daily-bytes", s.RemainingDaily.Bytes)
+	add("daily-requests", s.RemainingDaily.Requests)
+	add("monthly-bytes", s.RemainingMonthly.Bytes)
+	add("monthly-requests", s.RemainingMonthly.Requests)
+	return strings.Join(parts, ", ")
+}
+
+// Quota tracks and enforces quotas.
+type Quota struct {
+	opts  *Opts
+	usage map[string]*Usage
+	dirty bool
+	// conns are the open measured connections by ID, and connsByKey the same
+	// by key, so that quotas can be enforced on them when they're exceeded
+	conns      map[uint64]*liveConn
+	connsByKey map[string]map[uint64]*liveConn
+	mx         sync.Mutex
+	now        func() time.Time
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// New constructs a Quota, loading previously saved usage from opts.File if it
+// exists.
+func New(opts *Opts) (*Quota, error) {
+	if opts.SaveInterval <= 0 {
+		opts.SaveInterval = defaultSaveInterval
+	}
+	q := &Quota{
+		opts:       opts,
+		usage:      make(map[string]*Usage),
+		conns:      make(map[uint64]*liveConn),
+		connsByKey: make(map[string]map[uint64]*liveConn),
+		now:        time.Now,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if opts.File != "" {
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+	go q.savePeriodically()
+	return q, nil
+}
+
+// Filter returns a filter that counts requests, rejects (or throttles) clients
+// that exceeded their quota and reports the remaining quota in
+// RemainingHeader. It needs to run after any filter that sets the user.
+func (q *Quota) Filter() filters.Filter {
+	return filters.FilterFunc(q.filter)
+}
+
+func (q *Quota) filter(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	key := q.key(ctx, req)
+	// Count this connection's bytes against key. This fails if the connection
+	// isn't measured, in which case byte quotas aren't enforced for it.
+	id := server.ConnID(ctx)
+	if err := server.ControlConn(ctx, listeners.UpdateMeasuredContext{measuredKey: key, measuredConnKey: id}); err != nil {
+		log.Tracef("Unable to count bytes for %v: %v", key, err)
+	} else if id != 0 {
+		q.track(id, key, ctx)
+	}
+
+	status, allowed := q.countRequest(key)
+	if !allowed {
+		if q.opts.ThrottleBytesPerSecond <= 0 {
+			pages := q.opts.ErrorPages
+			if pages == nil {
+				pages = utils.ErrorPagesFor(ctx)
+			}
+			resp := pages.Response(req, &utils.ErrorPage{
+				Status:    http.StatusTooManyRequests,
+				Reason:    "quota_exceeded",
+				RequestID: utils.RequestID(ctx),
+			})
+			resp.Header.Set(RemainingHeader, status.Header())
+			return filters.ShortCircuit(ctx, req, resp)
+		}
+		if err := server.ControlConn(ctx, server.SetBandwidth{BytesPerSecond: q.opts.ThrottleBytesPerSecond}); err != nil {
+			log.Errorf("Unable to throttle %v: %v", key, err)
+		}
+	}
+
+	resp, nextCtx, err := next(ctx, req)
+	if resp != nil {
+		if header := status.Header(); header != "" {
+			resp.Header.Set(RemainingHeader, header)
+		}
+	}
+	return resp, nextCtx, err
+}
+
+func (q *Quota) key(ctx filters.Context, req *http.Request) string {
+	if q.opts.ByUser {
+		if user := server.User(ctx); user != "" {
+			return "user:" + user
+		}
+	}
+	return "ip:" + proxyfilters.ClientIP(ctx, req)
+}
+
+// liveConn is an open connection whose bytes count against a quota.
+type liveConn struct {
+	id  uint64
+	key string
+	// control applies control messages to the connection
+	control func(msg server.ControlMessage) error
+	// enforced is true once the exceeded quota was enforced on the connection
+	enforced bool
+}
+
+// track records that the connection with the given ID counts against key, so
+// that the quota can be enforced on it until its final report.
+func (q *Quota) track(id uint64, key string, ctx context.Context) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if c := q.conns[id]; c != nil {
+		if c.key == key {
+			return
+		}
+		q.untrackLocked(c)
+	}
+	c := &liveConn{
+		id:  id,
+		key: key,
+		control: func(msg server.ControlMessage) error {
+			return server.ControlConn(ctx, msg)
+		},
+	}
+	q.conns[id] = c
+	conns := q.connsByKey[key]
+	if conns == nil {
+		conns = make(map[uint64]*liveConn)
+		q.connsByKey[key] = conns
+	}
+	conns[id] = c
+}
+
+// untrackLocked forgets c. Must be called with mx held.
+func (q *Quota) untrackLocked(c *liveConn) {
+	delete(q.conns, c.id)
+	conns := q.connsByKey[c.key]
+	delete(conns, c.id)
+	if len(conns) == 0 {
+		delete(q.connsByKey, c.key)
+	}
+}
+
+// enforce throttles or closes c, whose quota was exceeded.
+func (q *Quota) enforce(c *liveConn) {
+	var msg server.ControlMessage = server.CloseConn{}
+	if q.opts.ThrottleBytesPerSecond > 0 {
+		msg = server.SetBandwidth{BytesPerSecond: q.opts.ThrottleBytesPerSecond}
+	}
+	log.Debugf("Quota of %v exceeded, applying %v to connection %d", c.key, msg.MessageType(), c.id)
+	if err := c.control(msg); err != nil {
+		log.Errorf("Unable to enforce quota of %v on connection %d: %v", c.key, c.id, err)
+	}
+}
+
+// Report is a listeners.MeasuredReportFN that counts bytes sent and received
+// against the quota of the connection's client. Once the client's quota is
+// exceeded, its open connections are throttled or closed.
+func (q *Quota) Report(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	key, _ := ctx[measuredKey].(string)
+	id, _ := ctx[measuredConnKey].(uint64)
+	bytes := int64(deltaStats.SentTotal + deltaStats.RecvTotal)
+	q.mx.Lock()
+	if c := q.conns[id]; c != nil && final {
+		q.untrackLocked(c)
+	}
+	if key == "" || bytes == 0 {
+		q.mx.Unlock()
+		return
+	}
+	u := q.current(key)
+	u.Daily.Bytes += bytes
+	u.Monthly.Bytes += bytes
+	q.dirty = true
+	var exceeded []*liveConn
+	if status := q.status(u); status.RemainingDaily.Bytes == 0 || status.RemainingMonthly.Bytes == 0 {
+		for _, c := range q.connsByKey[key] {
+			if !c.enforced {
+				c.enforced = true
+				exceeded = append(exceeded, c)
+			}
+		}
+	}
+	q.mx.Unlock()
+	// Closing connections reports them, so enforce without holding mx
+	for _, c := range exceeded {
+		q.enforce(c)
+	}
+}
+
+// countRequest counts a request unless the quota is already exceeded, in
+// which case allowed is false, and returns the resulting status.
+func (q *Quota) countRequest(key string) (status *Status, allowed bool) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	u := q.current(key)
+	if q.status(u).Exceeded {
+		return q.status(u), false
+	}
+	u.Daily.Requests++
+	u.Monthly.Requests++
+	q.dirty = true
+	return q.status(u), true
+}
+
+// current returns the usage for key in the current periods. Must be called
+// with mx held.
+func (q *Quota) current(key string) *Usage {
+	now := q.now().UTC()
+	day, month := now.Format(dayFormat), now.Format(monthFormat)
+	u := q.usage[key]
+	if u == nil {
+		u = &Usage{Key: key, Day: day, Month: month}
+		q.usage[key] = u
+	}
+	if u.Day != day {
+		u.Day = day
+		u.Daily = Counts{}
+	}
+	if u.Month != month {
+		u.Month = month
+		u.Monthly = Counts{}
+	}
+	return u
+}
+
+func (q *Quota) status(u *Usage) *Status {
+	s := &Status{Usage: *u}
+	var dailyExceeded, monthlyExceeded bool
+	s.RemainingDaily, dailyExceeded = remaining(q.opts.Daily, u.Daily)
+	s.RemainingMonthly, monthlyExceeded = remaining(q.opts.Monthly, u.Monthly)
+	s.Exceeded = dailyExceeded || monthlyExceeded
+	return s
+}
+
+func remaining(limits Limits, used Counts) (Counts, bool) {
+	r := Counts{Bytes: -1, Requests: -1}
+	exceeded := false
+	if limits.Bytes > 0 {
+		r.Bytes = max(limits.Bytes-used.Bytes, 0)
+		exceeded = r.Bytes == 0
+	}
+	if limits.Requests > 0 {
+		r.Requests = max(limits.Requests-used.Requests, 0)
+		exceeded = exceeded || r.Requests == 0
+	}
+	return r, exceeded
+}
+
+// Status returns the status of the client with the given key, like
+// "ip:127.0.0.1" or "user:alice".
+func (q *Quota) Status(key string) (*Status, bool) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.usage[key] == nil {
+		return nil, false
+	}
+	return q.status(q.current(key)), true
+}
+
+// All returns the status of all known clients, ordered by key.
+func (q *Quota) All() []*Status {
+	q.mx.Lock()
+	result := make([]*Status, 0, len(q.usage))
+	for key := range q.usage {
+		result = append(result, q.status(q.current(key)))
+	}
+	q.mx.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// Reset forgets the usage of the client with the given key, returning false if
+// there was none.
+func (q *Quota) Reset(key string) bool {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.usage[key] == nil {
+		return false
+	}
+	delete(q.usage, key)
+	q.dirty = true
+	return true
+}
+
+type savedUsage struct {
+	Usage []*Usage `json:"usage"`
+}
+
+func (q *Quota) load() error {
+	b, err := ioutil.ReadFile(q.opts.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New("Unable to read quota file %v: %v", q.opts.File, err)
+	}
+	var saved savedUsage
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return errors.New("Unable to parse quota file %v: %v", q.opts.File, err)
+	}
+	for _, u := range saved.Usage {
+		q.usage[u.Key] = u
+	}
+	log.Debugf("Loaded usage of %d clients from %v", len(saved.Usage), q.opts.File)
+	return nil
+}
+
+// Save writes usage to the configured file, if any. Usage from past periods
+// is dropped.
+func (q *Quota) Save() error {
+	if q.opts.File == "" {
+		return nil
+	}
+	q.mx.Lock()
+	q.expire()
+	saved := savedUsage{Usage: make([]*Usage, 0, len(q.usage))}
+	for _, u := range q.usage {
+		copied := *u
+		saved.Usage = append(saved.Usage, &copied)
+	}
+	q.dirty = false
+	q.mx.Unlock()
+	sort.Slice(saved.Usage, func(i, j int) bool { return saved.Usage[i].Key < saved.Usage[j].Key })
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	// Write to a temp file and rename it so that the file is never left half
+	// written
+	tmp, err := ioutil.TempFile(filepath.Dir(q.opts.File), filepath.Base(q.opts.File)+".tmp")
+	if err != nil {
+		return errors.New("Unable to create temp file for quota: %v", err)
+	}
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), q.opts.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.New("Unable to save quota to %v: %v", q.opts.File, err)
+	}
+	return nil
+}
+
+// expire forgets the usage of clients that haven't used anything in the
+// current periods. Must be called with mx held.
+func (q *Quota) expire() {
+	for key := range q.usage {
+		u := q.current(key)
+		if u.Daily == (Counts{}) && u.Monthly == (Counts{}) {
+			delete(q.usage, key)
+		}
+	}
+}
+
+// savePeriodically expires usage from past periods and saves usage if it
+// changed, every SaveInterval.
+func (q *Quota) savePeriodically() {
+	defer close(q.stopped)
+	ticker := time.NewTicker(q.opts.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.mx.Lock()
+			q.expire()
+			dirty := q.dirty
+			q.mx.Unlock()
+			if dirty {
+				if err := q.Save(); err != nil {
+					log.Error(err)
+				}
+			}
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Close stops saving periodically and saves one last time.
+func (q *Quota) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.stop)
+	})
+	<-q.stopped
+	return q.Save()
+}
@@ -0,0 +1,210 @@
+package quota
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/server"
+)
+
+func TestRequestQuota(t *testing.T) {
+	q, err := New(&Opts{Daily: Limits{Requests: 2}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	addr, origin := startProxy(t, q)
+	defer origin.Close()
+
+	resp := get(t, addr, origin.URL)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "daily-requests=1", resp.Header.Get(RemainingHeader))
+	}
+	resp = get(t, addr, origin.URL)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "daily-requests=0", resp.Header.Get(RemainingHeader))
+	}
+	resp = get(t, addr, origin.URL)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "daily-requests=0", resp.Header.Get(RemainingHeader))
+	}
+
+	status, found := q.Status("ip:127.0.0.1")
+	if assert.True(t, found) {
+		assert.True(t, status.Exceeded)
+		assert.EqualValues(t, 2, status.Daily.Requests)
+		assert.EqualValues(t, 2, status.Monthly.Requests)
+		assert.EqualValues(t, -1, status.RemainingMonthly.Requests)
+	}
+
+	// A new day
+	q.mx.Lock()
+	q.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	q.mx.Unlock()
+	resp = get(t, addr, origin.URL)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	assert.True(t, q.Reset("ip:127.0.0.1"))
+	assert.False(t, q.Reset("ip:127.0.0.1"))
+
+	// Usage from past periods is forgotten, even if it isn't saved
+	get(t, addr, origin.URL)
+	q.mx.Lock()
+	q.now = func() time.Time { return time.Now().AddDate(0, 2, 0) }
+	q.expire()
+	q.mx.Unlock()
+	_, found = q.Status("ip:127.0.0.1")
+	assert.False(t, found)
+}
+
+func TestByteQuotaPersisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "quota.json")
+	q, err := New(&Opts{Monthly: Limits{Bytes: 1000}, File: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr, origin := startProxy(t, q)
+	defer origin.Close()
+
+	resp := get(t, addr, origin.URL+"/big")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "monthly-bytes=1000", resp.Header.Get(RemainingHeader))
+	}
+	// Wait for bytes to be reported
+	for i := 0; i < 100; i++ {
+		if status, _ := q.Status("ip:127.0.0.1"); status != nil && status.Exceeded {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp = get(t, addr, origin.URL)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, "monthly-bytes=0", resp.Header.Get(RemainingHeader))
+	}
+	if !assert.NoError(t, q.Close()) {
+		return
+	}
+
+	// Usage survives a restart
+	q, err = New(&Opts{Monthly: Limits{Bytes: 1000}, File: file})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	all := q.All()
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, "ip:127.0.0.1", all[0].Key)
+		assert.True(t, all[0].Monthly.Bytes > 2000)
+		assert.True(t, all[0].Exceeded)
+	}
+}
+
+func TestByteQuotaClosesTunnels(t *testing.T) {
+	q, err := New(&Opts{Daily: Limits{Bytes: 1000}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	addr, origin := startProxy(t, q)
+	defer origin.Close()
+	echo, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+echo.Addr().String(), nil)
+	req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	// The tunnel is closed once it uses up the quota
+	go func() {
+		for {
+			if _, err := conn.Write([]byte(strings.Repeat("a", 100))); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.Copy(ioutil.Discard, br)
+	assert.NoError(t, err, "tunnel should be closed rather than time out")
+	assert.True(t, n > 0 && n < 5000, "tunnel should be closed soon after exceeding the quota, echoed %d", n)
+	status, _ := q.Status("ip:127.0.0.1")
+	if assert.NotNil(t, status) {
+		assert.True(t, status.Exceeded)
+	}
+}
+
+func startProxy(t *testing.T, q *Quota) (string, *httptest.Server) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/big" {
+			w.Write([]byte(strings.Repeat("a", 2000)))
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+
+	srv := server.New(&server.Opts{Filter: q.Filter()})
+	srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+		return listeners.NewMeasuredListener(ls, 10*time.Millisecond, q.Report)
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	return <-ready, origin
+}
+
+func get(t *testing.T, addr string, url string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if !assert.NoError(t, req.WriteProxy(conn)) {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
@@ -0,0 +1,355 @@
+// Package resilience makes dialing upstream resilient to failing origins. Dials
+// for idempotent requests are retried with exponential backoff, and a circuit
+// breaker per destination fails dials fast once the destination has failed
+// repeatedly, probing it again after a while (half-open) to detect recovery.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenProbes   = 1
+)
+
+var (
+	log = golog.LoggerFor("resilience")
+)
+
+type ctxKey string
+
+const methodKey = ctxKey("method")
+
+// State is the state of a circuit.
+type State string
+
+const (
+	// Closed circuits let dials through.
+	Closed State = "closed"
+	// Open circuits fail dials immediately.
+	Open State = "open"
+	// HalfOpen circuits let a limited number of probing dials through, closing
+	// if one succeeds and opening again if one fails.
+	HalfOpen State = "half-open"
+)
+
+// Opts configures Breakers.
+type Opts struct {
+	// Retries is how many times a failed dial is retried. Defaults to 0.
+	Retries int
+
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles with each retry, with jitter. Defaults to 100ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between retries. Defaults to 2 seconds.
+	MaxBackoff time.Duration
+
+	// FailureThreshold is how many consecutive failed dials open the circuit
+	// to a destination. Defaults to 5.
+	FailureThreshold int
+
+	// OpenTimeout is how long a circuit stays open before probing the
+	// destination again. Defaults to 30 seconds.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is how many dials may probe a half-open circuit at the
+	// same time. Defaults to 1.
+	HalfOpenProbes int
+}
+
+// CircuitOpenError is returned when dialing a destination whose circuit is
+// open.
+type CircuitOpenError struct {
+	Destination string
+	// RetryAfter is how long until the destination will be probed again.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit to %v is open, retry in %v", e.Destination, e.RetryAfter)
+}
+
+// AsCircuitOpen returns the CircuitOpenError that caused err, if any.
+func AsCircuitOpen(err error) (*CircuitOpenError, bool) {
+	if rc, ok := err.(interface{ RootCause() error }); ok {
+		err = rc.RootCause()
+	}
+	var openErr *CircuitOpenError
+	if errors.As(err, &openErr) {
+		return openErr, true
+	}
+	return nil, false
+}
+
+// CircuitStats describes the circuit to a destination.
+type CircuitStats struct {
+	Destination string    `json:"destination"`
+	State       State     `json:"state"`
+	Failures    int       `json:"failures"`
+	OpenedAt    time.Time `json:"opened_at,omitempty"`
+	Rejected    int64     `json:"rejected"`
+}
+
+// Stats describe the activity of Breakers.
+type Stats struct {
+	Retries  int64 `json:"retries"`
+	Rejected int64 `json:"rejected"`
+	// Circuits lists destinations that recently failed. Destinations are
+	// forgotten as soon as a dial to them succeeds, or once they haven't
+	// failed for OpenTimeout (twice that for open circuits, which are probed
+	// in between).
+	Circuits []CircuitStats `json:"circuits"`
+}
+
+type circuit struct {
+	state    State
+	failures int
+	failedAt time.Time
+	openedAt time.Time
+	probedAt time.Time
+	probes   int
+	rejected int64
+}
+
+// Breakers tracks a circuit per destination.
+type Breakers struct {
+	opts      *Opts
+	circuits  map[string]*circuit
+	now       func() time.Time
+	mx        sync.Mutex
+	expiredAt time.Time
+
+	retries  int64
+	rejected int64
+}
+
+// New constructs new Breakers.
+func New(opts *Opts) *Breakers {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultOpenTimeout
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = defaultHalfOpenProbes
+	}
+	return &Breakers{opts: opts, circuits: make(map[string]*circuit), now: time.Now}
+}
+
+// WithMethod records the method of the request being proxied with ctx, which
+// determines whether dials for it are retried.
+func WithMethod(ctx filters.Context, method string) filters.Context {
+	return ctx.WithValue(methodKey, method)
+}
+
+// retryable determines whether dials with ctx may be retried. That's the case
+// for idempotent requests and for CONNECT requests, which don't send anything
+// upstream until the tunnel is established.
+func retryable(ctx context.Context, isCONNECT bool) bool {
+	if isCONNECT {
+		return true
+	}
+	switch ctx.Value(methodKey) {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Dial wraps dial with retries and circuit breaking by the dialed address.
+func (b *Breakers) Dial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		attempts := 1
+		if retryable(ctx, isCONNECT) {
+			attempts += b.opts.Retries
+		}
+		backoff := b.opts.InitialBackoff
+		var err error
+		for i := 0; i < attempts; i++ {
+			if i > 0 {
+				atomic.AddInt64(&b.retries, 1)
+				// Full jitter
+				wait := time.Duration(rand.Int63n(int64(backoff)) + 1)
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return nil, err
+				}
+				backoff *= 2
+				if backoff > b.opts.MaxBackoff {
+					backoff = b.opts.MaxBackoff
+				}
+			}
+			if openErr := b.allow(addr); openErr != nil {
+				if err == nil {
+					err = openErr
+				}
+				return nil, err
+			}
+			var conn net.Conn
+			conn, err = dial(ctx, isCONNECT, network, addr)
+			// Dials abandoned by the client say nothing about the destination
+			b.record(addr, err, ctx.Err() != nil)
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			log.Debugf("Dial %d of %d to %v failed: %v", i+1, attempts, addr, err)
+		}
+		return nil, err
+	}
+}
+
+// Check returns a *CircuitOpenError if the circuit to addr is open.
+func (b *Breakers) Check(addr string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	c := b.circuits[addr]
+	if c == nil || c.state != Open {
+		return nil
+	}
+	retryAfter := c.openedAt.Add(b.opts.OpenTimeout).Sub(b.now())
+	if retryAfter <= 0 {
+		return nil
+	}
+	c.rejected++
+	atomic.AddInt64(&b.rejected, 1)
+	return &CircuitOpenError{Destination: addr, RetryAfter: retryAfter}
+}
+
+// allow determines whether addr may be dialed, moving open circuits to
+// half-open once they've been open for long enough.
+func (b *Breakers) allow(addr string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	c := b.circuits[addr]
+	if c == nil || c.state == Closed {
+		return nil
+	}
+	now := b.now()
+	if c.state == Open {
+		retryAfter := c.openedAt.Add(b.opts.OpenTimeout).Sub(now)
+		if retryAfter > 0 {
+			c.rejected++
+			atomic.AddInt64(&b.rejected, 1)
+			return &CircuitOpenError{Destination: addr, RetryAfter: retryAfter}
+		}
+		log.Debugf("Probing %v", addr)
+		c.state = HalfOpen
+		c.probedAt = now
+		c.probes = 0
+	}
+	if c.probes >= b.opts.HalfOpenProbes {
+		c.rejected++
+		atomic.AddInt64(&b.rejected, 1)
+		// If the probes fail, the circuit opens again for OpenTimeout, so
+		// that's the earliest the destination will be probed again
+		retryAfter := c.probedAt.Add(b.opts.OpenTimeout).Sub(now)
+		if retryAfter <= 0 {
+			retryAfter = b.opts.OpenTimeout
+		}
+		return &CircuitOpenError{Destination: addr, RetryAfter: retryAfter}
+	}
+	c.probes++
+	return nil
+}
+
+// record records the result of a dial to addr. Abandoned dials only release
+// their half-open probe.
+func (b *Breakers) record(addr string, err error, abandoned bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	c := b.circuits[addr]
+	if abandoned {
+		if c != nil && c.state == HalfOpen && c.probes > 0 {
+			c.probes--
+		}
+		return
+	}
+	if err == nil {
+		if c != nil && c.state != Closed {
+			log.Debugf("Circuit to %v closed", addr)
+		}
+		delete(b.circuits, addr)
+		return
+	}
+	now := b.now()
+	if c == nil {
+		b.expire(now)
+		c = &circuit{state: Closed}
+		b.circuits[addr] = c
+	}
+	c.failures++
+	c.failedAt = now
+	if c.state == HalfOpen || (c.state == Closed && c.failures >= b.opts.FailureThreshold) {
+		log.Errorf("Circuit to %v opened after %d failures: %v", addr, c.failures, err)
+		c.state = Open
+		c.openedAt = now
+		c.probes = 0
+	}
+}
+
+// expire forgets destinations that haven't failed in a while, at most once
+// every OpenTimeout. Must be called with mx held.
+func (b *Breakers) expire(now time.Time) {
+	if now.Sub(b.expiredAt) < b.opts.OpenTimeout {
+		return
+	}
+	b.expiredAt = now
+	for addr, c := range b.circuits {
+		quiet := now.Sub(c.failedAt)
+		switch {
+		case c.state == Closed && quiet >= b.opts.OpenTimeout,
+			c.state == Open && quiet >= 2*b.opts.OpenTimeout:
+			delete(b.circuits, addr)
+		}
+	}
+}
+
+// Stats returns the current stats.
+func (b *Breakers) Stats() Stats {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	stats := Stats{
+		Retries:  atomic.LoadInt64(&b.retries),
+		Rejected: atomic.LoadInt64(&b.rejected),
+		Circuits: make([]CircuitStats, 0, len(b.circuits)),
+	}
+	for addr, c := range b.circuits {
+		stats.Circuits = append(stats.Circuits, CircuitStats{
+			Destination: addr,
+			State:       c.state,
+			Failures:    c.failures,
+			OpenedAt:    c.openedAt,
+			Rejected:    c.rejected,
+		})
+	}
+	sort.Slice(stats.Circuits, func(i, j int) bool { return stats.Circuits[i].Destination < stats.Circuits[j].Destination })
+	return stats
+}
@@ -0,0 +1,180 @@
+package resilience
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+var errRefused = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+func TestRetries(t *testing.T) {
+	b := New(&Opts{Retries: 2, InitialBackoff: time.Millisecond, FailureThreshold: 100})
+	var attempts int64
+	dial := b.Dial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if atomic.AddInt64(&attempts, 1)%3 != 0 {
+			return nil, errRefused
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+
+	ctx := WithMethod(filters.BackgroundContext(), "GET")
+	conn, err := dial(ctx, false, "tcp", "origin:80")
+	if assert.NoError(t, err, "third attempt should succeed") {
+		conn.Close()
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt64(&attempts))
+	assert.EqualValues(t, 2, b.Stats().Retries)
+	assert.Empty(t, b.Stats().Circuits, "success should forget earlier failures")
+
+	// Non-idempotent requests aren't retried
+	atomic.StoreInt64(&attempts, 0)
+	_, err = dial(WithMethod(filters.BackgroundContext(), "POST"), false, "tcp", "origin:80")
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&attempts))
+
+	// CONNECT is
+	atomic.StoreInt64(&attempts, 0)
+	conn, err = dial(filters.BackgroundContext(), true, "tcp", "origin:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt64(&attempts))
+}
+
+func TestCircuit(t *testing.T) {
+	b := New(&Opts{FailureThreshold: 2, OpenTimeout: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	var attempts int64
+	failing := int32(1)
+	dial := b.Dial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&attempts, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, errRefused
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	ctx := filters.BackgroundContext()
+
+	for i := 0; i < 2; i++ {
+		_, err := dial(ctx, true, "tcp", "origin:443")
+		_, open := AsCircuitOpen(err)
+		assert.False(t, open)
+	}
+	assert.NoError(t, b.Check("other:443"))
+
+	// Open circuits fail fast
+	_, err := dial(ctx, true, "tcp", "origin:443")
+	openErr, open := AsCircuitOpen(errors.New("Unable to dial: %v", err))
+	if assert.True(t, open) {
+		assert.Equal(t, "origin:443", openErr.Destination)
+		assert.Equal(t, time.Minute, openErr.RetryAfter)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt64(&attempts))
+	assert.Error(t, b.Check("origin:443"))
+	stats := b.Stats()
+	if assert.Len(t, stats.Circuits, 1) {
+		assert.Equal(t, Open, stats.Circuits[0].State)
+		assert.Equal(t, 2, stats.Circuits[0].Failures)
+		assert.EqualValues(t, 2, stats.Circuits[0].Rejected)
+	}
+
+	// A failed probe opens the circuit again
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Check("origin:443"))
+	_, err = dial(ctx, true, "tcp", "origin:443")
+	_, open = AsCircuitOpen(err)
+	assert.False(t, open, "dial should have probed the destination")
+	assert.EqualValues(t, 3, atomic.LoadInt64(&attempts))
+	assert.Error(t, b.Check("origin:443"))
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	atomic.StoreInt32(&failing, 0)
+	conn, err := dial(ctx, true, "tcp", "origin:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Empty(t, b.Stats().Circuits)
+
+	// Destinations that stop failing are forgotten, open ones only after they
+	// could have been probed for a while
+	atomic.StoreInt32(&failing, 1)
+	destinations := func() []string {
+		var result []string
+		for _, c := range b.Stats().Circuits {
+			result = append(result, c.Destination)
+		}
+		return result
+	}
+	dial(ctx, true, "tcp", "quiet:443")
+	dial(ctx, true, "tcp", "dead:443")
+	dial(ctx, true, "tcp", "dead:443")
+	now = now.Add(time.Minute)
+	dial(ctx, true, "tcp", "new:443")
+	assert.Equal(t, []string{"dead:443", "new:443"}, destinations())
+	now = now.Add(time.Minute)
+	dial(ctx, true, "tcp", "newer:443")
+	assert.Equal(t, []string{"newer:443"}, destinations())
+}
+
+func TestHalfOpenProbes(t *testing.T) {
+	b := New(&Opts{FailureThreshold: 1, OpenTimeout: time.Minute})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	probing := make(chan struct{}, 1)
+	release := make(chan struct{}, 1)
+	dial := b.Dial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		probing <- struct{}{}
+		select {
+		case <-release:
+			return nil, errRefused
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	})
+
+	release <- struct{}{}
+	dial(context.Background(), true, "tcp", "origin:443")
+	<-probing
+	now = now.Add(time.Minute)
+
+	// The probe is abandoned by the client
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dial(ctx, true, "tcp", "origin:443")
+		close(done)
+	}()
+	<-probing
+	_, err := dial(context.Background(), true, "tcp", "origin:443")
+	openErr, open := AsCircuitOpen(err)
+	if assert.True(t, open, "only one probe should be allowed at a time") {
+		assert.Equal(t, time.Minute, openErr.RetryAfter, "should retry once a failed probe would allow probing again")
+	}
+	cancel()
+	<-done
+	stats := b.Stats()
+	if assert.Len(t, stats.Circuits, 1) {
+		assert.Equal(t, HalfOpen, stats.Circuits[0].State, "abandoned probe should neither open nor close the circuit")
+	}
+
+	// The next probe may go ahead
+	go func() {
+		<-probing
+		release <- struct{}{}
+	}()
+	_, err = dial(context.Background(), true, "tcp", "origin:443")
+	_, open = AsCircuitOpen(err)
+	assert.False(t, open)
+	assert.Equal(t, Open, b.Stats().Circuits[0].State)
+}
@@ -0,0 +1,336 @@
+// Package resolver resolves host names for the proxy's filters and dialer. It
+// caches answers honoring their TTLs, caches failed lookups for a while,
+// supports static overrides and can query upstream DNS servers over UDP, TCP,
+// DNS-over-TLS and DNS-over-HTTPS instead of using the system resolver.
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultCacheSize   = 10000
+	defaultTimeout     = 5 * time.Second
+	defaultMaxTTL      = 1 * time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	defaultSystemTTL   = 1 * time.Minute
+)
+
+var (
+	log = golog.LoggerFor("resolver")
+
+	defaultResolver atomic.Value
+	defaultOnce     sync.Once
+)
+
+// Opts configures a Resolver.
+type Opts struct {
+	// Servers are the upstream DNS servers to query, in order of preference.
+	// Supported forms are "host:port" or "udp://host:port" for UDP (retrying
+	// truncated answers over TCP), "tcp://host:port", "tls://host:port" for
+	// DNS-over-TLS and "https://host/path" for DNS-over-HTTPS. Ports default
+	// to 53, or 853 for DNS-over-TLS. If empty, the system resolver is used.
+	Servers []string
+
+	// Hosts statically maps host names to IP addresses, taking precedence over
+	// DNS.
+	Hosts map[string][]string
+
+	// TLSConfig is used for DNS-over-TLS and DNS-over-HTTPS. The server name
+	// defaults to the server's host.
+	TLSConfig *tls.Config
+
+	// Timeout limits how long a single lookup may take. Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// CacheSize is the maximum number of cached host names. Defaults to
+	// 10000.
+	CacheSize int
+
+	// MinTTL and MaxTTL bound how long answers are cached, irrespective of
+	// their TTL. MaxTTL defaults to 1 hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long failed lookups are cached. Defaults to 30
+	// seconds.
+	NegativeTTL time.Duration
+
+	// SystemTTL is how long answers from the system resolver, which doesn't
+	// report TTLs, are cached. Defaults to 1 minute.
+	SystemTTL time.Duration
+}
+
+// Stats are counters describing the resolver's activity.
+type Stats struct {
+	Lookups         int64 `json:"lookups"`
+	CacheHits       int64 `json:"cache_hits"`
+	NegativeHits    int64 `json:"negative_hits"`
+	StaticHits      int64 `json:"static_hits"`
+	UpstreamQueries int64 `json:"upstream_queries"`
+	UpstreamErrors  int64 `json:"upstream_errors"`
+	// UpstreamLatency is the average time taken by upstream lookups.
+	UpstreamLatency time.Duration `json:"upstream_latency"`
+}
+
+// HitRate is the fraction of lookups answered without querying upstream.
+func (s Stats) HitRate() float64 {
+	if s.Lookups == 0 {
+		return 0
+	}
+	return float64(s.CacheHits+s.NegativeHits+s.StaticHits) / float64(s.Lookups)
+}
+
+type entry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type call struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// Resolver resolves host names to IP addresses.
+type Resolver struct {
+	opts      *Opts
+	upstreams []upstream
+	hosts     map[string][]net.IP
+	cache     *lru.Cache
+	now       func() time.Time
+
+	inflight   map[string]*call
+	inflightMx sync.Mutex
+
+	lookups         int64
+	cacheHits       int64
+	negativeHits    int64
+	staticHits      int64
+	upstreamQueries int64
+	upstreamErrors  int64
+	upstreamNanos   int64
+}
+
+// New constructs a new Resolver.
+func New(opts *Opts) (*Resolver, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = defaultMaxTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if opts.SystemTTL <= 0 {
+		opts.SystemTTL = defaultSystemTTL
+	}
+	cache, err := lru.New(opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{
+		opts:     opts,
+		hosts:    make(map[string][]net.IP, len(opts.Hosts)),
+		cache:    cache,
+		now:      time.Now,
+		inflight: make(map[string]*call),
+	}
+	for host, addrs := range opts.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address %v for host %v", addr, host)
+			}
+			r.hosts[normalize(host)] = append(r.hosts[normalize(host)], ip)
+		}
+	}
+	for _, server := range opts.Servers {
+		u, err := newUpstream(server, opts.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// Default returns the resolver used by the proxy's filters and default dialer.
+// Unless changed with SetDefault, it's a caching resolver that uses the system
+// resolver.
+func Default() *Resolver {
+	defaultOnce.Do(func() {
+		if defaultResolver.Load() == nil {
+			r, _ := New(&Opts{})
+			defaultResolver.Store(r)
+		}
+	})
+	return defaultResolver.Load().(*Resolver)
+}
+
+// SetDefault changes the resolver returned by Default.
+func SetDefault(r *Resolver) {
+	defaultOnce.Do(func() {})
+	defaultResolver.Store(r)
+}
+
+// LookupIP resolves host to its IPv4 and IPv6 addresses, IPv4 addresses
+// first. IP addresses resolve to themselves. If the host doesn't exist, the
+// error is a *net.DNSError with IsNotFound set. The returned slice belongs to
+// the caller.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, err := r.lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	// Don't let callers reorder or append to cached addresses
+	return append([]net.IP(nil), ips...), nil
+}
+
+func (r *Resolver) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = normalize(host)
+	atomic.AddInt64(&r.lookups, 1)
+	if ips, found := r.hosts[host]; found {
+		atomic.AddInt64(&r.staticHits, 1)
+		return ips, nil
+	}
+	if cached, found := r.cache.Get(host); found {
+		e := cached.(*entry)
+		if r.now().Before(e.expires) {
+			if e.err != nil {
+				atomic.AddInt64(&r.negativeHits, 1)
+				return nil, e.err
+			}
+			atomic.AddInt64(&r.cacheHits, 1)
+			return e.ips, nil
+		}
+	}
+
+	// Coalesce concurrent lookups of the same host
+	r.inflightMx.Lock()
+	c, found := r.inflight[host]
+	if !found {
+		c = &call{done: make(chan struct{})}
+		r.inflight[host] = c
+		go r.resolve(host, c)
+	}
+	r.inflightMx.Unlock()
+
+	select {
+	case <-c.done:
+		return c.ips, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *Resolver) resolve(host string, c *call) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+	start := time.Now()
+	atomic.AddInt64(&r.upstreamQueries, 1)
+	var ttl time.Duration
+	if len(r.upstreams) == 0 {
+		c.ips, ttl, c.err = r.resolveSystem(ctx, host)
+	} else {
+		c.ips, ttl, c.err = r.resolveUpstream(ctx, host)
+	}
+	atomic.AddInt64(&r.upstreamNanos, int64(time.Since(start)))
+
+	if c.err == nil || isNotFound(c.err) {
+		if c.err != nil {
+			ttl = r.opts.NegativeTTL
+		} else if ttl < r.opts.MinTTL {
+			ttl = r.opts.MinTTL
+		} else if ttl > r.opts.MaxTTL {
+			ttl = r.opts.MaxTTL
+		}
+		r.cache.Add(host, &entry{ips: c.ips, err: c.err, expires: r.now().Add(ttl)})
+	} else {
+		atomic.AddInt64(&r.upstreamErrors, 1)
+	}
+
+	r.inflightMx.Lock()
+	delete(r.inflight, host)
+	r.inflightMx.Unlock()
+	close(c.done)
+}
+
+func (r *Resolver) resolveSystem(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, r.opts.SystemTTL, nil
+}
+
+func (r *Resolver) resolveUpstream(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, u := range r.upstreams {
+		ips, ttl, err := lookup(ctx, u, host)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		log.Debugf("Unable to resolve %v using %v: %v", host, u, err)
+		lastErr = err
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host}
+}
+
+// Stats returns the resolver's stats so far.
+func (r *Resolver) Stats() Stats {
+	s := Stats{
+		Lookups:         atomic.LoadInt64(&r.lookups),
+		CacheHits:       atomic.LoadInt64(&r.cacheHits),
+		NegativeHits:    atomic.LoadInt64(&r.negativeHits),
+		StaticHits:      atomic.LoadInt64(&r.staticHits),
+		UpstreamQueries: atomic.LoadInt64(&r.upstreamQueries),
+		UpstreamErrors:  atomic.LoadInt64(&r.upstreamErrors),
+	}
+	if s.UpstreamQueries > 0 {
+		s.UpstreamLatency = time.Duration(atomic.LoadInt64(&r.upstreamNanos) / s.UpstreamQueries)
+	}
+	return s
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
@@ -0,0 +1,395 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDP(t *testing.T) {
+	ds := startDNSServer(t)
+	defer ds.Close()
+	r, err := New(&Opts{Servers: []string{ds.udpAddr}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ips, err := r.LookupIP(context.Background(), "www.example.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, strs(ips))
+	}
+	assert.EqualValues(t, 2, ds.queries(), "should have queried A and AAAA")
+
+	ips[0] = net.ParseIP("192.0.2.1")
+	ips, err = r.LookupIP(context.Background(), "WWW.example.test.")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, strs(ips), "changing results shouldn't change the cache")
+	}
+	assert.EqualValues(t, 2, ds.queries(), "second lookup should be cached")
+
+	// The smallest TTL of 60 seconds applies
+	now = now.Add(61 * time.Second)
+	_, err = r.LookupIP(context.Background(), "www.example.test")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 4, ds.queries(), "expired entry should be looked up again")
+
+	// CNAMEs are followed by the server
+	ips, err = r.LookupIP(context.Background(), "alias.example.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, strs(ips))
+	}
+
+	// Truncated answers are retried over TCP
+	ips, err = r.LookupIP(context.Background(), "big.example.test")
+	if assert.NoError(t, err) {
+		assert.Len(t, ips, 100)
+	}
+	assert.True(t, atomic.LoadInt64(&ds.tcpQueries) > 0)
+}
+
+func TestNegativeCaching(t *testing.T) {
+	ds := startDNSServer(t)
+	defer ds.Close()
+	r, err := New(&Opts{Servers: []string{ds.udpAddr}, NegativeTTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for _, host := range []string{"missing.example.test", "v6only.example.test"} {
+		_, err = r.LookupIP(context.Background(), host)
+		if assert.Error(t, err) {
+			dnsErr, ok := err.(*net.DNSError)
+			if assert.True(t, ok, host) {
+				assert.True(t, dnsErr.IsNotFound, host)
+			}
+		}
+	}
+	queries := ds.queries()
+	_, err = r.LookupIP(context.Background(), "missing.example.test")
+	assert.Error(t, err)
+	assert.Equal(t, queries, ds.queries(), "failure should be cached")
+
+	now = now.Add(2 * time.Minute)
+	_, err = r.LookupIP(context.Background(), "missing.example.test")
+	assert.Error(t, err)
+	assert.True(t, ds.queries() > queries, "failure should have expired")
+
+	// Server failures aren't cached
+	_, err = r.LookupIP(context.Background(), "fail.example.test")
+	assert.Error(t, err)
+	queries = ds.queries()
+	_, err = r.LookupIP(context.Background(), "fail.example.test")
+	assert.Error(t, err)
+	assert.True(t, ds.queries() > queries)
+
+	stats := r.Stats()
+	assert.EqualValues(t, 6, stats.Lookups)
+	assert.EqualValues(t, 1, stats.NegativeHits)
+	assert.EqualValues(t, 2, stats.UpstreamErrors)
+	assert.True(t, stats.UpstreamLatency > 0)
+	assert.InDelta(t, 1.0/6.0, stats.HitRate(), 0.001)
+}
+
+func TestStaticHostsAndFailover(t *testing.T) {
+	ds := startDNSServer(t)
+	defer ds.Close()
+
+	// Grab a port that nobody is listening on
+	l, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	dead := l.LocalAddr().String()
+	l.Close()
+
+	r, err := New(&Opts{
+		Servers: []string{"tcp://" + dead, ds.udpAddr},
+		Hosts:   map[string][]string{"Static.Test": {"192.168.1.1", "fd00::2"}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ips, err := r.LookupIP(context.Background(), "static.test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"192.168.1.1", "fd00::2"}, strs(ips))
+	}
+	assert.EqualValues(t, 0, ds.queries())
+
+	ips, err = r.LookupIP(context.Background(), "www.example.test")
+	if assert.NoError(t, err) {
+		assert.Len(t, ips, 3)
+	}
+
+	ips, err = r.LookupIP(context.Background(), "127.0.0.1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"127.0.0.1"}, strs(ips))
+	}
+
+	stats := r.Stats()
+	assert.EqualValues(t, 2, stats.Lookups)
+	assert.EqualValues(t, 1, stats.StaticHits)
+
+	_, err = New(&Opts{Hosts: map[string][]string{"bad": {"not an ip"}}})
+	assert.Error(t, err)
+	_, err = New(&Opts{Servers: []string{"quic://1.1.1.1"}})
+	assert.Error(t, err)
+}
+
+func TestEncrypted(t *testing.T) {
+	ds := startDNSServer(t)
+	defer ds.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ds.https.Certificate())
+
+	for _, server := range []string{"tls://" + ds.tlsAddr, ds.https.URL + "/dns-query"} {
+		r, err := New(&Opts{Servers: []string{server}, TLSConfig: &tls.Config{RootCAs: pool}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		ips, err := r.LookupIP(context.Background(), "www.example.test")
+		if assert.NoError(t, err, server) {
+			assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "fd00::1"}, strs(ips))
+		}
+		_, err = r.LookupIP(context.Background(), "missing.example.test")
+		if assert.Error(t, err) {
+			assert.True(t, isNotFound(err), server)
+		}
+	}
+	assert.True(t, atomic.LoadInt64(&ds.tlsQueries) > 0)
+	assert.True(t, atomic.LoadInt64(&ds.httpsQueries) > 0)
+}
+
+func TestCoalescing(t *testing.T) {
+	ds := startDNSServer(t)
+	defer ds.Close()
+	atomic.StoreInt64(&ds.delay, int64(100*time.Millisecond))
+	r, err := New(&Opts{Servers: []string{ds.udpAddr}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.LookupIP(context.Background(), "www.example.test")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 2, ds.queries())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = r.LookupIP(ctx, "slow.example.test")
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func strs(ips []net.IP) []string {
+	result := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, ip.String())
+	}
+	return result
+}
+
+// dnsServer is a stand-in DNS server for the zone example.test that listens
+// over UDP, TCP, TLS and HTTPS.
+type dnsServer struct {
+	udp   net.PacketConn
+	tcp   net.Listener
+	tls   net.Listener
+	https *httptest.Server
+	delay int64
+
+	udpAddr string
+	tlsAddr string
+
+	udpQueries   int64
+	tcpQueries   int64
+	tlsQueries   int64
+	httpsQueries int64
+}
+
+func startDNSServer(t *testing.T) *dnsServer {
+	ds := &dnsServer{}
+	var err error
+	// TCP listens on the same port, for truncated responses. That port may be
+	// taken for TCP, so try a few.
+	for i := 0; i < 10; i++ {
+		ds.udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.udpAddr = ds.udp.LocalAddr().String()
+		ds.tcp, err = net.Listen("tcp", ds.udpAddr)
+		if err == nil {
+			break
+		}
+		ds.udp.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.https = httptest.NewTLSServer(http.HandlerFunc(ds.serveHTTPS))
+	ds.tls, err = tls.Listen("tcp", "127.0.0.1:0", ds.https.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.tlsAddr = ds.tls.Addr().String()
+
+	go ds.serveUDP()
+	go ds.serveStream(ds.tcp, &ds.tcpQueries)
+	go ds.serveStream(ds.tls, &ds.tlsQueries)
+	return ds
+}
+
+func (ds *dnsServer) queries() int64 {
+	return atomic.LoadInt64(&ds.udpQueries) + atomic.LoadInt64(&ds.tcpQueries) +
+		atomic.LoadInt64(&ds.tlsQueries) + atomic.LoadInt64(&ds.httpsQueries)
+}
+
+func (ds *dnsServer) Close() {
+	ds.udp.Close()
+	ds.tcp.Close()
+	ds.tls.Close()
+	ds.https.Close()
+}
+
+func (ds *dnsServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := ds.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&ds.udpQueries, 1)
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := ds.answer(query, maxUDPSize); resp != nil {
+				ds.udp.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (ds *dnsServer) serveStream(l net.Listener, count *int64) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				atomic.AddInt64(count, 1)
+				resp := ds.answer(query, 65535)
+				if resp == nil {
+					return
+				}
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}
+		}()
+	}
+}
+
+func (ds *dnsServer) serveHTTPS(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query, _ := ioutil.ReadAll(req.Body)
+	atomic.AddInt64(&ds.httpsQueries, 1)
+	resp := ds.answer(query, 65535)
+	if resp == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	w.Write(resp)
+}
+
+func (ds *dnsServer) answer(query []byte, maxSize int) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	time.Sleep(time.Duration(atomic.LoadInt64(&ds.delay)))
+
+	rh := func(name string, qtype dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	h.Response = true
+	h.RecursionAvailable = true
+	var answers []dnsmessage.Resource
+	target := q.Name.String()
+	switch target {
+	case "alias.example.test.":
+		answers = append(answers, dnsmessage.Resource{
+			Header: rh(target, dnsmessage.TypeCNAME, 300),
+			Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("www.example.test.")},
+		})
+		target = "www.example.test."
+	case "fail.example.test.":
+		h.RCode = dnsmessage.RCodeServerFailure
+	}
+	switch {
+	case target == "www.example.test." && q.Type == dnsmessage.TypeA:
+		answers = append(answers,
+			dnsmessage.Resource{Header: rh(target, q.Type, 300), Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}},
+			dnsmessage.Resource{Header: rh(target, q.Type, 60), Body: &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}})
+	case target == "www.example.test." && q.Type == dnsmessage.TypeAAAA:
+		answers = append(answers,
+			dnsmessage.Resource{Header: rh(target, q.Type, 120), Body: &dnsmessage.AAAAResource{AAAA: [16]byte{0: 0xfd, 15: 1}}})
+	case target == "slow.example.test.":
+		time.Sleep(200 * time.Millisecond)
+	case target == "big.example.test." && q.Type == dnsmessage.TypeA:
+		for i := 0; i < 100; i++ {
+			answers = append(answers,
+				dnsmessage.Resource{Header: rh(target, q.Type, 300), Body: &dnsmessage.AResource{A: [4]byte{10, 1, 0, byte(i)}}})
+		}
+	case target == "missing.example.test.":
+		h.RCode = dnsmessage.RCodeNameError
+	}
+
+	msg := dnsmessage.Message{Header: h, Questions: []dnsmessage.Question{q}, Answers: answers}
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	if len(resp) > maxSize {
+		msg.Truncated = true
+		msg.Answers = nil
+		resp, _ = msg.Pack()
+	}
+	return resp
+}
@@ -0,0 +1,325 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// maxUDPSize is the UDP payload size advertised with EDNS(0), small
+	// enough to avoid fragmentation.
+	maxUDPSize = 1232
+
+	dnsMessageType = "application/dns-message"
+)
+
+// upstream exchanges a DNS query for a response with a DNS server.
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+
+	String() string
+}
+
+func newUpstream(server string, tlsConfig *tls.Config) (upstream, error) {
+	scheme := "udp"
+	addr := server
+	if idx := strings.Index(server, "://"); idx >= 0 {
+		scheme = server[:idx]
+		addr = server[idx+3:]
+	}
+	switch scheme {
+	case "udp":
+		return &udpUpstream{addr: withPort(addr, "53")}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withPort(addr, "53")}, nil
+	case "tls":
+		addr = withPort(addr, "853")
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		return &tcpUpstream{addr: addr, tlsConfig: cfg}, nil
+	case "https":
+		return &httpsUpstream{
+			url: server,
+			client: &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig:     tlsConfig,
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: 10,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		}, nil
+	default:
+		return nil, errors.New("Unsupported DNS server %v", server)
+	}
+}
+
+func withPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// udpUpstream queries a server over UDP, retrying over TCP if the response is
+// truncated.
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			// Not a response to our query, keep waiting
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			// Truncated
+			return (&tcpUpstream{addr: u.addr}).exchange(ctx, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+// tcpUpstream queries a server over TCP or, if tlsConfig is set, over TLS.
+type tcpUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (u *tcpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if u.tlsConfig != nil {
+		d := &tls.Dialer{Config: u.tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", u.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", u.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *tcpUpstream) String() string {
+	if u.tlsConfig != nil {
+		return "tls://" + u.addr
+	}
+	return "tcp://" + u.addr
+}
+
+// httpsUpstream queries a server using DNS-over-HTTPS (RFC 8484).
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Unexpected HTTP status %v", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+// lookup queries u for the A and AAAA records of host in parallel. The
+// returned TTL is the smallest TTL of the answers.
+func lookup(ctx context.Context, u upstream, host string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]chan result, len(types))
+	for i, qtype := range types {
+		results[i] = make(chan result, 1)
+		go func(qtype dnsmessage.Type, resultCh chan result) {
+			ips, ttl, err := query(ctx, u, host, qtype)
+			resultCh <- result{ips, ttl, err}
+		}(qtype, results[i])
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	var firstErr error
+	for _, resultCh := range results {
+		r := <-resultCh
+		if r.err != nil {
+			if firstErr == nil || isNotFound(firstErr) {
+				firstErr = r.err
+			}
+			continue
+		}
+		if len(r.ips) > 0 && (len(ips) == 0 || r.ttl < ttl) {
+			ttl = r.ttl
+		}
+		ips = append(ips, r.ips...)
+	}
+	if len(ips) > 0 {
+		// One family is enough
+		return ips, time.Duration(ttl) * time.Second, nil
+	}
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	return nil, 0, notFound(host)
+}
+
+func query(ctx context.Context, u upstream, host string, qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(0)
+	if _, isHTTPS := u.(*httpsUpstream); !isHTTPS {
+		// RFC 8484 recommends an ID of 0 for cache friendliness
+		id = uint16(rand.Uint32())
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET})
+	b.StartAdditionals()
+	var opt dnsmessage.ResourceHeader
+	opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false)
+	b.OPTResource(opt, dnsmessage.OPTResource{})
+	q, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := u.exchange(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.ID != id || !h.Response {
+		return nil, 0, errors.New("Mismatched DNS response")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFound(host)
+	default:
+		return nil, 0, errors.New("DNS server responded %v", h.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	// Collect the answers of the requested type, which includes those at the
+	// end of CNAME chains
+	var ips []net.IP
+	var ttl uint32
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if rh.Type != qtype {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if len(ips) == 0 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+		switch qtype {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(a.A[:]))
+		case dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			ips = append(ips, net.IP(aaaa.AAAA[:]))
+		}
+	}
+	return ips, ttl, nil
+}
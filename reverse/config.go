@@ -0,0 +1,59 @@
+package reverse
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// Load loads the routes and pools of a Router from a JSON file, like:
+//
+//	{
+//	  "routes": [{"host": "*.example.com", "path_prefix": "/api/", "pool": "api"}],
+//	  "pools": [{
+//	    "name": "api",
+//	    "backends": ["http://10.0.0.1:8080", "http://10.0.0.2:8080"],
+//	    "balancing": "least-connections",
+//	    "health_check": {"path": "/healthz", "interval": "5s"}
+//	  }]
+//	}
+func Load(file string) (*Opts, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Unable to read %v: %v", file, err)
+	}
+	opts := &Opts{}
+	if err := json.Unmarshal(b, opts); err != nil {
+		return nil, errors.New("Unable to parse %v: %v", file, err)
+	}
+	return opts, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, reading durations as strings
+// like "10s".
+func (hc *HealthCheck) UnmarshalJSON(b []byte) error {
+	type healthCheck HealthCheck
+	var raw struct {
+		*healthCheck
+		Interval string `json:"interval"`
+		Timeout  string `json:"timeout"`
+	}
+	raw.healthCheck = (*healthCheck)(hc)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	var err error
+	if raw.Interval != "" {
+		if hc.Interval, err = time.ParseDuration(raw.Interval); err != nil {
+			return errors.New("Invalid health check interval: %v", err)
+		}
+	}
+	if raw.Timeout != "" {
+		if hc.Timeout, err = time.ParseDuration(raw.Timeout); err != nil {
+			return errors.New("Invalid health check timeout: %v", err)
+		}
+	}
+	return nil
+}
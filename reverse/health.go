@@ -0,0 +1,81 @@
+package reverse
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkHealth checks the backends of p every interval until the router is
+// closed or stopped is closed.
+func (r *Router) checkHealth(p *pool, stopped <-chan struct{}) {
+	ticker := time.NewTicker(p.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				r.recordCheck(p, b, r.check(p.healthCheck, b))
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-r.closed:
+			return
+		case <-stopped:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check GETs the health check path of b, returning whether it passed.
+func (r *Router) check(hc *HealthCheck, b *backend) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.String()+hc.Path, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", "http-proxy-health-check")
+	resp, err := r.tr.RoundTrip(req)
+	if err != nil {
+		log.Debugf("Health check of %v failed: %v", b.url, err)
+		return false
+	}
+	// Drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		log.Debugf("Health check of %v failed with status %v", b.url, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// recordCheck takes b out of rotation or puts it back once enough
+// consecutive checks have failed or passed.
+func (r *Router) recordCheck(p *pool, b *backend, passed bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if passed {
+		b.fails = 0
+		b.successes++
+		if !b.healthy && b.successes >= p.healthCheck.HealthyThreshold {
+			b.healthy = true
+			log.Debugf("Backend %v of pool %v is healthy again", b.url, p.name)
+		}
+		return
+	}
+	b.successes = 0
+	b.fails++
+	if b.healthy && b.fails >= p.healthCheck.UnhealthyThreshold {
+		b.healthy = false
+		log.Errorf("Backend %v of pool %v is unhealthy after %d failed checks", b.url, p.name, b.fails)
+	}
+}
@@ -0,0 +1,202 @@
+package reverse
+
+import (
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// replicas is how many points each backend gets on the consistent hash ring,
+// which spreads keys evenly across backends.
+const replicas = 100
+
+type backend struct {
+	url *url.URL
+
+	active   int64
+	requests int64
+	failures int64
+
+	mx        sync.Mutex
+	healthy   bool
+	successes int
+	fails     int
+}
+
+func (b *backend) isHealthy() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.healthy
+}
+
+func (b *backend) begin() {
+	atomic.AddInt64(&b.active, 1)
+	atomic.AddInt64(&b.requests, 1)
+}
+
+func (b *backend) end(failed bool) {
+	atomic.AddInt64(&b.active, -1)
+	if failed {
+		atomic.AddInt64(&b.failures, 1)
+	}
+}
+
+func (b *backend) stats(pool string) BackendStats {
+	return BackendStats{
+		Pool:     pool,
+		URL:      b.url.String(),
+		Healthy:  b.isHealthy(),
+		Active:   atomic.LoadInt64(&b.active),
+		Requests: atomic.LoadInt64(&b.requests),
+		Failures: atomic.LoadInt64(&b.failures),
+	}
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+type pool struct {
+	name        string
+	backends    []*backend
+	balancing   Balancing
+	hashHeader  string
+	healthCheck *HealthCheck
+
+	next uint64
+	ring []ringPoint
+}
+
+func newPool(opts *PoolOpts) (*pool, error) {
+	if opts.Balancing == "" {
+		opts.Balancing = RoundRobin
+	}
+	switch opts.Balancing {
+	case RoundRobin, LeastConnections, ConsistentHash:
+	default:
+		return nil, errors.New("Unknown balancing %q for pool %q", opts.Balancing, opts.Name)
+	}
+	if len(opts.Backends) == 0 {
+		return nil, errors.New("Pool %q has no backends", opts.Name)
+	}
+	p := &pool{
+		name:       opts.Name,
+		balancing:  opts.Balancing,
+		hashHeader: opts.HashHeader,
+	}
+	for _, raw := range opts.Backends {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("Invalid backend %q in pool %q, expected an http or https URL", raw, opts.Name)
+		}
+		p.backends = append(p.backends, &backend{url: &url.URL{Scheme: u.Scheme, Host: u.Host}, healthy: true})
+	}
+	if hc := opts.HealthCheck; hc != nil {
+		if hc.Path == "" {
+			hc.Path = defaultHealthPath
+		}
+		if hc.Interval <= 0 {
+			hc.Interval = defaultHealthInterval
+		}
+		if hc.Timeout <= 0 {
+			hc.Timeout = defaultHealthTimeout
+		}
+		if hc.UnhealthyThreshold <= 0 {
+			hc.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+		if hc.HealthyThreshold <= 0 {
+			hc.HealthyThreshold = defaultHealthyThreshold
+		}
+		p.healthCheck = hc
+	}
+	if p.balancing == ConsistentHash {
+		for _, b := range p.backends {
+			for i := 0; i < replicas; i++ {
+				p.ring = append(p.ring, ringPoint{hashOf(b.url.Host + "#" + strconv.Itoa(i)), b})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return p, nil
+}
+
+// pick picks a healthy backend for req, or returns nil if there is none.
+func (p *pool) pick(req *http.Request, clientIP string) *backend {
+	switch p.balancing {
+	case LeastConnections:
+		var best *backend
+		var bestActive int64
+		for _, b := range p.backends {
+			if !b.isHealthy() {
+				continue
+			}
+			if active := atomic.LoadInt64(&b.active); best == nil || active < bestActive {
+				best, bestActive = b, active
+			}
+		}
+		return best
+	case ConsistentHash:
+		key := clientIP
+		if p.hashHeader != "" {
+			if value := req.Header.Get(p.hashHeader); value != "" {
+				key = value
+			}
+		}
+		h := hashOf(key)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+		// Keys of unhealthy backends move on to the next backend on the ring
+		for i := 0; i < len(p.ring); i++ {
+			if b := p.ring[(start+i)%len(p.ring)].backend; b.isHealthy() {
+				return b
+			}
+		}
+		return nil
+	default:
+		n := uint64(len(p.backends))
+		first := atomic.AddUint64(&p.next, 1) - 1
+		for i := uint64(0); i < n; i++ {
+			if b := p.backends[(first+i)%n]; b.isHealthy() {
+				return b
+			}
+		}
+		return nil
+	}
+}
+
+func hashOf(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// trackedBody ends a request to a backend once its response has been
+// consumed.
+type trackedBody struct {
+	io.ReadCloser
+	b        *backend
+	failed   bool
+	doneOnce sync.Once
+}
+
+func (t *trackedBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		t.failed = true
+	}
+	return n, err
+}
+
+func (t *trackedBody) Close() error {
+	t.doneOnce.Do(func() {
+		t.b.end(t.failed)
+	})
+	return t.ReadCloser.Close()
+}
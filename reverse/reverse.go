@@ -0,0 +1,408 @@
+// Package reverse turns the proxy into a reverse proxy for origin-form
+// requests, routing them by Host and path to pools of backends. Each pool
+// balances requests across its backends by round-robin, least connections or
+// consistent hashing, and takes backends that fail active health checks out
+// of rotation until they pass again.
+package reverse
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	defaultIdleTimeout        = 90 * time.Second
+	defaultHealthPath         = "/"
+	defaultHealthInterval     = 10 * time.Second
+	defaultHealthTimeout      = 2 * time.Second
+	defaultUnhealthyThreshold = 3
+	defaultHealthyThreshold   = 2
+
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("reverse")
+)
+
+// Balancing is how a pool picks the backend for a request.
+type Balancing string
+
+const (
+	// RoundRobin picks healthy backends in turn.
+	RoundRobin Balancing = "round-robin"
+	// LeastConnections picks the healthy backend with the fewest requests in
+	// flight.
+	LeastConnections Balancing = "least-connections"
+	// ConsistentHash picks backends by hashing the client IP, or the value of
+	// PoolOpts.HashHeader, so that clients stick to the same backend while
+	// it's healthy.
+	ConsistentHash Balancing = "consistent-hash"
+)
+
+// Route sends matching requests to a pool. A request matches if both Host
+// and PathPrefix match.
+type Route struct {
+	// Host matches the Host of requests, ignoring case and port. A leading
+	// "*." matches any subdomain, and an empty Host matches any host.
+	Host string `json:"host"`
+
+	// PathPrefix matches requests whose path starts with it. An empty
+	// PathPrefix matches any path.
+	PathPrefix string `json:"path_prefix"`
+
+	// Pool is the name of the pool to send requests to.
+	Pool string `json:"pool"`
+}
+
+// HealthCheck configures active health checks of a pool's backends, which
+// GET a path of each backend periodically and expect a 2xx or 3xx status.
+type HealthCheck struct {
+	// Path is the path to GET. Defaults to "/".
+	Path string `json:"path"`
+
+	// Interval is how often each backend is checked. Defaults to 10 seconds.
+	Interval time.Duration `json:"interval"`
+
+	// Timeout limits how long each check may take. Defaults to 2 seconds.
+	Timeout time.Duration `json:"timeout"`
+
+	// UnhealthyThreshold is how many consecutive failed checks take a backend
+	// out of rotation. Defaults to 3.
+	UnhealthyThreshold int `json:"unhealthy_threshold"`
+
+	// HealthyThreshold is how many consecutive passed checks put a backend
+	// back into rotation. Defaults to 2.
+	HealthyThreshold int `json:"healthy_threshold"`
+}
+
+// PoolOpts configures a pool of backends.
+type PoolOpts struct {
+	// Name identifies the pool in routes.
+	Name string `json:"name"`
+
+	// Backends are the base URLs of the backends, like http://10.0.0.1:8080
+	// or https://app.internal. Their paths are ignored.
+	Backends []string `json:"backends"`
+
+	// Balancing is how backends are picked. Defaults to RoundRobin.
+	Balancing Balancing `json:"balancing"`
+
+	// HashHeader, if specified, is the request header hashed by
+	// ConsistentHash instead of the client IP. Requests without it are hashed
+	// by client IP.
+	HashHeader string `json:"hash_header"`
+
+	// HealthCheck, if specified, enables active health checks. Without them,
+	// backends are always considered healthy.
+	HealthCheck *HealthCheck `json:"health_check"`
+}
+
+// Opts configures a Router.
+type Opts struct {
+	// Routes are matched against requests in order, the first match winning.
+	Routes []Route `json:"routes"`
+
+	// Pools are the pools that routes refer to.
+	Pools []*PoolOpts `json:"pools"`
+
+	// Dial dials backends. Defaults to a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-"`
+
+	// TLSConfig configures TLS connections to https backends.
+	TLSConfig *tls.Config `json:"-"`
+
+	// IdleTimeout is how long connections to backends may be idle before
+	// they're closed. Defaults to 90 seconds.
+	IdleTimeout time.Duration `json:"-"`
+
+	// TLSHandshakeTimeout limits how long TLS handshakes with https backends
+	// may take. Defaults to 10 seconds.
+	TLSHandshakeTimeout time.Duration `json:"-"`
+}
+
+// Error is returned by the router's filter for requests that it should
+// handle but can't send to a backend.
+type Error struct {
+	// Status is the HTTP status to answer the request with.
+	Status int
+	// Reason identifies the error, like "no_route".
+	Reason string
+	Host   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("unable to route request for %v: %v", e.Host, e.Reason)
+}
+
+// AsError returns the Error that caused err, if any.
+func AsError(err error) (*Error, bool) {
+	if rc, ok := err.(interface{ RootCause() error }); ok {
+		err = rc.RootCause()
+	}
+	routeErr, ok := err.(*Error)
+	return routeErr, ok
+}
+
+// BackendStats describe a backend.
+type BackendStats struct {
+	Pool    string `json:"pool"`
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	// Active is the number of requests in flight.
+	Active   int64 `json:"active"`
+	Requests int64 `json:"requests"`
+	// Failures counts requests that couldn't be sent to the backend or whose
+	// response couldn't be read.
+	Failures int64 `json:"failures"`
+}
+
+// Router routes origin-form requests to pools of backends.
+type Router struct {
+	tr        *http.Transport
+	mx        sync.RWMutex
+	table     *table
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// table holds the routes and pools of a Router, which are replaced as a
+// whole by Update.
+type table struct {
+	routes    []Route
+	pools     map[string]*pool
+	poolOrder []*pool
+	// stopped is closed to stop health checking the pools
+	stopped chan struct{}
+}
+
+// New constructs a new Router and starts health checking its pools.
+func New(opts *Opts) (*Router, error) {
+	if opts.Dial == nil {
+		opts.Dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	if opts.TLSHandshakeTimeout <= 0 {
+		opts.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	t, err := newTable(opts)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{
+		tr: &http.Transport{
+			DialContext:         opts.Dial,
+			TLSClientConfig:     opts.TLSConfig,
+			IdleConnTimeout:     opts.IdleTimeout,
+			TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+			// Pass content through as is
+			DisableCompression: true,
+		},
+		table:  t,
+		closed: make(chan struct{}),
+	}
+	r.startHealthChecks(t)
+	return r, nil
+}
+
+// Update replaces the routes and pools of the router with those of opts,
+// keeping its other options. Requests in flight finish on the backends they
+// were sent to, and the stats of the old pools are discarded.
+func (r *Router) Update(opts *Opts) error {
+	t, err := newTable(opts)
+	if err != nil {
+		return err
+	}
+	r.mx.Lock()
+	old := r.table
+	r.table = t
+	r.mx.Unlock()
+	close(old.stopped)
+	r.startHealthChecks(t)
+	return nil
+}
+
+func newTable(opts *Opts) (*table, error) {
+	t := &table{
+		routes:  opts.Routes,
+		pools:   make(map[string]*pool, len(opts.Pools)),
+		stopped: make(chan struct{}),
+	}
+	for _, poolOpts := range opts.Pools {
+		if _, found := t.pools[poolOpts.Name]; found {
+			return nil, errors.New("Duplicate pool %q", poolOpts.Name)
+		}
+		p, err := newPool(poolOpts)
+		if err != nil {
+			return nil, err
+		}
+		t.pools[poolOpts.Name] = p
+		t.poolOrder = append(t.poolOrder, p)
+	}
+	for _, route := range opts.Routes {
+		if _, found := t.pools[route.Pool]; !found {
+			return nil, errors.New("Route for %q%v refers to unknown pool %q", route.Host, route.PathPrefix, route.Pool)
+		}
+	}
+	return t, nil
+}
+
+func (r *Router) startHealthChecks(t *table) {
+	for _, p := range t.poolOrder {
+		if p.healthCheck != nil {
+			go r.checkHealth(p, t.stopped)
+		}
+	}
+}
+
+func (r *Router) currentTable() *table {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.table
+}
+
+// Filter returns a filter that sends origin-form requests to the backends
+// of the first matching route. It needs to come after any filters that
+// should apply to them. Requests that match no route, or whose pool has no
+// healthy backend, fail with an Error. CONNECT requests, requests in
+// absolute form and upgrade requests are passed on to the next filter.
+func (r *Router) Filter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.Method == http.MethodConnect || req.URL.Host != "" || utils.IsUpgrade(req) {
+			return next(ctx, req)
+		}
+		t := r.currentTable()
+		route, ok := t.route(req)
+		if !ok {
+			return nil, ctx, &Error{Status: http.StatusNotFound, Reason: "no_route", Host: req.Host}
+		}
+		p := t.pools[route.Pool]
+		downstream := ctx.DownstreamConn()
+		clientIP := proxyfilters.ClientIP(ctx, req)
+		b := p.pick(req, clientIP)
+		if b == nil {
+			return nil, ctx, &Error{Status: http.StatusServiceUnavailable, Reason: "no_healthy_backend", Host: req.Host}
+		}
+		resp, err := r.roundTrip(b, prepareRequest(req.WithContext(ctx), b.url, clientIP, downstream != nil && isTLS(downstream)))
+		if err != nil {
+			return nil, ctx, errors.New("Unable to round-trip request to backend %v: %v", b.url.Host, err)
+		}
+		return resp, ctx, nil
+	})
+}
+
+// Matches determines whether req is an origin-form request that matches one
+// of the routes.
+func (r *Router) Matches(req *http.Request) bool {
+	if req.Method == http.MethodConnect || req.URL.Host != "" {
+		return false
+	}
+	_, ok := r.currentTable().route(req)
+	return ok
+}
+
+// route returns the first route matching req.
+func (t *table) route(req *http.Request) (Route, bool) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, route := range t.routes {
+		if matchHost(strings.ToLower(route.Host), host) && strings.HasPrefix(req.URL.Path, route.PathPrefix) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+func matchHost(pattern, host string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return host == pattern
+	}
+}
+
+// roundTrip sends req to b, keeping count of it until its response body is
+// closed.
+func (r *Router) roundTrip(b *backend, req *http.Request) (*http.Response, error) {
+	b.begin()
+	resp, err := r.tr.RoundTrip(req)
+	if err != nil {
+		b.end(true)
+		return nil, err
+	}
+	resp.Body = &trackedBody{ReadCloser: resp.Body, b: b}
+	return resp, nil
+}
+
+// Stats returns the stats of all backends, by pool in the order configured.
+func (r *Router) Stats() []BackendStats {
+	var stats []BackendStats
+	for _, p := range r.currentTable().poolOrder {
+		for _, b := range p.backends {
+			stats = append(stats, b.stats(p.name))
+		}
+	}
+	return stats
+}
+
+// Close stops health checks and closes idle connections to backends.
+func (r *Router) Close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.tr.CloseIdleConnections()
+	})
+}
+
+// prepareRequest prepares a request received from a client to be sent to the
+// backend at target, keeping its Host and telling the backend where it came
+// from in X-Forwarded headers. Forwarding headers from clients can't be
+// trusted at the edge, so X-Forwarded-For only holds the client IP, which is
+// determined by proxyfilters.Forwarded from the headers of trusted proxies if
+// it's in use.
+func prepareRequest(req *http.Request, target *url.URL, clientIP string, overTLS bool) *http.Request {
+	out := utils.PrepareRequest(req, target)
+	out.Header.Del("X-Forwarded-For")
+	if clientIP != "" {
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+	out.Header.Set("X-Forwarded-Host", req.Host)
+	proto := "http"
+	if overTLS {
+		proto = "https"
+	}
+	out.Header.Set("X-Forwarded-Proto", proto)
+	return out
+}
+
+// isTLS determines whether conn, or any connection it wraps, is TLS.
+func isTLS(conn net.Conn) bool {
+	found := false
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		_, found = wrapped.(*tls.Conn)
+		return !found
+	})
+	return found
+}
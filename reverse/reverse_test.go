@@ -0,0 +1,316 @@
+package reverse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+func TestRouting(t *testing.T) {
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name + " " + req.Host + req.URL.Path + " " + req.Header.Get("X-Forwarded-Host") + " " + req.Header.Get("X-Forwarded-Proto")))
+		}))
+	}
+	api, www, fallback := backend("api"), backend("www"), backend("fallback")
+	defer api.Close()
+	defer www.Close()
+	defer fallback.Close()
+
+	r, err := New(&Opts{
+		Routes: []Route{
+			{Host: "*.example.com", PathPrefix: "/api/", Pool: "api"},
+			{Host: "www.example.com", Pool: "www"},
+			{Host: "other.test", Pool: "fallback"},
+		},
+		Pools: []*PoolOpts{
+			{Name: "api", Backends: []string{api.URL}},
+			{Name: "www", Backends: []string{www.URL}},
+			{Name: "fallback", Backends: []string{fallback.URL}},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	filter := r.Filter()
+	nextCalled := false
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		nextCalled = true
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+	get := func(host, path string) (string, error) {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+		resp, _, err := filter.Apply(filters.BackgroundContext(), req, next)
+		if err != nil {
+			return "", err
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body), nil
+	}
+
+	body, err := get("WWW.example.com:80", "/api/users")
+	assert.NoError(t, err)
+	assert.Equal(t, "api WWW.example.com:80/api/users WWW.example.com:80 http", body, "Host should be kept")
+	body, err = get("www.example.com", "/index.html")
+	assert.NoError(t, err)
+	assert.Equal(t, "www www.example.com/index.html www.example.com http", body)
+	body, err = get("other.test", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback other.test/ other.test http", body)
+
+	_, err = get("example.com", "/api/users")
+	routeErr, ok := AsError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, http.StatusNotFound, routeErr.Status)
+		assert.Equal(t, "no_route", routeErr.Reason)
+	}
+
+	// Forward proxy requests are left to the next filter
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	filter.Apply(filters.BackgroundContext(), req, next)
+	assert.True(t, nextCalled)
+
+	stats := r.Stats()
+	if assert.Len(t, stats, 3) {
+		assert.Equal(t, BackendStats{Pool: "api", URL: api.URL, Healthy: true, Requests: 1}, stats[0])
+	}
+
+	assert.Error(t, r.Update(&Opts{Routes: []Route{{Pool: "missing"}}}), "invalid updates should be rejected")
+	body, err = get("other.test", "/")
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback other.test/ other.test http", body, "routes should be kept after an invalid update")
+	if assert.NoError(t, r.Update(&Opts{
+		Routes: []Route{{Pool: "www"}},
+		Pools:  []*PoolOpts{{Name: "www", Backends: []string{www.URL}}},
+	})) {
+		body, err = get("other.test", "/")
+		assert.NoError(t, err)
+		assert.Equal(t, "www other.test/ other.test http", body, "updated routes should apply")
+		assert.Len(t, r.Stats(), 1)
+	}
+
+	_, err = New(&Opts{Routes: []Route{{Pool: "missing"}}})
+	assert.Error(t, err, "routes should refer to existing pools")
+	_, err = New(&Opts{Pools: []*PoolOpts{{Name: "bad", Backends: []string{"ftp://example.com"}}}})
+	assert.Error(t, err, "backends should be http or https")
+}
+
+func TestForwardedFor(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("X-Forwarded-For")))
+	}))
+	defer backend.Close()
+	r, err := New(&Opts{
+		Routes: []Route{{Pool: "app"}},
+		Pools:  []*PoolOpts{{Name: "app", Backends: []string{backend.URL}}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	forwarded, err := proxyfilters.Forwarded(&proxyfilters.ForwardedOpts{TrustedProxies: []string{"192.0.2.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	get := func(filter filters.Filter, remoteAddr string) string {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.test"
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		resp, _, err := filter.Apply(filters.BackgroundContext(), req, nil)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body)
+	}
+
+	assert.Equal(t, "198.51.100.2", get(r.Filter(), "198.51.100.2:1234"), "forwarding headers of clients shouldn't be trusted")
+	chain := filters.Join(forwarded, r.Filter())
+	assert.Equal(t, "198.51.100.2", get(chain, "198.51.100.2:1234"), "forwarding headers of untrusted peers shouldn't be trusted")
+	assert.Equal(t, "203.0.113.7", get(chain, "192.0.2.1:1234"), "the client IP should be taken from trusted proxies")
+}
+
+func TestBalancing(t *testing.T) {
+	newPool := func(balancing Balancing) *pool {
+		p, err := newPool(&PoolOpts{
+			Name:       "test",
+			Backends:   []string{"http://a", "http://b", "http://c"},
+			Balancing:  balancing,
+			HashHeader: "X-Session",
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return p
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	picks := func(p *pool, n int) []string {
+		var hosts []string
+		for i := 0; i < n; i++ {
+			b := p.pick(req, "")
+			if b == nil {
+				hosts = append(hosts, "")
+				continue
+			}
+			hosts = append(hosts, b.url.Host)
+		}
+		return hosts
+	}
+
+	p := newPool(RoundRobin)
+	assert.Equal(t, []string{"a", "b", "c", "a"}, picks(p, 4))
+	p.backends[1].healthy = false
+	assert.Equal(t, []string{"c", "c", "a"}, picks(p, 3), "unhealthy backends should be skipped")
+	for _, b := range p.backends {
+		b.healthy = false
+	}
+	assert.Equal(t, []string{""}, picks(p, 1))
+
+	p = newPool(LeastConnections)
+	p.backends[0].begin()
+	p.backends[0].begin()
+	p.backends[1].begin()
+	assert.Equal(t, []string{"c"}, picks(p, 1))
+	p.backends[2].begin()
+	p.backends[2].begin()
+	assert.Equal(t, []string{"b"}, picks(p, 1))
+
+	p = newPool(ConsistentHash)
+	spread := make(map[string]bool)
+	for _, session := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		req.Header.Set("X-Session", session)
+		first := picks(p, 1)[0]
+		assert.Equal(t, []string{first, first}, picks(p, 2), "requests with the same key should stick to a backend")
+		spread[first] = true
+	}
+	assert.True(t, len(spread) > 1, "keys should be spread across backends")
+	req.Header.Set("X-Session", "1")
+	sticky := p.pick(req, "")
+	sticky.healthy = false
+	moved := p.pick(req, "")
+	assert.NotNil(t, moved)
+	assert.NotEqual(t, sticky, moved, "keys of unhealthy backends should move")
+	sticky.healthy = true
+	assert.Equal(t, sticky, p.pick(req, ""), "keys should return once the backend recovers")
+
+	// Requests without the header are hashed by client IP
+	req.Header.Del("X-Session")
+	spread = make(map[string]bool)
+	for i := 1; i <= 10; i++ {
+		clientIP := fmt.Sprintf("192.0.2.%d", i)
+		first := p.pick(req, clientIP)
+		assert.Equal(t, first, p.pick(req, clientIP), "requests from the same client should stick to a backend")
+		spread[first.url.Host] = true
+	}
+	assert.True(t, len(spread) > 1, "clients without the header should be spread across backends")
+}
+
+func TestHealthCheck(t *testing.T) {
+	var failing int32
+	unstable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("unstable"))
+	}))
+	defer unstable.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+
+	r, err := New(&Opts{
+		Routes: []Route{{Pool: "app"}},
+		Pools: []*PoolOpts{{
+			Name:     "app",
+			Backends: []string{unstable.URL, stable.URL},
+			HealthCheck: &HealthCheck{
+				Path:               "/healthz",
+				Interval:           20 * time.Millisecond,
+				UnhealthyThreshold: 2,
+				HealthyThreshold:   2,
+			},
+		}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	healthy := func() []bool {
+		var result []bool
+		for _, stats := range r.Stats() {
+			result = append(result, stats.Healthy)
+		}
+		return result
+	}
+
+	assert.Equal(t, []bool{true, true}, healthy())
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, []bool{false, true}, healthy())
+
+	filter := r.Filter()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "app.test"
+		resp, _, err := filter.Apply(filters.BackgroundContext(), req, nil)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "stable", string(body), "unhealthy backends should get no requests")
+		}
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, []bool{true, true}, healthy())
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reverse")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "reverse.json")
+	ioutil.WriteFile(file, []byte(`{
+		"routes": [{"host": "*.example.com", "path_prefix": "/api/", "pool": "api"}],
+		"pools": [{
+			"name": "api",
+			"backends": ["http://10.0.0.1:8080"],
+			"balancing": "consistent-hash",
+			"health_check": {"path": "/healthz", "interval": "5s", "unhealthy_threshold": 4}
+		}]
+	}`), 0644)
+
+	opts, err := Load(file)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Route{{Host: "*.example.com", PathPrefix: "/api/", Pool: "api"}}, opts.Routes)
+	if assert.Len(t, opts.Pools, 1) {
+		assert.Equal(t, ConsistentHash, opts.Pools[0].Balancing)
+		assert.Equal(t, &HealthCheck{Path: "/healthz", Interval: 5 * time.Second, UnhealthyThreshold: 4}, opts.Pools[0].HealthCheck)
+	}
+
+	ioutil.WriteFile(file, []byte(`{"pools": [{"health_check": {"interval": "often"}}]}`), 0644)
+	_, err = Load(file)
+	assert.Error(t, err)
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+type ctxKey string
+
+const (
+	activeConnKey = ctxKey("activeConn")
+	clientIPKey   = ctxKey("clientIP")
+)
+
+// ConnInfo describes an active client connection. Streams of HTTP/2 and
+// HTTP/3 connections are listed as connections of their own, with Parent set
+// to the ID of the connection carrying them.
+type ConnInfo struct {
+	ID         uint64            `json:"id"`
+	Parent     uint64            `json:"parent,omitempty"`
+	Client     string            `json:"client"`
+	User       string            `json:"user,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Started    time.Time         `json:"started"`
+	AgeSeconds float64           `json:"age_seconds"`
+	BytesSent  int               `json:"bytes_sent"`
+	BytesRecv  int               `json:"bytes_recv"`
+	Requests   int64             `json:"requests"`
+}
+
+// ConnSelector selects active connections. All non-empty fields have to match,
+// so the zero value selects all connections.
+type ConnSelector struct {
+	ID       uint64
+	ClientIP string
+	User     string
+}
+
+func (sel ConnSelector) matches(ac *activeConn) bool {
+	return (sel.ID == 0 || sel.ID == ac.id) &&
+		(sel.ClientIP == "" || sel.ClientIP == ac.clientIP) &&
+		(sel.User == "" || sel.User == ac.getUser())
+}
+
+type activeConn struct {
+	registry *connRegistry
+	id       uint64
+	conn     net.Conn
+	client   string
+	clientIP string
+	started  time.Time
+	target   atomic.Value
+	requests int64
+	timeouts *connTimeouts
+	parent   uint64
+
+	user string
+	tags map[string]string
+	mx   sync.RWMutex
+}
+
+func (ac *activeConn) getUser() string {
+	ac.mx.RLock()
+	defer ac.mx.RUnlock()
+	return ac.user
+}
+
+func (ac *activeConn) info() *ConnInfo {
+	info := &ConnInfo{
+		ID:         ac.id,
+		Parent:     ac.parent,
+		Client:     ac.client,
+		Started:    ac.started,
+		AgeSeconds: time.Since(ac.started).Seconds(),
+		Requests:   atomic.LoadInt64(&ac.requests),
+	}
+	info.Target, _ = ac.target.Load().(string)
+	ac.mx.RLock()
+	info.User = ac.user
+	if len(ac.tags) > 0 {
+		info.Tags = make(map[string]string, len(ac.tags))
+		for key, value := range ac.tags {
+			info.Tags[key] = value
+		}
+	}
+	ac.mx.RUnlock()
+	if sc, ok := ac.conn.(*streamConn); ok {
+		info.BytesSent, info.BytesRecv = sc.transferred()
+	} else if stats, ok := listeners.MeasuredStats(ac.conn); ok {
+		info.BytesSent = stats.SentTotal
+		info.BytesRecv = stats.RecvTotal
+	}
+	return info
+}
+
+// connRegistry tracks active connections, indexed by ID, client IP and user.
+type connRegistry struct {
+	nextID     uint64
+	conns      map[uint64]*activeConn
+	byClientIP map[string]map[uint64]*activeConn
+	byUser     map[string]map[uint64]*activeConn
+	mx         sync.RWMutex
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:      make(map[uint64]*activeConn),
+		byClientIP: make(map[string]map[uint64]*activeConn),
+		byUser:     make(map[string]map[uint64]*activeConn),
+	}
+}
+
+func (r *connRegistry) add(conn net.Conn) *activeConn {
+	ac := &activeConn{
+		registry: r,
+		id:       atomic.AddUint64(&r.nextID, 1),
+		conn:     conn,
+		started:  time.Now(),
+	}
+	if remoteAddr := conn.RemoteAddr(); remoteAddr != nil {
+		ac.client = remoteAddr.String()
+		ac.clientIP, _, _ = net.SplitHostPort(ac.client)
+	}
+	r.mx.Lock()
+	r.conns[ac.id] = ac
+	addToIndex(r.byClientIP, ac.clientIP, ac)
+	r.mx.Unlock()
+	return ac
+}
+
+func (r *connRegistry) remove(ac *activeConn) {
+	r.mx.Lock()
+	delete(r.conns, ac.id)
+	removeFromIndex(r.byClientIP, ac.clientIP, ac)
+	removeFromIndex(r.byUser, ac.getUser(), ac)
+	r.mx.Unlock()
+}
+
+func (r *connRegistry) setUser(ac *activeConn, user string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	ac.mx.Lock()
+	oldUser := ac.user
+	ac.user = user
+	ac.mx.Unlock()
+	removeFromIndex(r.byUser, oldUser, ac)
+	if _, active := r.conns[ac.id]; active {
+		addToIndex(r.byUser, user, ac)
+	}
+}
+
+func (r *connRegistry) get(id uint64) *activeConn {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.conns[id]
+}
+
+func (r *connRegistry) count() int {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return len(r.conns)
+}
+
+func (r *connRegistry) all() []*activeConn {
+	return r.selectConns(ConnSelector{})
+}
+
+// selectConns returns the connections matching sel, ordered by ID.
+func (r *connRegistry) selectConns(sel ConnSelector) []*activeConn {
+	r.mx.RLock()
+	candidates := r.conns
+	switch {
+	case sel.ID != 0:
+		candidates = nil
+		if ac := r.conns[sel.ID]; ac != nil {
+			candidates = map[uint64]*activeConn{ac.id: ac}
+		}
+	case sel.User != "":
+		candidates = r.byUser[sel.User]
+	case sel.ClientIP != "":
+		candidates = r.byClientIP[sel.ClientIP]
+	}
+	result := make([]*activeConn, 0, len(candidates))
+	for _, ac := range candidates {
+		if sel.matches(ac) {
+			result = append(result, ac)
+		}
+	}
+	r.mx.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+func addToIndex(index map[string]map[uint64]*activeConn, key string, ac *activeConn) {
+	if key == "" {
+		return
+	}
+	conns := index[key]
+	if conns == nil {
+		conns = make(map[uint64]*activeConn)
+		index[key] = conns
+	}
+	conns[ac.id] = ac
+}
+
+func removeFromIndex(index map[string]map[uint64]*activeConn, key string, ac *activeConn) {
+	conns := index[key]
+	if conns == nil {
+		return
+	}
+	delete(conns, ac.id)
+	if len(conns) == 0 {
+		delete(index, key)
+	}
+}
+
+func withActiveConn(ctx context.Context, ac *activeConn) context.Context {
+	return context.WithValue(ctx, activeConnKey, ac)
+}
+
+// clientlessContext hides the client connection and client IP of a context.
+type clientlessContext struct {
+	context.Context
+}
+
+func (ctx clientlessContext) Value(key interface{}) interface{} {
+	if key == activeConnKey || key == clientIPKey {
+		return nil
+	}
+	return ctx.Context.Value(key)
+}
+
+// withoutClient returns a context like ctx that doesn't belong to a client
+// connection, for work that's shared by all clients.
+func withoutClient(ctx context.Context) context.Context {
+	return clientlessContext{ctx}
+}
+
+// trackRequest records the target of each request on the active connection.
+func (s *Server) trackRequest(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if ac, ok := ctx.Value(activeConnKey).(*activeConn); ok {
+		ac.target.Store(req.Host)
+		atomic.AddInt64(&ac.requests, 1)
+	}
+	return next(ctx, req)
+}
+
+// Connections lists the currently active client connections, ordered by ID.
+func (s *Server) Connections() []*ConnInfo {
+	return s.SelectConnections(ConnSelector{})
+}
+
+// SelectConnections lists the currently active client connections matching
+// sel, ordered by ID.
+func (s *Server) SelectConnections(sel ConnSelector) []*ConnInfo {
+	conns := s.conns.selectConns(sel)
+	result := make([]*ConnInfo, 0, len(conns))
+	for _, ac := range conns {
+		result = append(result, ac.info())
+	}
+	return result
+}
+
+// CloseConnection closes the active connection with the given ID, returning
+// false if there is no such connection.
+func (s *Server) CloseConnection(id uint64) bool {
+	if id == 0 {
+		// An ID of 0 would select all connections
+		return false
+	}
+	n, _ := s.Control(ConnSelector{ID: id}, CloseConn{})
+	return n > 0
+}
+
+// LimitedListeners returns the listeners.LimitedListener instances created by
+// this server's listener wrappers.
+func (s *Server) LimitedListeners() []listeners.LimitedListener {
+	s.limitedMx.RLock()
+	defer s.limitedMx.RUnlock()
+	result := make([]listeners.LimitedListener, len(s.limitedListeners))
+	copy(result, s.limitedListeners)
+	return result
+}
+
+// SlowClientStats sums the stats of the listeners.SlowClientListener
+// instances created by this server's listener wrappers, and counts the
+// connections that exceeded the request header timeout. It returns false if
+// there are neither slow client listeners nor a request header timeout.
+func (s *Server) SlowClientStats() (listeners.SlowClientStats, bool) {
+	s.limitedMx.RLock()
+	defer s.limitedMx.RUnlock()
+	total := listeners.SlowClientStats{HeaderTimeouts: atomic.LoadInt64(&s.headerTimeouts)}
+	for _, l := range s.slowClientListeners {
+		stats := l.Stats()
+		total.SlowTransfers += stats.SlowTransfers
+	}
+	return total, len(s.slowClientListeners) > 0 || s.requestHeaderTimeout > 0
+}
+
+// Pause stops accepting new connections on all limited listeners.
+func (s *Server) Pause() {
+	for _, l := range s.LimitedListeners() {
+		l.Pause()
+	}
+}
+
+// Resume resumes accepting new connections on all limited listeners.
+func (s *Server) Resume() {
+	for _, l := range s.LimitedListeners() {
+		l.Resume()
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+var errNotServerConn = errors.New("context does not belong to a connection handled by a Server")
+
+// A ControlMessage changes an active client connection. Besides the messages
+// defined here, any listeners.Message can be sent, which is dispatched to the
+// connection's chain of wrapped connections with listeners.Send.
+type ControlMessage = listeners.Message
+
+// SetBandwidth limits the connection's bandwidth in each direction. It's
+// handled by connections accepted by a listeners.NewThrottledListener.
+type SetBandwidth = listeners.SetBandwidth
+
+// SetIdleTimeout changes how long the connection may be idle before it's
+// closed. It's handled by connections accepted by a
+// listeners.NewIdleConnListener.
+type SetIdleTimeout = listeners.SetIdleTimeout
+
+// Tag attaches a key/value pair to the connection. Tags are listed in ConnInfo
+// and included in the context reported for measured connections.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func (msg Tag) MessageType() string { return "tag" }
+
+// CloseConn closes the connection.
+type CloseConn struct{}
+
+func (msg CloseConn) MessageType() string { return "close" }
+
+func (ac *activeConn) apply(msg ControlMessage) error {
+	switch t := msg.(type) {
+	case Tag:
+		ac.mx.Lock()
+		if ac.tags == nil {
+			ac.tags = make(map[string]string)
+		}
+		ac.tags[t.Key] = t.Value
+		ac.mx.Unlock()
+		// Connections don't have to be measured
+		_, err := listeners.Send(ac.conn, listeners.UpdateMeasuredContext{t.Key: t.Value})
+		if errors.Is(err, listeners.ErrUnhandled) {
+			err = nil
+		}
+		return err
+	case CloseConn:
+		safeClose(ac.conn)
+		return nil
+	default:
+		_, err := listeners.Send(ac.conn, msg)
+		return err
+	}
+}
+
+// Control applies the given messages, in order, to all active connections
+// matching sel and returns the number of connections affected. If any message
+// fails or isn't handled by a connection, the first such error is returned
+// after all messages have been applied to all connections.
+func (s *Server) Control(sel ConnSelector, msgs ...ControlMessage) (int, error) {
+	conns := s.conns.selectConns(sel)
+	var firstErr error
+	for _, ac := range conns {
+		if err := ac.applyAll(msgs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(conns), firstErr
+}
+
+func (ac *activeConn) applyAll(msgs []ControlMessage) error {
+	var firstErr error
+	for _, msg := range msgs {
+		if err := ac.apply(msg); err != nil {
+			log.Debugf("Unable to apply %v control message to connection %d: %v", msg.MessageType(), ac.id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// ControlConn applies the given messages to the client connection being
+// handled in ctx. Filters can use this to change their own connection. It
+// returns an error if ctx doesn't belong to a connection handled by a Server,
+// or if any message fails or isn't handled.
+func ControlConn(ctx context.Context, msgs ...ControlMessage) error {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok {
+		return errNotServerConn
+	}
+	return ac.applyAll(msgs)
+}
+
+// updateMeasuredContext adds the given values to the measured context of the
+// client connection being handled in ctx. Connections that aren't measured are
+// skipped quietly.
+func updateMeasuredContext(ctx context.Context, update listeners.UpdateMeasuredContext) {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok {
+		return
+	}
+	if _, measured := listeners.MeasuredStats(ac.conn); measured {
+		ac.applyAll([]ControlMessage{update})
+	}
+}
+
+// SetUser associates the client connection being handled in ctx with the given
+// user, for example once a filter has authenticated it, so that it can be
+// selected with ConnSelector.User. It returns false if ctx doesn't belong to a
+// connection handled by a Server.
+func SetUser(ctx context.Context, user string) bool {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok {
+		return false
+	}
+	ac.registry.setUser(ac, user)
+	return true
+}
+
+// ConnID returns the ID of the client connection being handled in ctx, as
+// listed in ConnInfo and selected with ConnSelector.ID, or 0 if ctx doesn't
+// belong to a connection handled by a Server.
+func ConnID(ctx context.Context) uint64 {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok {
+		return 0
+	}
+	return ac.id
+}
+
+// User returns the user associated with the client connection being handled in
+// ctx by SetUser, or "" if there is none.
+func User(ctx context.Context) string {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok {
+		return ""
+	}
+	return ac.getUser()
+}
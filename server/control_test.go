@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+func TestControl(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/big" {
+			w.Write([]byte(strings.Repeat("a", 20000)))
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	var reportedMx sync.Mutex
+	var reportedPlan, reportedFamily interface{}
+	srv := New(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			if user := req.Header.Get("X-Test-User"); user != "" {
+				SetUser(ctx, user)
+			}
+			return next(ctx, req)
+		}),
+	})
+	srv.AddListenerWrappers(
+		func(ls net.Listener) net.Listener {
+			return listeners.NewIdleConnListener(ls, time.Hour)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewThrottledListener(ls, 0)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, 10*time.Millisecond, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+				reportedMx.Lock()
+				if plan, ok := ctx["plan"]; ok {
+					reportedPlan = plan
+				}
+				if family, ok := ctx[UpstreamFamilyKey]; ok {
+					reportedFamily = family
+				}
+				reportedMx.Unlock()
+			})
+		},
+	)
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	get := func(conn net.Conn, br *bufio.Reader, path string, user string) (time.Duration, error) {
+		start := time.Now()
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		if user != "" {
+			req.Header.Set("X-Test-User", user)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			return 0, err
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return 0, err
+		}
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return time.Since(start), err
+	}
+
+	alice, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer alice.Close()
+	aliceReader := bufio.NewReader(alice)
+	_, err = get(alice, aliceReader, "/", "alice")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	anonymous, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer anonymous.Close()
+	anonymousReader := bufio.NewReader(anonymous)
+	_, err = get(anonymous, anonymousReader, "/", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Len(t, srv.SelectConnections(ConnSelector{ClientIP: "127.0.0.1"}), 2)
+	assert.Len(t, srv.SelectConnections(ConnSelector{User: "bob"}), 0)
+	aliceConns := srv.SelectConnections(ConnSelector{User: "alice"})
+	if !assert.Len(t, aliceConns, 1) {
+		return
+	}
+	assert.Equal(t, alice.LocalAddr().String(), aliceConns[0].Client)
+
+	// Tag
+	n, err := srv.Control(ConnSelector{User: "alice"}, Tag{Key: "plan", Value: "free"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	info := srv.SelectConnections(ConnSelector{ID: aliceConns[0].ID})
+	if assert.Len(t, info, 1) {
+		assert.Equal(t, map[string]string{"plan": "free"}, info[0].Tags)
+	}
+	time.Sleep(50 * time.Millisecond)
+	reportedMx.Lock()
+	assert.Equal(t, "free", reportedPlan, "tags should be reported for measured connections")
+	assert.Equal(t, "ipv4", reportedFamily, "upstream address family should be reported")
+	reportedMx.Unlock()
+
+	// Bandwidth
+	n, err = srv.Control(ConnSelector{ClientIP: "127.0.0.1", User: "alice"}, SetBandwidth{BytesPerSecond: 10000})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	elapsed, err := get(alice, aliceReader, "/big", "")
+	if assert.NoError(t, err) {
+		assert.True(t, elapsed > 800*time.Millisecond, "download should have been throttled, took %v", elapsed)
+	}
+	elapsed, err = get(anonymous, anonymousReader, "/big", "")
+	if assert.NoError(t, err) {
+		assert.True(t, elapsed < 500*time.Millisecond, "download should not have been throttled, took %v", elapsed)
+	}
+
+	// Idle timeout
+	n, err = srv.Control(ConnSelector{User: "alice"}, SetIdleTimeout{Timeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = aliceReader.ReadByte()
+	assert.Error(t, err, "connection should have been closed once idle")
+
+	// Close
+	for i := 0; i < 100 && len(srv.SelectConnections(ConnSelector{User: "alice"})) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	n, _ = srv.Control(ConnSelector{User: "alice"}, CloseConn{})
+	assert.Equal(t, 0, n, "idled connection should have been removed")
+	remaining := srv.Connections()
+	if !assert.Len(t, remaining, 1) {
+		return
+	}
+	assert.True(t, srv.CloseConnection(remaining[0].ID))
+	anonymous.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = anonymousReader.ReadByte()
+	assert.Error(t, err, "connection should have been closed")
+	assert.False(t, srv.CloseConnection(0))
+}
+
+type unknownMessage struct{}
+
+func (msg unknownMessage) MessageType() string { return "unknown" }
+
+func TestControlMessages(t *testing.T) {
+	var reportedMx sync.Mutex
+	var reported map[string]interface{}
+	getReported := func() map[string]interface{} {
+		reportedMx.Lock()
+		defer reportedMx.Unlock()
+		return reported
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	var wrapped net.Listener = listeners.NewDefaultListener(l)
+	wrapped = listeners.NewIdleConnListener(wrapped, time.Hour)
+	wrapped = listeners.NewThrottledListener(wrapped, 0)
+	wrapped = listeners.NewMeasuredListener(wrapped, time.Hour, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		reportedMx.Lock()
+		reported = ctx
+		reportedMx.Unlock()
+	})
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+	conn, err := wrapped.Accept()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	acks, err := listeners.Send(conn, SetBandwidth{BytesPerSecond: 5000})
+	if assert.NoError(t, err) && assert.Len(t, acks, 1) {
+		assert.EqualValues(t, 0, acks[0].Result, "should return prior bandwidth")
+	}
+	acks, err = listeners.Send(conn, SetBandwidth{BytesPerSecond: 0})
+	if assert.NoError(t, err) && assert.Len(t, acks, 1) {
+		assert.EqualValues(t, 5000, acks[0].Result)
+	}
+	acks, err = listeners.Send(conn, SetIdleTimeout{Timeout: time.Minute})
+	if assert.NoError(t, err) && assert.Len(t, acks, 1) {
+		assert.Equal(t, time.Hour, acks[0].Result, "should return prior timeout")
+	}
+	_, err = listeners.Send(conn, SetIdleTimeout{Timeout: -1})
+	assert.Error(t, err)
+	_, err = listeners.Send(conn, unknownMessage{})
+	assert.True(t, errors.Is(err, listeners.ErrUnhandled), "unexpected error %v", err)
+
+	// String API
+	wc := conn.(listeners.WrapConn)
+	wc.ControlMessage(listeners.MsgMeasured, map[string]interface{}{"plan": "free"})
+	assert.NotPanics(t, func() {
+		wc.ControlMessage(listeners.MsgMeasured, "not a map")
+		wc.ControlMessage(listeners.MsgBandwidth, 1000)
+	})
+	conn.Close()
+	for i := 0; i < 100 && getReported() == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]interface{}{"plan": "free"}, getReported())
+}
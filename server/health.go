@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/transparent"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeInterval = 1 * time.Second
+
+	// drainPollInterval is how often AwaitDrained checks for open connections
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// HTTPProbe returns a readiness probe that succeeds if a GET of the given URL
+// returns a status code below 400.
+func HTTPProbe(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return errors.New("Probe of %v returned %v", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Readiness reports whether the server is ready to receive traffic.
+type Readiness struct {
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Drain marks the server as draining, so that it reports not-ready and load
+// balancers stop sending it new connections. Existing connections are left
+// alone.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// AwaitDrained waits until the server has no open connections, or until ctx
+// is done, in which case it returns ctx.Err(). It's meant to be called after
+// Drain to let connections in flight finish before exiting.
+func (s *Server) AwaitDrained(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for s.conns.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Readiness checks whether the server is ready: it must be listening, not
+// draining, its limited listeners must be accepting connections (i.e. not
+// saturated or paused), and the readiness probe (if any) must have
+// succeeded within the last Opts.ReadinessProbeInterval.
+func (s *Server) Readiness(ctx context.Context) *Readiness {
+	var reasons []string
+	if atomic.LoadInt32(&s.listening) == 0 {
+		reasons = append(reasons, "not listening")
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		reasons = append(reasons, "draining")
+	}
+	for _, l := range s.LimitedListeners() {
+		if l.IsPaused() {
+			reasons = append(reasons, "paused")
+		} else if l.IsStopped() {
+			reasons = append(reasons, "saturated")
+		}
+	}
+	if s.readinessProbe != nil && s.probe(ctx) != nil {
+		reasons = append(reasons, "probe failed")
+	}
+	return &Readiness{Ready: len(reasons) == 0, Reasons: reasons}
+}
+
+// probe runs the readiness probe unless it ran recently, in which case its
+// previous result is returned. Concurrent callers wait for a single probe.
+func (s *Server) probe(ctx context.Context) error {
+	s.probeMx.Lock()
+	defer s.probeMx.Unlock()
+	if time.Since(s.probedAt) < s.readinessProbeInterval {
+		return s.probeErr
+	}
+	// The result is shared, so don't let one caller going away cancel it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.readinessProbeTimeout)
+	defer cancel()
+	s.probeErr = s.readinessProbe(ctx)
+	s.probedAt = time.Now()
+	if s.probeErr != nil {
+		log.Debugf("Readiness probe failed: %v", s.probeErr)
+	}
+	return s.probeErr
+}
+
+// HealthHandler returns an http.Handler serving /healthz (liveness) and
+// /readyz (readiness), suitable for the admin API.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status, body := s.health(req.Context(), req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+}
+
+func (s *Server) health(ctx context.Context, path string) (int, []byte) {
+	var result interface{}
+	status := http.StatusOK
+	if path == readyzPath {
+		readiness := s.Readiness(ctx)
+		if !readiness.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		result = readiness
+	} else {
+		result = map[string]interface{}{"alive": true}
+	}
+	body, _ := json.Marshal(result)
+	return status, append(body, '\n')
+}
+
+// answerHealth answers health checks addressed to the proxy itself (as
+// opposed to proxied requests for some origin's /healthz).
+func (s *Server) answerHealth(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		(req.URL.Path != healthzPath && req.URL.Path != readyzPath) ||
+		!isToSelf(ctx, req) || (s.reverse != nil && s.reverse.Matches(req)) {
+		return next(ctx, req)
+	}
+	status, body := s.health(ctx, req.URL.Path)
+	return filters.ShortCircuit(ctx, req, &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+	})
+}
+
+// isToSelf determines whether req is an origin-form request or an
+// absolute-form request for the proxy's own address. Requests on redirected
+// connections are never for the proxy, but for their original destination.
+func isToSelf(ctx filters.Context, req *http.Request) bool {
+	downstream := ctx.DownstreamConn()
+	if _, redirected := transparent.OriginalDst(downstream); redirected {
+		return false
+	}
+	if !req.URL.IsAbs() {
+		return true
+	}
+	if downstream == nil || downstream.LocalAddr() == nil {
+		return false
+	}
+	local := downstream.LocalAddr().String()
+	if req.URL.Host == local {
+		return true
+	}
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		return false
+	}
+	_, localPort, _ := net.SplitHostPort(local)
+	return port == localPort && (host == "localhost" || net.ParseIP(host).IsLoopback())
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+func TestReadiness(t *testing.T) {
+	var probeFails, probes int32
+	srv := New(&Opts{
+		ReadinessProbe: func(ctx context.Context) error {
+			atomic.AddInt32(&probes, 1)
+			if atomic.LoadInt32(&probeFails) == 1 {
+				return errors.New("upstream down")
+			}
+			return nil
+		},
+		ReadinessProbeInterval: 50 * time.Millisecond,
+	})
+	srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+		return listeners.NewLimitedListener(ls, 2)
+	})
+
+	readiness := srv.Readiness(context.Background())
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, []string{"not listening"}, readiness.Reasons)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	served := make(chan error)
+	ready := make(chan string)
+	go func() { served <- srv.Serve(l, func(addr string) { ready <- addr }) }()
+	addr := <-ready
+
+	// Health checks answered by the proxy itself
+	assert.Equal(t, http.StatusOK, doHealthCheck(t, addr, "/healthz", nil))
+	var result Readiness
+	waitForConns(t, srv, 0)
+	assert.Equal(t, http.StatusOK, doHealthCheck(t, addr, "/readyz", &result))
+	assert.True(t, result.Ready)
+
+	atomic.StoreInt32(&probeFails, 1)
+	probesBefore := atomic.LoadInt32(&probes)
+	assert.True(t, srv.Readiness(context.Background()).Ready, "recent probe results should be reused")
+	assert.Equal(t, probesBefore, atomic.LoadInt32(&probes))
+	time.Sleep(60 * time.Millisecond)
+	waitForConns(t, srv, 0)
+	assert.Equal(t, http.StatusServiceUnavailable, doHealthCheck(t, addr, "/readyz", &result))
+	assert.Equal(t, []string{"probe failed"}, result.Reasons)
+	atomic.StoreInt32(&probeFails, 0)
+	time.Sleep(60 * time.Millisecond)
+
+	// Saturate the limited listener
+	waitForConns(t, srv, 0)
+	conn1, _ := net.Dial("tcp", addr)
+	defer conn1.Close()
+	conn2, _ := net.Dial("tcp", addr)
+	defer conn2.Close()
+	waitForConns(t, srv, 2)
+	readiness = srv.Readiness(context.Background())
+	assert.Equal(t, []string{"saturated"}, readiness.Reasons)
+	conn1.Close()
+	conn2.Close()
+	waitForConns(t, srv, 0)
+	readiness = srv.Readiness(context.Background())
+	assert.True(t, readiness.Ready, "should accept connections again once connections are closed")
+
+	srv.Drain()
+	conn, _ := net.Dial("tcp", addr)
+	waitForConns(t, srv, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, srv.AwaitDrained(ctx), "should wait for open connections")
+	cancel()
+	conn.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	assert.NoError(t, srv.AwaitDrained(ctx), "should return once connections are closed")
+	cancel()
+
+	rec := httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), "draining")
+
+	rec = httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	l.Close()
+	<-served
+	assert.Contains(t, srv.Readiness(context.Background()).Reasons, "not listening", "should stop being ready once no longer serving")
+}
+
+func doHealthCheck(t *testing.T, addr string, path string, result interface{}) int {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	req.Host = addr
+	req.URL.Host = ""
+	req.URL.Scheme = ""
+	if !assert.NoError(t, req.Write(conn)) {
+		return 0
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+func waitForConns(t *testing.T, srv *Server, numConns uint64) {
+	for i := 0; i < 100; i++ {
+		if srv.LimitedListeners()[0].NumConns() == numConns {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d open connections, have %d", numConns, srv.LimitedListeners()[0].NumConns())
+}
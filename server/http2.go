@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/netx"
+	"golang.org/x/net/http2"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+// negotiatedProtocol returns the protocol negotiated with ALPN if conn is a
+// TLS connection.
+func negotiatedProtocol(conn net.Conn) string {
+	var tlsConn *tls.Conn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		tlsConn, _ = wrapped.(*tls.Conn)
+		return tlsConn == nil
+	})
+	if tlsConn == nil {
+		return ""
+	}
+	return tlsConn.ConnectionState().NegotiatedProtocol
+}
+
+// serveHTTP2 serves a client connection that negotiated HTTP/2. Each stream is
+// proxied like a client connection of its own, see handleStream.
+func (s *Server) serveHTTP2(ctx context.Context, ac *activeConn, conn net.Conn) {
+	srv := &http2.Server{IdleTimeout: s.idleTimeout}
+	srv.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			s.handleStream(ctx, ac, w, req)
+		}),
+	})
+	safeClose(conn)
+}
+
+// handleStream proxies a single HTTP/2 stream. The stream is translated to
+// HTTP/1.1 over an in-memory connection that's handled by the proxy, so that
+// it goes through the same filters and dialing as any other request. CONNECT
+// streams (RFC 7540 section 8.3) tunnel to the upstream.
+func (s *Server) handleStream(ctx context.Context, parent *activeConn, w http.ResponseWriter, req *http.Request) {
+	proxySide, streamSide := halfClosePipe()
+	sc := &streamConn{
+		Conn:   proxySide,
+		parent: parent.conn,
+		quic:   quicConnOf(parent.conn),
+	}
+	ac := s.conns.add(sc)
+	ac.parent = parent.id
+	defer s.conns.remove(ac)
+	ac.timeouts = newConnTimeouts(sc, 0)
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		if err := s.proxy.Handle(withActiveConn(ctx, ac), ac.timeouts, sc); err != nil {
+			log.Debugf("Error handling stream from %v: %v", sc.RemoteAddr(), err)
+		}
+		ac.timeouts.stop()
+	}()
+	defer func() {
+		streamSide.Close()
+		<-handled
+	}()
+
+	out := toHTTP1(req)
+	go func() {
+		var err error
+		if out.Method == http.MethodConnect {
+			err = out.Write(streamSide)
+		} else {
+			err = out.WriteProxy(streamSide)
+		}
+		if err != nil {
+			streamSide.Close()
+		}
+	}()
+	br := bufio.NewReader(streamSide)
+	resp, err := http.ReadResponse(br, out)
+	if err != nil {
+		log.Debugf("Unable to read response to stream from %v: %v", sc.RemoteAddr(), err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	utils.RemoveHopByHopHeaders(header)
+	tunnel := out.Method == http.MethodConnect && resp.StatusCode == http.StatusOK
+	if tunnel {
+		// The response is followed by tunneled data
+		header.Del("Content-Length")
+	}
+	w.WriteHeader(resp.StatusCode)
+	fw := &flushWriter{w}
+	if !tunnel {
+		io.Copy(fw, resp.Body)
+		return
+	}
+
+	fw.Flush()
+	go func() {
+		// The end of the client's stream only ends what's sent upstream, the
+		// upstream may keep responding until it's done
+		io.Copy(streamSide, req.Body)
+		streamSide.CloseWrite()
+	}()
+	io.Copy(fw, br)
+}
+
+// toHTTP1 converts a request received on an HTTP/2 stream to one that can be
+// written to the proxy.
+func toHTTP1(req *http.Request) *http.Request {
+	out := req.Clone(req.Context())
+	out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
+	out.RequestURI = ""
+	out.Close = false
+	utils.RemoveHopByHopHeaders(out.Header)
+	if req.Method == http.MethodConnect {
+		out.URL = &url.URL{Host: req.Host}
+		out.Body = nil
+		out.ContentLength = 0
+		return out
+	}
+	if out.URL.Scheme == "" {
+		// Plain HTTP, since HTTPS is tunneled with CONNECT
+		out.URL.Scheme = "http"
+	}
+	out.URL.Host = req.Host
+	return out
+}
+
+// halfClosePipe is like net.Pipe, except that each direction is a pipe of its
+// own, so that either end can close writing while still reading.
+func halfClosePipe() (*pipeConn, *pipeConn) {
+	aReader, bWriter := net.Pipe()
+	bReader, aWriter := net.Pipe()
+	return &pipeConn{Conn: aReader, writer: aWriter}, &pipeConn{Conn: bReader, writer: bWriter}
+}
+
+// pipeConn is an end of a halfClosePipe. The embedded Conn is the reading
+// side.
+type pipeConn struct {
+	net.Conn
+	writer net.Conn
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// CloseWrite makes reads at the other end return io.EOF.
+func (c *pipeConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *pipeConn) Close() error {
+	c.writer.Close()
+	return c.Conn.Close()
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.writer.SetWriteDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.writer.SetWriteDeadline(t)
+}
+
+// streamConn is the connection through which the proxy handles an HTTP/2
+// stream. It counts the stream's data by itself, but reports the addresses of
+// its parent connection and passes control messages on to it.
+type streamConn struct {
+	net.Conn
+	// sent and recv count the bytes sent to and received from the client
+	sent   int64
+	recv   int64
+	parent net.Conn
+	// quic is the parent if it's a QUIC connection, which doesn't carry the
+	// stream's data and so has it accounted for separately
+	quic *quicConn
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.recv, int64(n))
+	if n > 0 && c.quic != nil {
+		c.quic.received(n)
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	if n > 0 && c.quic != nil {
+		c.quic.sent(n)
+	}
+	return n, err
+}
+
+// transferred returns the bytes sent to and received from the client so far.
+func (c *streamConn) transferred() (sent int, recv int) {
+	return int(atomic.LoadInt64(&c.sent)), int(atomic.LoadInt64(&c.recv))
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.parent.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.parent.RemoteAddr()
+}
+
+func (c *streamConn) Wrapped() net.Conn {
+	return c.parent
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.Flush()
+	return n, err
+}
+
+func (fw *flushWriter) Flush() {
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.URL.Path))
+	}))
+	defer origin.Close()
+	echo, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// Responds some time after clients are done sending
+	late, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer late.Close()
+	go func() {
+		for {
+			conn, err := late.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				io.ReadFull(conn, buf)
+				time.Sleep(100 * time.Millisecond)
+				conn.Write([]byte("late " + string(buf)))
+			}()
+		}
+	}()
+
+	srv := New(&Opts{HTTP2: true})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTPS("localhost:0", keyFile, certFile, func(addr string) { ready <- addr })
+	addr := <-ready
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http2.NextProtoTLS}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, http2.NextProtoTLS, conn.ConnectionState().NegotiatedProtocol)
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Tunnel over one stream
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	connectReq := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: echo.Addr().String()},
+		Host:   echo.Addr().String(),
+		Header: make(http.Header),
+		Body:   pr,
+	}
+	tunnel, err := cc.RoundTrip(connectReq)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, tunnel.StatusCode) {
+		return
+	}
+	defer tunnel.Body.Close()
+
+	// While plain HTTP requests use others
+	for _, path := range []string{"/a", "/b"} {
+		start := time.Now()
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		resp, err := cc.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello "+path, string(body))
+		assert.True(t, time.Since(start) < 500*time.Millisecond, "streams should end as soon as they're handled, took %v", time.Since(start))
+	}
+
+	pw.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(tunnel.Body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	var parents, streams int
+	for _, info := range srv.Connections() {
+		if info.Parent == 0 {
+			parents++
+		} else if info.Target == echo.Addr().String() {
+			streams++
+			// The stream's request header and the tunneled ping
+			assert.True(t, info.BytesRecv > 4 && info.BytesRecv < 1000, "stream should be measured by itself, received %d", info.BytesRecv)
+		}
+	}
+	assert.Equal(t, 1, parents, "streams should share a single connection")
+	assert.Equal(t, 1, streams)
+
+	// Clients ending their stream still get the rest of the response
+	halfClosed, err := cc.RoundTrip(&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: late.Addr().String()},
+		Host:   late.Addr().String(),
+		Header: make(http.Header),
+		Body:   ioutil.NopCloser(strings.NewReader("ping")),
+	})
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusOK, halfClosed.StatusCode) {
+		body, _ := ioutil.ReadAll(halfClosed.Body)
+		halfClosed.Body.Close()
+		assert.Equal(t, "late ping", string(body))
+	}
+
+	// Errors are rendered by the proxy as usual
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:0/", nil)
+	resp, err := cc.RoundTrip(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	}
+}
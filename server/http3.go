@@ -0,0 +1,435 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/filters"
+	"github.com/getlantern/tlsdefaults"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	// connectUDP is the protocol of extended CONNECT requests that proxy UDP
+	// (RFC 9298)
+	connectUDP = "connect-udp"
+
+	// udpPathPrefix is the start of the default URI template of UDP proxying,
+	// /.well-known/masque/udp/{target_host}/{target_port}/
+	udpPathPrefix = "/.well-known/masque/udp/"
+
+	maxUDPPayload = 65535
+
+	// quicTransferChunk is the most data of QUIC streams that's accounted for
+	// on their connection at once
+	quicTransferChunk = 32 << 10
+)
+
+// ListenAndServeHTTP3 listens for QUIC connections on the given UDP address
+// and serves HTTP/3 on them, see ServeHTTP3.
+func (s *Server) ListenAndServeHTTP3(addr, keyfile, certfile string, readyCb func(addr string)) error {
+	pconn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	cfg, err := tlsdefaults.BuildListenerConfig(pconn.LocalAddr().String(), keyfile, certfile)
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+	log.Debugf("Listen http3 on %s", addr)
+	return s.ServeHTTP3(pconn, cfg, readyCb)
+}
+
+// ServeHTTP3 serves HTTP/3 on QUIC connections accepted from pconn. Requests
+// and CONNECT tunnels are proxied like HTTP/2 streams, see handleStream, and
+// CONNECT-UDP requests (RFC 9298) tunnel UDP to their target using HTTP
+// Datagrams. QUIC connections are checked against Allow and go through the
+// listener wrappers like TCP connections, with the data of their streams and
+// datagrams accounted for on them (see quicConn), so that they're limited and
+// measured alike. Streams also count their own data and are listed as
+// connections with the QUIC connection as their parent.
+func (s *Server) ServeHTTP3(pconn net.PacketConn, cfg *tls.Config, readyCb func(addr string)) error {
+	ql, err := quic.Listen(pconn, http3.ConfigureTLSConfig(cfg), &quic.Config{
+		MaxIdleTimeout:  s.idleTimeout,
+		EnableDatagrams: true,
+	})
+	if err != nil {
+		return err
+	}
+	l := s.applyListenerWrappers(&quicListener{ql})
+	defer l.Close()
+
+	atomic.AddInt32(&s.listening, 1)
+	defer atomic.AddInt32(&s.listening, -1)
+	if readyCb != nil {
+		readyCb(l.Addr().String())
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if fatalErr := s.onAcceptError(err); fatalErr != nil {
+				return fatalErr
+			}
+			continue
+		}
+		if wrapConn, ok := conn.(listeners.WrapConn); ok {
+			wrapConn.OnState(http.StateNew)
+		}
+		go s.serveQUIC(conn)
+	}
+}
+
+// serveQUIC serves a QUIC connection accepted through the listener wrappers.
+func (s *Server) serveQUIC(conn net.Conn) {
+	defer conn.Close()
+	qc := quicConnOf(conn)
+	qc.outer = conn
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if s.Allow != nil && !s.Allow(clientIP) {
+		return
+	}
+	op := ops.Begin("http_proxy_handle").Set("client_ip", clientIP)
+	defer op.End()
+
+	ac := s.conns.add(conn)
+	defer s.conns.remove(ac)
+	ctx := withActiveConn(proxyfilters.WithOp(context.Background(), op), ac)
+	srv := &http3.Server{
+		EnableDatagrams: true,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodConnect && req.Proto == connectUDP {
+				s.proxyUDP(ctx, ac, w, req)
+				return
+			}
+			s.handleStream(ctx, ac, w, req)
+		}),
+	}
+	if err := srv.ServeQUICConn(qc.conn); err != nil {
+		log.Debugf("Error serving QUIC connection from %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// proxyUDP handles a CONNECT-UDP request. The request goes through the filters
+// as a CONNECT to the target, and UDP payloads are then relayed between the
+// target and HTTP Datagrams on the request stream.
+func (s *Server) proxyUDP(ctx context.Context, parent *activeConn, w http.ResponseWriter, req *http.Request) {
+	target, err := udpTarget(req.URL.Path)
+	if err != nil {
+		log.Debugf("Invalid CONNECT-UDP request from %v: %v", req.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	dgCtx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	dc := &datagramConn{ctx: dgCtx, cancel: cancel, parent: parent.conn}
+	sc := &streamConn{
+		Conn:   dc,
+		parent: parent.conn,
+		quic:   quicConnOf(parent.conn),
+	}
+	ac := s.conns.add(sc)
+	ac.parent = parent.id
+	defer s.conns.remove(ac)
+	ac.timeouts = newConnTimeouts(sc, 0)
+	defer ac.timeouts.stop()
+
+	connectReq := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     req.Header.Clone(),
+		RemoteAddr: req.RemoteAddr,
+	}
+	var upstream net.Conn
+	fctx := filters.WrapContext(withActiveConn(ctx, ac), sc)
+	resp, fctx, err := s.filter.Apply(fctx, connectReq, func(fctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		conn, err := s.dial(fctx, true, "udp", req.URL.Host)
+		if err != nil {
+			return nil, fctx, err
+		}
+		upstream = conn
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}, fctx, nil
+	})
+	if err != nil && resp == nil {
+		resp = s.errorResponse(fctx, connectReq, false, err)
+	}
+	if resp.StatusCode != http.StatusOK || upstream == nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		writeResponse(w, resp)
+		return
+	}
+	defer upstream.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	str := streamer.HTTPStream()
+	dc.setStream(str)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayDatagrams(upstream, sc)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		relayDatagrams(sc, upstream)
+		sc.Close()
+	}()
+	// Capsules aren't used, so the stream only tells when the tunnel is closed
+	io.Copy(ioutil.Discard, str)
+	sc.Close()
+	upstream.Close()
+	wg.Wait()
+}
+
+// udpTarget extracts the target host and port from a path following the
+// default URI template of UDP proxying.
+func udpTarget(path string) (string, error) {
+	if !strings.HasPrefix(path, udpPathPrefix) {
+		return "", errors.New("Unexpected path %v", path)
+	}
+	parts := strings.Split(strings.TrimPrefix(path, udpPathPrefix), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" || (len(parts) > 2 && parts[2] != "") || len(parts) > 3 {
+		return "", errors.New("Unexpected path %v", path)
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// relayDatagrams copies datagrams from src to dst until reading from src
+// fails. Datagrams that can't be written are dropped, as they would be by the
+// network.
+func relayDatagrams(dst, src net.Conn) {
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			log.Tracef("Dropping datagram of %d bytes: %v", n, err)
+		}
+	}
+}
+
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	utils.RemoveHopByHopHeaders(header)
+	w.WriteHeader(resp.StatusCode)
+	if resp.Body != nil {
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// datagramConn reads and writes the UDP payloads of a CONNECT-UDP stream,
+// which are carried in HTTP Datagrams with a context ID of 0 (RFC 9298 section
+// 5). Each Read and Write is one datagram.
+type datagramConn struct {
+	str    *http3.Stream
+	ctx    context.Context
+	cancel context.CancelFunc
+	parent net.Conn
+	closed bool
+	mx     sync.Mutex
+}
+
+// setStream sets the stream once the request has been answered, closing it
+// right away if the connection has already been closed.
+func (c *datagramConn) setStream(str *http3.Stream) {
+	c.mx.Lock()
+	c.str = str
+	closed := c.closed
+	c.mx.Unlock()
+	if closed {
+		closeStream(str)
+	}
+}
+
+func (c *datagramConn) Read(b []byte) (int, error) {
+	for {
+		data, err := c.str.ReceiveDatagram(c.ctx)
+		if err != nil {
+			return 0, err
+		}
+		contextID, n, err := quicvarint.Parse(data)
+		if err != nil || contextID != 0 {
+			// Unknown contexts are dropped
+			continue
+		}
+		return copy(b, data[n:]), nil
+	}
+}
+
+func (c *datagramConn) Write(b []byte) (int, error) {
+	data := make([]byte, 0, len(b)+1)
+	data = quicvarint.Append(data, 0)
+	if err := c.str.SendDatagram(append(data, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *datagramConn) Close() error {
+	c.cancel()
+	c.mx.Lock()
+	str := c.str
+	alreadyClosed := c.closed
+	c.closed = true
+	c.mx.Unlock()
+	if str != nil && !alreadyClosed {
+		closeStream(str)
+	}
+	return nil
+}
+
+func closeStream(str *http3.Stream) {
+	str.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	str.Close()
+}
+
+func (c *datagramConn) LocalAddr() net.Addr                { return c.parent.LocalAddr() }
+func (c *datagramConn) RemoteAddr() net.Addr               { return c.parent.RemoteAddr() }
+func (c *datagramConn) SetDeadline(t time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// quicListener accepts QUIC connections as quicConns, so that they can be
+// wrapped by the listener wrappers.
+type quicListener struct {
+	l *quic.Listener
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	conn, err := l.l.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{conn: conn}, nil
+}
+
+func (l *quicListener) Close() error   { return l.l.Close() }
+func (l *quicListener) Addr() net.Addr { return l.l.Addr() }
+
+// quicConn stands in for a QUIC connection in the listener wrappers and the
+// registry of active connections, as the parent of its streams. Closing it
+// closes the QUIC connection. It doesn't carry any data itself. Instead, what
+// its streams receive and send is read and written through the wrappers
+// around it (see received and sent), for them to measure, throttle and time
+// out the QUIC connection by its streams' data.
+type quicConn struct {
+	conn *quic.Conn
+	// outer is the outermost wrapper around this connection
+	outer net.Conn
+
+	// transferMx serializes accounting for the streams' data
+	transferMx sync.Mutex
+	unread     int
+	buf        []byte
+}
+
+// quicConnOf returns the quicConn wrapped by conn, or nil if conn isn't a QUIC
+// connection.
+func quicConnOf(conn net.Conn) *quicConn {
+	var qc *quicConn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		qc, _ = wrapped.(*quicConn)
+		return qc == nil
+	})
+	return qc
+}
+
+// received accounts for n bytes received on one of the connection's streams.
+func (c *quicConn) received(n int) {
+	c.transfer(n, func(b []byte) (int, error) {
+		c.unread = len(b)
+		defer func() { c.unread = 0 }()
+		return c.outer.Read(b)
+	})
+}
+
+// sent accounts for n bytes sent on one of the connection's streams.
+func (c *quicConn) sent(n int) {
+	c.transfer(n, c.outer.Write)
+}
+
+func (c *quicConn) transfer(n int, fn func(b []byte) (int, error)) {
+	c.transferMx.Lock()
+	defer c.transferMx.Unlock()
+	if c.buf == nil {
+		c.buf = make([]byte, quicTransferChunk)
+	}
+	for n > 0 {
+		chunk := c.buf
+		if n < len(chunk) {
+			chunk = chunk[:n]
+		}
+		transferred, err := fn(chunk)
+		if err != nil || transferred == 0 {
+			return
+		}
+		n -= transferred
+	}
+}
+
+// Read returns as many bytes as received is accounting for.
+func (c *quicConn) Read(b []byte) (int, error) {
+	if c.unread == 0 {
+		return 0, io.EOF
+	}
+	n := len(b)
+	if n > c.unread {
+		n = c.unread
+	}
+	c.unread -= n
+	return n, nil
+}
+
+func (c *quicConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *quicConn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *quicConn) SetDeadline(t time.Time) error      { return nil }
+func (c *quicConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *quicConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *quicConn) Close() error {
+	return c.conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+}
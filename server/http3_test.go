@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/proxy/filters"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+func TestHTTP3(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.URL.Path))
+	}))
+	defer origin.Close()
+	echo, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	srv := New(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			if req.Host == "blocked.test:53" {
+				return filters.Fail(ctx, req, http.StatusForbidden, errors.New("blocked"))
+			}
+			return next(ctx, req)
+		}),
+	})
+	var reported int64
+	srv.AddListenerWrappers(
+		func(ls net.Listener) net.Listener {
+			return listeners.NewLimitedListener(ls, 10)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, 50*time.Millisecond, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+				atomic.AddInt64(&reported, int64(deltaStats.SentTotal+deltaStats.RecvTotal))
+			})
+		},
+	)
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP3("localhost:0", keyFile, certFile, func(addr string) { ready <- addr })
+	addr := <-ready
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}}, &quic.Config{EnableDatagrams: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.CloseWithError(0, "")
+	cc := (&http3.Transport{EnableDatagrams: true}).NewClientConn(conn)
+
+	// Plain HTTP requests
+	for _, path := range []string{"/a", "/b"} {
+		start := time.Now()
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		resp, err := cc.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello "+path, string(body))
+		assert.True(t, time.Since(start) < 500*time.Millisecond, "streams should end as soon as they're handled, took %v", time.Since(start))
+	}
+
+	// A TCP tunnel
+	tunnel, err := cc.OpenRequestStream(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tunnel.Close()
+	err = tunnel.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Host:   echo.Addr().String(),
+		URL:    &url.URL{Host: echo.Addr().String()},
+		Header: make(http.Header),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := tunnel.ReadResponse()
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	tunnel.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(tunnel, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// And a UDP one
+	<-cc.ReceivedSettings()
+	assert.True(t, cc.Settings().EnableDatagrams)
+	assert.True(t, cc.Settings().EnableExtendedConnect)
+	_, port, _ := net.SplitHostPort(udpEcho.LocalAddr().String())
+	udpTunnel, resp := openUDPTunnel(t, ctx, cc, addr, "127.0.0.1", port)
+	if !assert.NotNil(t, udpTunnel) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	defer udpTunnel.Close()
+	assert.Equal(t, "?1", resp.Header.Get("Capsule-Protocol"))
+	for _, payload := range []string{"one", "two"} {
+		if !assert.NoError(t, udpTunnel.SendDatagram(append(quicvarint.Append(nil, 0), payload...))) {
+			return
+		}
+		data, err := udpTunnel.ReceiveDatagram(ctx)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, append([]byte{0}, payload...), data)
+	}
+
+	var parents, streams int
+	for _, info := range srv.Connections() {
+		if info.Parent == 0 {
+			parents++
+		} else if info.Target == udpEcho.LocalAddr().String() {
+			streams++
+			assert.Equal(t, 6, info.BytesRecv, "datagrams should be measured without framing")
+			assert.Equal(t, 6, info.BytesSent, "datagrams should be measured without framing")
+		}
+	}
+	assert.Equal(t, 1, parents, "streams should share a single connection")
+	assert.Equal(t, 1, streams)
+	if limited := srv.LimitedListeners(); assert.Len(t, limited, 1) {
+		assert.EqualValues(t, 1, limited[0].NumConns(), "QUIC connections should count against the connection limit")
+	}
+
+	// Filters apply to UDP tunnels like any other
+	blocked, resp := openUDPTunnel(t, ctx, cc, addr, "blocked.test", "53")
+	if assert.NotNil(t, blocked) {
+		blocked.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	udpTunnel.Close()
+	udpTunnel.CancelRead(0)
+	closed := false
+	// Closing measured connections waits for their rate tracking
+	for i := 0; i < 30 && !closed; i++ {
+		time.Sleep(100 * time.Millisecond)
+		closed = true
+		for _, info := range srv.Connections() {
+			if info.Target == udpEcho.LocalAddr().String() {
+				closed = false
+			}
+		}
+	}
+	assert.True(t, closed, "closing the stream should close the tunnel")
+
+	// The requests, tunneled pings and datagrams, along with HTTP framing
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, atomic.LoadInt64(&reported) > 20, "data of streams should be reported for the QUIC connection, got %d", atomic.LoadInt64(&reported))
+}
+
+func TestUDPTarget(t *testing.T) {
+	target, err := udpTarget("/.well-known/masque/udp/192.0.2.6/443/")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.6:443", target)
+	target, err = udpTarget("/.well-known/masque/udp/2001%3Adb8%3A%3A42/53")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::42]:53", target)
+	for _, path := range []string{"/", "/.well-known/masque/udp/example.com/", "/.well-known/masque/udp//53/", "/.well-known/masque/udp/example.com/53/x"} {
+		_, err := udpTarget(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func openUDPTunnel(t *testing.T, ctx context.Context, cc *http3.ClientConn, proxyAddr, host, port string) (*http3.RequestStream, *http.Response) {
+	str, err := cc.OpenRequestStream(ctx)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	u, _ := url.Parse("https://" + proxyAddr + udpPathPrefix + url.PathEscape(host) + "/" + port + "/")
+	err = str.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Proto:  connectUDP,
+		Host:   proxyAddr,
+		URL:    u,
+		Header: http.Header{"Capsule-Protocol": {"?1"}},
+	})
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	resp, err := str.ReadResponse()
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	return str, resp
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/pac"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/transparent"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+// servePAC answers requests for the PAC file addressed to the proxy itself,
+// at pac.Path or pac.WPADPath. Unless the PAC file advertises a configured
+// address, it advertises the one that the client connected to, since the Host
+// of requests is up to clients.
+func (s *Server) servePAC(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	g := s.pacGenerator()
+	if g == nil ||
+		(req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		(req.URL.Path != pac.Path && req.URL.Path != pac.WPADPath) ||
+		!isToSelf(ctx, req) || (s.reverse != nil && s.reverse.Matches(req)) {
+		return next(ctx, req)
+	}
+	advertised := ""
+	if downstream := ctx.DownstreamConn(); downstream != nil && downstream.LocalAddr() != nil {
+		advertised = downstream.LocalAddr().String()
+	}
+	script := g.Script(pacClientIP(ctx, req), advertised)
+	return filters.ShortCircuit(ctx, req, &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type": []string{pac.ContentType},
+			// The script depends on the client's address
+			"Cache-Control": []string{"private, max-age=300"},
+		},
+		Body:          ioutil.NopCloser(bytes.NewReader(script)),
+		ContentLength: int64(len(script)),
+	})
+}
+
+// refuseDirect refuses to proxy requests for destinations that the PAC file
+// tells clients to reach directly if the PAC file is enforced, so that the
+// proxy applies the same rules as the PAC file. Redirected connections aren't
+// subject to the PAC file.
+func (s *Server) refuseDirect(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	g := s.pacGenerator()
+	if g == nil || !g.Enforced() || (req.Method != http.MethodConnect && !req.URL.IsAbs()) {
+		return next(ctx, req)
+	}
+	if _, redirected := transparent.OriginalDst(ctx.DownstreamConn()); redirected {
+		return next(ctx, req)
+	}
+	if g.Action(pacClientIP(ctx, req), req.URL.Hostname()) != pac.Direct {
+		return next(ctx, req)
+	}
+	log.Debugf("Refusing to proxy %v for %v, which should reach it directly", req.URL.Host, req.RemoteAddr)
+	return filters.ShortCircuit(ctx, req, s.errorPages.Response(req, &utils.ErrorPage{
+		Status:    http.StatusForbidden,
+		Reason:    "direct_destination",
+		RequestID: utils.RequestID(ctx),
+	}))
+}
+
+// pacClientIP returns the IP that picks the variation of the PAC file for the
+// client of req, see proxyfilters.ClientIP.
+func pacClientIP(ctx filters.Context, req *http.Request) net.IP {
+	return net.ParseIP(proxyfilters.ClientIP(ctx, req))
+}
+
+// UpdatePAC replaces the options of the PAC file, or stops serving it if opts
+// is nil.
+func (s *Server) UpdatePAC(opts *pac.Opts) error {
+	var g *pac.Generator
+	if opts != nil {
+		var err error
+		if g, err = pac.New(opts); err != nil {
+			return err
+		}
+	}
+	s.pacMx.Lock()
+	s.pac = g
+	s.pacMx.Unlock()
+	return nil
+}
+
+func (s *Server) pacGenerator() *pac.Generator {
+	s.pacMx.RLock()
+	defer s.pacMx.RUnlock()
+	return s.pac
+}
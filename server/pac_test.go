@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/pac"
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+func TestPAC(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("origin " + req.URL.Path))
+	}))
+	defer origin.Close()
+
+	pacOpts := &pac.Opts{
+		Rules: []pac.Rule{{Domain: "intranet.example", Action: pac.Direct}},
+		Variations: []pac.Variation{{
+			Clients: []string{"127.0.0.0/8"},
+			Rules:   []pac.Rule{{CIDR: "192.0.2.0/24", Action: pac.Direct}},
+		}},
+	}
+	srv := New(&Opts{PAC: pacOpts})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+	get := func(client *http.Client, url, host string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, script := get(http.DefaultClient, "http://"+addr+pac.Path, "")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, pac.ContentType, resp.Header.Get("Content-Type"))
+		assert.Equal(t, "private, max-age=300", resp.Header.Get("Cache-Control"), "shared caches shouldn't keep scripts for particular clients")
+	}
+	assert.Contains(t, script, `return "PROXY `+addr+`";`)
+	assert.Contains(t, script, `isInNet(host, "192.0.2.0", "255.255.255.0")`, "local clients should get their variation")
+	assert.Contains(t, script, `dnsDomainIs(host, ".intranet.example")) return "DIRECT"`)
+
+	_, script = get(http.DefaultClient, "http://"+addr+pac.WPADPath, "attacker.example:8080")
+	assert.Contains(t, script, `return "PROXY `+addr+`";`, "the address clients connected to should be advertised, whatever their Host")
+
+	// PAC files of other hosts are proxied
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	_, body := get(client, origin.URL+pac.Path, "")
+	assert.Equal(t, "origin "+pac.Path, body)
+
+	// Destinations that clients should reach directly are proxied unless the
+	// PAC file is enforced
+	resp, _ = get(client, "http://www.intranet.example/", "")
+	if assert.NotNil(t, resp) {
+		assert.NotEqual(t, http.StatusForbidden, resp.StatusCode, "PAC files shouldn't be enforced by default")
+	}
+	pacOpts.Enforce = true
+	if !assert.NoError(t, srv.UpdatePAC(pacOpts)) {
+		return
+	}
+	resp, _ = get(client, "http://www.intranet.example/", "")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	resp, _ = get(client, "http://192.0.2.1/", "")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, "variations should be enforced for their clients")
+	}
+
+	assert.Error(t, srv.UpdatePAC(&pac.Opts{Default: "block"}))
+	if assert.NoError(t, srv.UpdatePAC(&pac.Opts{Proxy: "proxy.example:8080", Default: pac.Direct})) {
+		_, script = get(http.DefaultClient, "http://"+addr+pac.Path, "")
+		assert.Equal(t, "function FindProxyForURL(url, host) {\n\thost = host.toLowerCase();\n\tvar isIP = /^[0-9.]+$/.test(host) || host.indexOf(\":\") >= 0;\n\treturn \"DIRECT\";\n}\n", script, "updated options should apply")
+	}
+}
+
+func TestPACTrustedClientIP(t *testing.T) {
+	forwarded, err := proxyfilters.Forwarded(&proxyfilters.ForwardedOpts{TrustedProxies: []string{"127.0.0.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := New(&Opts{
+		Filter: forwarded,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return nil, errors.New("not dialing %v", addr)
+		},
+		PAC: &pac.Opts{
+			Enforce: true,
+			Variations: []pac.Variation{{
+				Clients: []string{"203.0.113.0/24"},
+				Rules:   []pac.Rule{{CIDR: "192.0.2.0/24", Action: pac.Direct}},
+			}},
+		},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	status := func(forwardedFor string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://192.0.2.1/", nil)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, status("203.0.113.7"), "the variation should be picked by the trusted client IP")
+	assert.NotEqual(t, http.StatusForbidden, status(""), "other clients get the plain rules")
+}
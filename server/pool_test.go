@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/pool"
+)
+
+func TestUpstreamPool(t *testing.T) {
+	var conns int64
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	var dialsForClients int64
+	srv := New(&Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			if ctx.Value(activeConnKey) != nil || ctx.Value(clientIPKey) != nil {
+				atomic.AddInt64(&dialsForClients, 1)
+			}
+			return net.Dial(network, addr)
+		},
+		UpstreamPool: &pool.Opts{},
+	})
+	defer srv.Pool().Close()
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	// Each request comes from a new client connection
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		if !assert.NoError(t, req.WriteProxy(conn)) {
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		conn.Close()
+		assert.Equal(t, "hello", string(body))
+	}
+
+	assert.EqualValues(t, 1, atomic.LoadInt64(&conns), "clients should share the upstream connection")
+	assert.Zero(t, atomic.LoadInt64(&dialsForClients), "shared connections shouldn't be dialed on behalf of a client")
+	stats := srv.Pool().Stats()
+	assert.EqualValues(t, 3, stats.Requests)
+	assert.EqualValues(t, 2, stats.Reused)
+	assert.Nil(t, New(&Opts{}).Pool())
+}
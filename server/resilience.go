@@ -0,0 +1,60 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/resilience"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+// Breakers returns the circuit breakers for upstream destinations, or nil if
+// Opts.Resilience wasn't specified.
+func (s *Server) Breakers() *resilience.Breakers {
+	return s.breakers
+}
+
+// failFast records the request method for dial retries and answers requests
+// to destinations whose circuit is open without dialing them.
+func (s *Server) failFast(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	ctx = resilience.WithMethod(ctx, req.Method)
+	if err := s.breakers.Check(destination(req)); err != nil {
+		openErr, _ := resilience.AsCircuitOpen(err)
+		return s.circuitOpen(ctx, req, openErr), ctx, nil
+	}
+	return next(ctx, req)
+}
+
+// circuitOpen renders a 503 error page telling the client when to try again.
+func (s *Server) circuitOpen(ctx filters.Context, req *http.Request, openErr *resilience.CircuitOpenError) *http.Response {
+	resp := s.errorPages.Response(req, &utils.ErrorPage{
+		Status:    http.StatusServiceUnavailable,
+		Reason:    "circuit_open",
+		RequestID: utils.RequestID(ctx),
+	})
+	retryAfter := int(math.Ceil(openErr.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	resp.Header.Set("Retry-After", strconv.Itoa(retryAfter))
+	return resp
+}
+
+// destination returns the address that will be dialed for req.
+func destination(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err == nil {
+		return req.Host
+	}
+	port := "80"
+	if req.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(req.Host, port)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/resilience"
+)
+
+func TestCircuitOpen(t *testing.T) {
+	dials := 0
+	srv := New(&Opts{
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dials++
+			return nil, errors.New("connection refused")
+		},
+		Resilience: &resilience.Opts{FailureThreshold: 2, OpenTimeout: time.Minute},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	get := func() *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, "http://origin.test/", nil)
+		req.Header.Set("Accept", "application/json")
+		if !assert.NoError(t, req.WriteProxy(conn)) {
+			return nil
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get(); resp != nil {
+			assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		}
+	}
+	resp := get()
+	if resp != nil {
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	}
+	assert.Equal(t, 2, dials, "open circuit should fail fast")
+
+	stats := srv.Breakers().Stats()
+	if assert.Len(t, stats.Circuits, 1) {
+		assert.Equal(t, "origin.test:80", stats.Circuits[0].Destination)
+		assert.Equal(t, resilience.Open, stats.Circuits[0].State)
+	}
+	assert.Nil(t, New(&Opts{}).Breakers())
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/reverse"
+	"github.com/getlantern/http-proxy/utils"
+)
+
+// reverseProxy applies the filter of the reverse proxy, answering requests
+// that it can't route with an error page instead of closing their
+// connection.
+func (s *Server) reverseProxy(route filters.Filter) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		resp, ctx, err := route.Apply(ctx, req, next)
+		if routeErr, ok := reverse.AsError(err); ok && resp == nil {
+			return s.errorPages.Response(req, &utils.ErrorPage{
+				Status:    routeErr.Status,
+				Reason:    routeErr.Reason,
+				RequestID: utils.RequestID(ctx),
+			}), ctx, nil
+		}
+		return resp, ctx, err
+	})
+}
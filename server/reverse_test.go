@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/reverse"
+)
+
+func TestReverse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("backend " + req.Host + req.URL.Path + " " + req.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("origin " + req.URL.Path))
+	}))
+	defer origin.Close()
+
+	srv := New(&Opts{
+		Reverse: &reverse.Opts{
+			Routes: []reverse.Route{{Host: "app.example.com", Pool: "app"}},
+			Pools:  []*reverse.PoolOpts{{Name: "app", Backends: []string{backend.URL}}},
+		},
+	})
+	if !assert.NotNil(t, srv.Reverse()) {
+		return
+	}
+	ready := make(chan string)
+	go srv.ListenAndServeHTTPS("localhost:0", keyFile, certFile, func(addr string) { ready <- addr })
+	addr := <-ready
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	get := func(host, path string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+addr+path, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("app.example.com", "/index.html")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "backend app.example.com/index.html https", body, "TLS should be terminated by the proxy")
+	_, body = get("app.example.com", "/healthz")
+	assert.Equal(t, "backend app.example.com/healthz https", body, "routed health checks should go to backends")
+	status, _ = get("unknown.example.com", "/")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Forward proxying keeps working
+	proxyURL, _ := url.Parse("https://" + addr)
+	forward := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig}}
+	resp, err := forward.Get(origin.URL + "/forwarded")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "origin /forwarded", string(body))
+	}
+
+	if stats := srv.Reverse().Stats(); assert.Len(t, stats, 1) {
+		assert.EqualValues(t, 2, stats[0].Requests)
+	}
+}
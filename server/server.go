@@ -2,11 +2,12 @@ package server
 
 import (
 	"context"
-	"io/ioutil"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -15,10 +16,26 @@ import (
 	"github.com/getlantern/proxy"
 	"github.com/getlantern/proxy/filters"
 	"github.com/getlantern/tlsdefaults"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/http2"
 
+	"github.com/getlantern/http-proxy/dialer"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/pac"
+	"github.com/getlantern/http-proxy/pool"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resilience"
+	"github.com/getlantern/http-proxy/reverse"
+	"github.com/getlantern/http-proxy/tracing"
+	"github.com/getlantern/http-proxy/transparent"
+	"github.com/getlantern/http-proxy/utils"
+	"github.com/getlantern/http-proxy/websocket"
 )
 
+// UpstreamFamilyKey is the key of the measured context under which the address
+// family ("ipv4" or "ipv6") of the latest upstream connection is recorded.
+const UpstreamFamilyKey = "upstream_family"
+
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
@@ -29,11 +46,86 @@ type ListenerGenerator func(net.Listener) net.Listener
 
 // Opts are used to configure a Server
 type Opts struct {
-	IdleTimeout  time.Duration
+	// IdleTimeout is how long client connections may be idle. It's advertised
+	// to clients in Keep-Alive headers and enforced by wrapping listeners with
+	// listeners.NewIdleConnListener.
+	IdleTimeout time.Duration
+
+	// UpstreamIdleTimeout, if positive, closes upstream connections, including
+	// those of CONNECT tunnels, that have been idle for this long.
+	UpstreamIdleTimeout time.Duration
+
+	// DialTimeout, if positive, limits how long each upstream dial may take,
+	// including resolving the destination.
+	DialTimeout time.Duration
+
+	// RequestHeaderTimeout, if positive, limits how long clients may take to
+	// send a complete request header once they've started sending it. This
+	// is the only deadline for request headers. Clients that don't start
+	// sending requests are left to the idle timeout.
+	RequestHeaderTimeout time.Duration
+
+	// TLSHandshakeTimeout, if positive, limits how long clients of
+	// ListenAndServeHTTPS may take to complete the TLS handshake. It also
+	// limits the handshakes of UpstreamPool and Reverse with https upstreams,
+	// unless they set their own.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout, if positive, limits how long upstreams may take to
+	// send the response header of plain HTTP requests, including the time to
+	// dial them. Requests that time out are answered with 504 Gateway Timeout.
+	ResponseHeaderTimeout time.Duration
+
+	// MaxTunnelLifetime, if positive, closes CONNECT tunnels that have been
+	// open for this long, irrespective of activity.
+	MaxTunnelLifetime time.Duration
+
+	// HTTP2 enables HTTP/2 for clients of ListenAndServeHTTPS that negotiate it
+	// with ALPN, which lets them multiplex requests and CONNECT tunnels over a
+	// single connection.
+	HTTP2 bool
+
 	BufferSource proxy.BufferSource
 	Filter       filters.Filter
 	Dial         proxy.DialFunc
 
+	// Dialer configures the dialer used if Dial is unspecified, which races
+	// connections to all of an upstream's addresses (Happy Eyeballs).
+	Dialer *dialer.Opts
+
+	// Resilience, if specified, retries failed upstream dials and breaks the
+	// circuit to destinations that keep failing, answering requests to them
+	// with 503 Service Unavailable until they're probed again.
+	Resilience *resilience.Opts
+
+	// UpstreamPool, if specified, makes plain HTTP requests share a pool of
+	// upstream connections across all clients instead of each client
+	// connection using its own. Its Dial defaults to the server's, dialing
+	// on behalf of no particular client.
+	UpstreamPool *pool.Opts
+
+	// WebSocket, if specified, makes WebSocket handshakes in plain HTTP
+	// requests get validated, and the upgraded connections relayed frame by
+	// frame with the given limits instead of as opaque streams. Message
+	// counts are recorded in the measured context under
+	// WebSocketMessagesSentKey and WebSocketMessagesRecvKey.
+	WebSocket *websocket.Opts
+
+	// Reverse, if specified, makes the server a reverse proxy for
+	// origin-form requests, which are routed by Host and path to pools of
+	// backends instead of to their Host. Requests that match no route are
+	// answered with 404 Not Found. Clients of ListenAndServeHTTPS get TLS
+	// terminated by the server. Its Dial defaults to the server's.
+	Reverse *reverse.Opts
+
+	// PAC, if specified, makes the server serve a Proxy Auto-Config file
+	// generated from its rules at pac.Path and pac.WPADPath to clients that
+	// request it from the proxy itself. If pac.Opts.Enforce is set, the proxy
+	// also refuses requests for destinations that clients are told to reach
+	// directly. Unless the PAC file advertises a configured address, it
+	// advertises the address that clients connected to.
+	PAC *pac.Opts
+
 	// OKDoesNotWaitForUpstream can be set to true in order to immediately return
 	// OK to CONNECT requests.
 	OKDoesNotWaitForUpstream bool
@@ -42,6 +134,29 @@ type Opts struct {
 	// error while proxying for the given client connection.
 	OnError func(conn net.Conn, err error)
 
+	// RequestID configures how request IDs are assigned. If unspecified, a new
+	// request ID is generated for every request.
+	RequestID *proxyfilters.RequestIDOpts
+
+	// ReadinessProbe, if specified, is checked whenever readiness is requested
+	// (see Server.Readiness). If it returns an error, the server reports that
+	// it's not ready. See HTTPProbe for probing an upstream URL.
+	ReadinessProbe func(ctx context.Context) error
+
+	// ReadinessProbeTimeout limits how long ReadinessProbe may take. Defaults
+	// to 5 seconds.
+	ReadinessProbeTimeout time.Duration
+
+	// ReadinessProbeInterval is how long the result of ReadinessProbe is
+	// reused for, so that frequent readiness checks don't translate into as
+	// many probes. Defaults to 1 second.
+	ReadinessProbeInterval time.Duration
+
+	// ErrorPages renders the responses sent to clients when proxying fails or
+	// a filter rejects a request. If unspecified, utils.DefaultErrorPages is
+	// used.
+	ErrorPages *utils.ErrorPages
+
 	// OnAcceptError is called when the server fails to accept a connection.
 	// If the error is fatal and should halt server operations, this callback
 	// should return an error. That error will be returned by functions like
@@ -59,43 +174,252 @@ type Server struct {
 	// from the given IP address. If unspecified, all connections are allowed.
 	Allow              func(string) bool
 	proxy              proxy.Proxy
+	filter             filters.Filter
+	dial               proxy.DialFunc
 	listenerGenerators []ListenerGenerator
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
+
+	conns               *connRegistry
+	dialer              *dialer.Dialer
+	pool                *pool.Pool
+	reverse             *reverse.Router
+	pac                 *pac.Generator
+	pacMx               sync.RWMutex
+	websocket           *websocket.Opts
+	breakers            *resilience.Breakers
+	errorPages          *utils.ErrorPages
+	limitedListeners    []listeners.LimitedListener
+	slowClientListeners []listeners.SlowClientListener
+	// headerTimeouts counts connections that timed out sending a request
+	// header
+	headerTimeouts int64
+	limitedMx      sync.RWMutex
+
+	http2                 bool
+	idleTimeout           time.Duration
+	requestHeaderTimeout  time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	maxTunnelLifetime     time.Duration
+
+	readinessProbe         func(ctx context.Context) error
+	readinessProbeTimeout  time.Duration
+	readinessProbeInterval time.Duration
+	probeMx                sync.Mutex
+	probeErr               error
+	probedAt               time.Time
+	// listening counts the listeners being served
+	listening int32
+	draining  int32
 }
 
 // New constructs a new HTTP proxy server using the given options
 func New(opts *Opts) *Server {
+	if opts.ErrorPages == nil {
+		opts.ErrorPages = utils.DefaultErrorPages
+	}
+	requestID, err := proxyfilters.RequestID(opts.RequestID)
+	if err != nil {
+		log.Errorf("Unable to configure request IDs, ignoring trusted proxies: %v", err)
+		requestID, _ = proxyfilters.RequestID(nil)
+	}
+	if opts.OnError == nil {
+		opts.OnError = func(conn net.Conn, err error) {}
+	}
+	if opts.OnAcceptError == nil {
+		opts.OnAcceptError = func(err error) (fatalErr error) { return err }
+	}
+	if opts.ReadinessProbeTimeout <= 0 {
+		opts.ReadinessProbeTimeout = defaultProbeTimeout
+	}
+	if opts.ReadinessProbeInterval <= 0 {
+		opts.ReadinessProbeInterval = defaultProbeInterval
+	}
+	s := &Server{
+		onError:                opts.OnError,
+		onAcceptError:          opts.OnAcceptError,
+		conns:                  newConnRegistry(),
+		readinessProbe:         opts.ReadinessProbe,
+		readinessProbeTimeout:  opts.ReadinessProbeTimeout,
+		readinessProbeInterval: opts.ReadinessProbeInterval,
+		errorPages:             opts.ErrorPages,
+		http2:                  opts.HTTP2,
+		idleTimeout:            opts.IdleTimeout,
+		requestHeaderTimeout:   opts.RequestHeaderTimeout,
+		tlsHandshakeTimeout:    opts.TLSHandshakeTimeout,
+		responseHeaderTimeout:  opts.ResponseHeaderTimeout,
+		maxTunnelLifetime:      opts.MaxTunnelLifetime,
+	}
+
+	if opts.PAC != nil {
+		if s.pac, err = pac.New(opts.PAC); err != nil {
+			log.Errorf("Unable to configure PAC file, not serving it: %v", err)
+		}
+	}
+
+	filter := filters.Join(filters.FilterFunc(s.useErrorPages), requestID, filters.FilterFunc(s.trackRequest), filters.FilterFunc(s.enforceTimeouts), filters.FilterFunc(s.answerHealth), filters.FilterFunc(s.servePAC), filters.FilterFunc(s.fillTransparentHost))
+	if chain, ok := opts.Filter.(filters.Chain); ok {
+		filter = filter.Append(chain...)
+	} else if opts.Filter != nil {
+		filter = filter.Append(opts.Filter)
+	}
+	// Follows Opts.Filter so that it sees the client IP of filters like
+	// Forwarded
+	filter = filter.Append(filters.FilterFunc(s.refuseDirect))
+	dial := opts.Dial
+	if dial == nil {
+		if opts.DialTimeout > 0 {
+			// The dialer enforces the timeout itself
+			dialerOpts := dialer.Opts{}
+			if opts.Dialer != nil {
+				dialerOpts = *opts.Dialer
+			}
+			dialerOpts.Timeout = opts.DialTimeout
+			opts.Dialer = &dialerOpts
+		}
+		s.dialer = dialer.New(opts.Dialer)
+		dial = s.dialer.Dial
+	} else if opts.DialTimeout > 0 {
+		dial = withDialTimeout(dial, opts.DialTimeout)
+	}
+	if opts.UpstreamIdleTimeout > 0 {
+		dial = withUpstreamIdleTimeout(dial, opts.UpstreamIdleTimeout)
+	}
+	if opts.Resilience != nil {
+		s.breakers = resilience.New(opts.Resilience)
+		dial = s.breakers.Dial(dial)
+		filter = filter.Append(filters.FilterFunc(s.failFast))
+	}
+	// Runs last so that it sees the client IP of filters like Forwarded
+	filter = filter.Append(filters.FilterFunc(trackClientIP))
+	dial = tracing.Dial(trackDial(dial))
+	chain := tracing.Chain(filter)
+	if opts.Reverse != nil {
+		if opts.Reverse.Dial == nil {
+			opts.Reverse.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, false, network, addr)
+			}
+		}
+		if opts.Reverse.IdleTimeout <= 0 {
+			opts.Reverse.IdleTimeout = opts.UpstreamIdleTimeout
+		}
+		if opts.Reverse.TLSHandshakeTimeout <= 0 {
+			opts.Reverse.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+		}
+		if s.reverse, err = reverse.New(opts.Reverse); err != nil {
+			log.Errorf("Unable to configure reverse proxy, disabling it: %v", err)
+		} else {
+			chain = chain.Append(s.reverseProxy(s.reverse.Filter()))
+		}
+	}
+	if opts.WebSocket != nil {
+		s.websocket = opts.WebSocket
+		chain = chain.Append(filters.FilterFunc(s.forwardWebSocket))
+	}
+	if opts.UpstreamPool != nil {
+		if opts.UpstreamPool.IdleTimeout <= 0 {
+			opts.UpstreamPool.IdleTimeout = opts.UpstreamIdleTimeout
+		}
+		if opts.UpstreamPool.TLSHandshakeTimeout <= 0 {
+			opts.UpstreamPool.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+		}
+		if opts.UpstreamPool.Dial == nil {
+			opts.UpstreamPool.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				// Pooled connections are shared, so they're not dialed on
+				// behalf of the client whose request happens to dial them
+				return dial(withoutClient(ctx), false, network, addr)
+			}
+		}
+		s.pool = pool.New(opts.UpstreamPool)
+		chain = chain.Append(s.pool.Filter())
+	}
 	p, _ := proxy.New(&proxy.Opts{
 		IdleTimeout:         opts.IdleTimeout,
-		Dial:                opts.Dial,
-		Filter:              opts.Filter,
+		Dial:                dial,
+		Filter:              chain,
 		BufferSource:        opts.BufferSource,
 		OKWaitsForUpstream:  !opts.OKDoesNotWaitForUpstream,
 		OKSendsServerTiming: true,
-		OnError: func(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
-			status := http.StatusBadGateway
-			if read {
-				status = http.StatusBadRequest
-			}
-			return &http.Response{
-				Request:    req,
-				StatusCode: status,
-				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
-			}
-		},
+		OnError:             s.errorResponse,
 	})
+	s.proxy = p
+	s.filter = chain
+	s.dial = dial
+	return s
+}
 
-	if opts.OnError == nil {
-		opts.OnError = func(conn net.Conn, err error) {}
+// useErrorPages makes the filters that follow render failures with the
+// server's error pages.
+func (s *Server) useErrorPages(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	return next(utils.WithErrorPages(ctx, s.errorPages), req)
+}
+
+// errorResponse renders the response to a request that failed with err, read
+// being true if the request itself couldn't be read.
+func (s *Server) errorResponse(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
+	page := &utils.ErrorPage{
+		Status:    http.StatusBadGateway,
+		Reason:    "bad_gateway",
+		RequestID: utils.RequestID(ctx),
 	}
-	if opts.OnAcceptError == nil {
-		opts.OnAcceptError = func(err error) (fatalErr error) { return err }
+	if read {
+		page.Status = http.StatusBadRequest
+		page.Reason = "bad_request"
+	} else if openErr, ok := resilience.AsCircuitOpen(err); ok {
+		return s.circuitOpen(ctx, req, openErr)
+	} else if isTimeout(err) {
+		page.Status = http.StatusGatewayTimeout
+		page.Reason = "gateway_timeout"
 	}
-	return &Server{
-		proxy:         p,
-		onError:       opts.OnError,
-		onAcceptError: opts.OnAcceptError,
+	return s.errorPages.Response(req, page)
+}
+
+// Dialer returns the dialer used for upstream connections, or nil if Opts.Dial
+// was specified.
+func (s *Server) Dialer() *dialer.Dialer {
+	return s.dialer
+}
+
+// Pool returns the pool of upstream connections, or nil if
+// Opts.UpstreamPool wasn't specified.
+func (s *Server) Pool() *pool.Pool {
+	return s.pool
+}
+
+// Reverse returns the router of the reverse proxy, or nil if Opts.Reverse
+// wasn't specified or was invalid.
+func (s *Server) Reverse() *reverse.Router {
+	return s.reverse
+}
+
+// trackClientIP records the trusted client IP of the request, see
+// proxyfilters.ClientIP, for trackDial.
+func trackClientIP(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	return next(ctx.WithValue(clientIPKey, proxyfilters.ClientIP(ctx, req)), req)
+}
+
+// trackDial tells the dialer which client it's dialing for, see
+// dialer.WithClient, and records the address family of upstream connections in
+// the measured context of the client connection under UpstreamFamilyKey. The
+// client IP is the trusted one recorded by trackClientIP, if any, rather than
+// the IP of the peer, which may be a load balancer or another proxy.
+func trackDial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		if ac, ok := ctx.Value(activeConnKey).(*activeConn); ok {
+			clientIP, ok := ctx.Value(clientIPKey).(string)
+			if !ok {
+				clientIP = ac.clientIP
+			}
+			ctx = dialer.WithClient(ctx, clientIP, ac.getUser())
+		}
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err == nil {
+			if family := dialer.FamilyOf(conn.RemoteAddr()); family != "" {
+				updateMeasuredContext(ctx, listeners.UpdateMeasuredContext{UpstreamFamilyKey: family})
+			}
+		}
+		return conn, err
 	}
 }
 
@@ -120,10 +444,14 @@ func (s *Server) ListenAndServeHTTPS(addr, keyfile, certfile string, readyCb fun
 		return err
 	}
 
-	listener, err := tlsdefaults.NewListener(s.wrapListenerIfNecessary(l), keyfile, certfile)
+	cfg, err := tlsdefaults.BuildListenerConfig(l.Addr().String(), keyfile, certfile)
 	if err != nil {
 		return err
 	}
+	if s.http2 {
+		cfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	listener := tls.NewListener(s.wrapListenerIfNecessary(l), cfg)
 	log.Debugf("Listen https on %s", addr)
 	return s.serve(listener, readyCb)
 }
@@ -133,12 +461,10 @@ func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 }
 
 func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
-	l := listeners.NewDefaultListener(listener)
-
-	for _, wrap := range s.listenerGenerators {
-		l = wrap(l)
-	}
+	l := s.applyListenerWrappers(listener)
 
+	atomic.AddInt32(&s.listening, 1)
+	defer atomic.AddInt32(&s.listening, -1)
 	if readyCb != nil {
 		readyCb(l.Addr().String())
 	}
@@ -169,6 +495,26 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 	}
 }
 
+// applyListenerWrappers wraps l with the listener wrappers, keeping track of
+// the limited and slow client listeners among them.
+func (s *Server) applyListenerWrappers(listener net.Listener) net.Listener {
+	l := listeners.NewDefaultListener(listener)
+	for _, wrap := range s.listenerGenerators {
+		l = wrap(l)
+		if ll, ok := l.(listeners.LimitedListener); ok {
+			s.limitedMx.Lock()
+			s.limitedListeners = append(s.limitedListeners, ll)
+			s.limitedMx.Unlock()
+		}
+		if sl, ok := l.(listeners.SlowClientListener); ok {
+			s.limitedMx.Lock()
+			s.slowClientListeners = append(s.slowClientListeners, sl)
+			s.limitedMx.Unlock()
+		}
+	}
+	return l
+}
+
 func (s *Server) handle(conn net.Conn) {
 	wrapConn, isWrapConn := conn.(listeners.WrapConn)
 	if isWrapConn {
@@ -177,6 +523,21 @@ func (s *Server) handle(conn net.Conn) {
 	go s.doHandle(conn, isWrapConn, wrapConn)
 }
 
+// handshake performs the TLS handshake of conn, if it's a TLS connection,
+// within the TLS handshake timeout.
+func (s *Server) handshake(ctx context.Context, conn net.Conn) error {
+	if s.tlsHandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.tlsHandshakeTimeout)
+		defer cancel()
+	}
+	err := tracing.Handshake(ctx, conn)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		log.Debugf("Closing connection from %v that didn't complete the TLS handshake within %v", conn.RemoteAddr(), s.tlsHandshakeTimeout)
+	}
+	return err
+}
+
 func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.WrapConn) {
 	clientIP := ""
 	remoteAddr := conn.RemoteAddr()
@@ -197,7 +558,36 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 		}
 	}()
 
-	err := s.proxy.Handle(context.Background(), conn, conn)
+	ac := s.conns.add(conn)
+	defer s.conns.remove(ac)
+
+	ctx, span := tracing.Start(withActiveConn(proxyfilters.WithOp(context.Background(), op), ac), "accept",
+		attribute.String("client_ip", clientIP))
+	var err error
+	if tracing.Enabled() || s.http2 || s.tlsHandshakeTimeout > 0 {
+		// Handshake up front to trace it, to learn the negotiated protocol and
+		// to limit how long it takes. Otherwise, the handshake happens on the
+		// first read.
+		err = s.handshake(ctx, conn)
+	}
+	switch {
+	case err != nil:
+		safeClose(conn)
+	case s.http2 && negotiatedProtocol(conn) == http2.NextProtoTLS:
+		s.serveHTTP2(ctx, ac, conn)
+	default:
+		ac.timeouts = newConnTimeouts(conn, s.requestHeaderTimeout)
+		ac.timeouts.onHeaderTimeout = func() { atomic.AddInt64(&s.headerTimeouts, 1) }
+		if dst, ok := transparent.OriginalDst(conn); ok {
+			err = s.handleTransparent(ctx, ac, conn, dst)
+		} else if isSNIConn(conn) {
+			err = s.handleSNI(ctx, ac, conn)
+		} else {
+			err = s.proxy.Handle(ctx, ac.timeouts, conn)
+		}
+		ac.timeouts.stop()
+	}
+	tracing.End(span, err)
 	if err != nil {
 		op.FailIf(errors.New("Error handling connection from %v: %v", conn.RemoteAddr(), err))
 		s.onError(conn, err)
@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,6 +27,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
 )
 
 const (
@@ -41,6 +44,9 @@ var (
 	tlsOriginURL     string
 
 	serverCertificate *keyman.Certificate
+	// keyFile and certFile are generated in a temporary directory on first use
+	keyFile  string
+	certFile string
 	// TODO: this should be imported from tlsdefaults package, but is not being
 	// exported there.
 	preferredCipherSuites = []uint16{
@@ -59,7 +65,18 @@ var (
 
 func TestMain(m *testing.M) {
 	flag.Parse()
-	var err error
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	keyDir, err := ioutil.TempDir("", "http-proxy-test")
+	if err != nil {
+		log.Errorf("Unable to create directory for key material: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(keyDir)
+	keyFile = filepath.Join(keyDir, "key.pem")
+	certFile = filepath.Join(keyDir, "cert.pem")
 
 	// Set up mock origin servers
 	httpOriginURL, httpOriginServer = newOriginHandler(originResponse, false)
@@ -71,17 +88,17 @@ func TestMain(m *testing.M) {
 	httpProxyAddr, err = setupNewHTTPServer(0, 30*time.Second)
 	if err != nil {
 		log.Error("Error starting proxy server")
-		os.Exit(1)
+		return 1
 	}
 
 	// Set up HTTPS chained server
 	tlsProxyAddr, err = setupNewHTTPSServer(0, 30*time.Second)
 	if err != nil {
 		log.Error("Error starting proxy server")
-		os.Exit(1)
+		return 1
 	}
 
-	os.Exit(m.Run())
+	return m.Run()
 }
 
 func TestMaxConnections(t *testing.T) {
@@ -540,7 +557,7 @@ func setupNewHTTPSServer(maxConns uint64, idleTimeout time.Duration) (string, er
 		ready <- addr
 	}
 	go func(err *error) {
-		if *err = s.ListenAndServeHTTPS("localhost:0", "key.pem", "cert.pem", wait); err != nil {
+		if *err = s.ListenAndServeHTTPS("localhost:0", keyFile, certFile, wait); err != nil {
 			log.Errorf("Unable to serve: %v", err)
 		}
 	}(&err)
@@ -548,7 +565,7 @@ func setupNewHTTPSServer(maxConns uint64, idleTimeout time.Duration) (string, er
 	if err != nil {
 		return "", err
 	}
-	serverCertificate, err = keyman.LoadCertificateFromFile("cert.pem")
+	serverCertificate, err = keyman.LoadCertificateFromFile(certFile)
 	return addr, err
 }
 
@@ -619,6 +636,39 @@ func (m *originHandler) Close() {
 	m.server.Close()
 }
 
+func TestDialTrustedClientIP(t *testing.T) {
+	forwarded, err := proxyfilters.Forwarded(&proxyfilters.ForwardedOpts{TrustedProxies: []string{"127.0.0.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientIPs := make(chan string, 1)
+	srv := New(&Opts{
+		Filter: forwarded,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			clientIP, _ := ctx.Value(clientIPKey).(string)
+			clientIPs <- clientIP
+			return net.Dial(network, addr)
+		},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, httpOriginURL, nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.WriteProxy(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "203.0.113.7", <-clientIPs, "upstream connections should be dialed for the trusted client IP")
+	}
+}
+
 func newOriginHandler(msg string, tls bool) (string, *originHandler) {
 	m := originHandler{}
 	m.Msg(msg)
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+func TestSlowClients(t *testing.T) {
+	echo, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	srv := New(&Opts{RequestHeaderTimeout: 200 * time.Millisecond})
+	srv.AddListenerWrappers(func(ls net.Listener) net.Listener {
+		return listeners.NewSlowClientListener(ls, &listeners.SlowClientOpts{
+			MinBytesPerSecond: 100,
+			Window:            200 * time.Millisecond,
+		})
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	closedWithin := func(conn net.Conn, timeout time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := io.Copy(ioutil.Discard, conn)
+		return err == nil
+	}
+
+	// Trickling the request header is left to the request header timeout,
+	// which counts it
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\n"))
+	assert.True(t, closedWithin(conn, time.Second))
+	conn.Close()
+
+	connect := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+echo.Addr().String(), nil)
+		req.Write(conn)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return nil, nil
+		}
+		return conn, br
+	}
+
+	// Idle tunnels are left alone
+	conn, br := connect()
+	if conn == nil {
+		return
+	}
+	time.Sleep(time.Second)
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err, "idle tunnel should stay open")
+
+	// Tunnels trickling data aren't
+	start := time.Now()
+	for time.Since(start) < time.Second {
+		if _, err := conn.Write([]byte("p")); err != nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, closedWithin(conn, time.Second), "trickling tunnel should be closed")
+	conn.Close()
+
+	stats, ok := srv.SlowClientStats()
+	assert.True(t, ok)
+	assert.Equal(t, listeners.SlowClientStats{HeaderTimeouts: 1, SlowTransfers: 1}, stats)
+	_, ok = New(&Opts{}).SlowClientStats()
+	assert.False(t, ok)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+
+	"github.com/getlantern/http-proxy/transparent"
+)
+
+// sniPort is the port that TLS connections routed by server name are
+// tunneled to.
+const sniPort = "443"
+
+// ListenAndServeSNI listens on the given address, usually on port 443, for TLS
+// connections from clients that can't be configured to use a proxy, for
+// example because their DNS resolves origins to the proxy. Without
+// terminating TLS, each connection is tunneled to the server name in its
+// ClientHello on port 443, as if the client had sent a CONNECT to it, so that
+// the filters apply. Connections without a server name are closed.
+func (s *Server) ListenAndServeSNI(addr string, readyCb func(addr string)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Listen sni on %s", addr)
+	return s.serve(s.wrapListenerIfNecessary(&sniListener{l}), readyCb)
+}
+
+// handleSNI handles a connection accepted by ListenAndServeSNI.
+func (s *Server) handleSNI(ctx context.Context, ac *activeConn, conn net.Conn) error {
+	in := bufio.NewReaderSize(ac.timeouts, transparent.SniffBufferSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	protocol, serverName := transparent.Sniff(in)
+	conn.SetReadDeadline(time.Time{})
+	if protocol != transparent.TLS || serverName == "" || net.ParseIP(serverName) != nil {
+		conn.Close()
+		return errors.New("No server name in %v connection from %v", protocol, conn.RemoteAddr())
+	}
+	ac.timeouts.tunnel()
+	return s.tunnelSniffed(ctx, conn, in, net.JoinHostPort(serverName, sniPort))
+}
+
+// sniListener marks the connections it accepts as to be routed by server
+// name.
+type sniListener struct {
+	net.Listener
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniConn{conn}, nil
+}
+
+type sniConn struct {
+	net.Conn
+}
+
+func (c *sniConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// isSNIConn determines whether conn, or any connection it wraps, was accepted
+// by ListenAndServeSNI.
+func isSNIConn(conn net.Conn) bool {
+	found := false
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		_, found = wrapped.(*sniConn)
+		return !found
+	})
+	return found
+}
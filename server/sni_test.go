@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSNI(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.Host))
+	}))
+	defer origin.Close()
+
+	var dialed []string
+	srv := New(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			if req.Host == "blocked.test:443" {
+				return filters.Fail(ctx, req, http.StatusForbidden, errors.New("blocked"))
+			}
+			return next(ctx, req)
+		}),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return net.Dial(network, origin.Listener.Addr().String())
+		},
+	})
+	ready := make(chan string)
+	go srv.ListenAndServeSNI("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	get := func(serverName string) (string, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		req, _ := http.NewRequest(http.MethodGet, "https://"+serverName+"/", nil)
+		if err := req.Write(tlsConn); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), req)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(body), err
+	}
+
+	body, err := get("allowed.test")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello allowed.test", body, "TLS shouldn't be terminated")
+
+	_, err = get("blocked.test")
+	assert.Error(t, err, "filters should apply")
+
+	_, err = get("")
+	assert.Error(t, err, "connections without a server name can't be routed")
+
+	assert.Equal(t, []string{"allowed.test:443"}, dialed)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/idletiming"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+// timeoutError is a net.Error that reports a timeout enforced by the server.
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// isTimeout determines whether err was caused by a timeout.
+func isTimeout(err error) bool {
+	if rc, ok := err.(interface{ RootCause() error }); ok {
+		err = rc.RootCause()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// connTimeouts enforces the timeouts of a single client connection.
+type connTimeouts struct {
+	conn                 net.Conn
+	requestHeaderTimeout time.Duration
+	// awaitingRequest is 1 while the next read starts a new request
+	awaitingRequest int32
+	// readingHeader is 1 while the request header deadline is set
+	readingHeader int32
+	// onHeaderTimeout, if set, is called when the request header deadline
+	// passes
+	onHeaderTimeout func()
+
+	tunnelTimer *time.Timer
+	mx          sync.Mutex
+}
+
+func newConnTimeouts(conn net.Conn, requestHeaderTimeout time.Duration) *connTimeouts {
+	return &connTimeouts{conn: conn, requestHeaderTimeout: requestHeaderTimeout, awaitingRequest: 1}
+}
+
+// Read reads from the client connection. Once the first bytes of a request
+// arrive, the rest of its header has to arrive within the request header
+// timeout. Time spent waiting for the request to start is governed by the
+// idle timeout instead.
+func (t *connTimeouts) Read(b []byte) (int, error) {
+	n, err := t.conn.Read(b)
+	if n > 0 && t.requestHeaderTimeout > 0 && atomic.CompareAndSwapInt32(&t.awaitingRequest, 1, 0) {
+		atomic.StoreInt32(&t.readingHeader, 1)
+		t.conn.SetReadDeadline(time.Now().Add(t.requestHeaderTimeout))
+	}
+	if err != nil && isTimeout(err) && atomic.CompareAndSwapInt32(&t.readingHeader, 1, 0) {
+		log.Debugf("Closing connection from %v that didn't send its request header within %v", t.conn.RemoteAddr(), t.requestHeaderTimeout)
+		if t.onHeaderTimeout != nil {
+			t.onHeaderTimeout()
+		}
+	}
+	return n, err
+}
+
+// headerRead lifts the deadline for reading the request header once it has
+// been read.
+func (t *connTimeouts) headerRead() {
+	if t.requestHeaderTimeout > 0 {
+		atomic.StoreInt32(&t.readingHeader, 0)
+		t.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// awaitRequest makes the next read start the deadline for the next request's
+// header.
+func (t *connTimeouts) awaitRequest() {
+	atomic.StoreInt32(&t.awaitingRequest, 1)
+}
+
+// tunnel stops reads from starting the deadline for a request header, for
+// connections that won't carry any requests.
+func (t *connTimeouts) tunnel() {
+	atomic.StoreInt32(&t.awaitingRequest, 0)
+}
+
+// limitTunnel closes the connection once lifetime has elapsed.
+func (t *connTimeouts) limitTunnel(lifetime time.Duration) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.tunnelTimer != nil {
+		return
+	}
+	t.tunnelTimer = time.AfterFunc(lifetime, func() {
+		log.Debugf("Closing tunnel from %v after its maximum lifetime of %v", t.conn.RemoteAddr(), lifetime)
+		safeClose(t.conn)
+	})
+}
+
+// stop stops timers once the connection has been handled.
+func (t *connTimeouts) stop() {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.tunnelTimer != nil {
+		t.tunnelTimer.Stop()
+	}
+}
+
+// enforceTimeouts applies the request header, response header and tunnel
+// lifetime timeouts to each request.
+func (s *Server) enforceTimeouts(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	ac, ok := ctx.Value(activeConnKey).(*activeConn)
+	if !ok || ac.timeouts == nil {
+		return next(ctx, req)
+	}
+	t := ac.timeouts
+	t.headerRead()
+
+	if req.Method == http.MethodConnect {
+		resp, nextCtx, err := next(ctx, req)
+		if err == nil && resp != nil && resp.StatusCode == http.StatusOK && s.maxTunnelLifetime > 0 {
+			t.limitTunnel(s.maxTunnelLifetime)
+		}
+		return resp, nextCtx, err
+	}
+	if utils.IsUpgrade(req) {
+		// The connection won't carry any further requests
+		return next(ctx, req)
+	}
+	defer t.awaitRequest()
+	if s.responseHeaderTimeout <= 0 {
+		return next(ctx, req)
+	}
+
+	// The context is only canceled if the response header doesn't arrive in
+	// time, since the response body is read with it.
+	reqCtx, cancel := ctx.WithCancel()
+	var timedOut int32
+	timer := time.AfterFunc(s.responseHeaderTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	resp, nextCtx, err := next(reqCtx, req)
+	if !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, ctx, timeoutError(fmt.Sprintf("timed out after %v waiting for response header from %v", s.responseHeaderTimeout, req.Host))
+	}
+	return resp, nextCtx, err
+}
+
+// withDialTimeout limits how long each upstream dial may take.
+func withDialTimeout(dial proxy.DialFunc, timeout time.Duration) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, isCONNECT, network, addr)
+	}
+}
+
+// withUpstreamIdleTimeout closes upstream connections that have been idle for
+// longer than timeout. Since the client connection of a CONNECT tunnel is
+// useless without its upstream connection, it's closed too. WebSockets enforce
+// their own idle timeout, see Opts.WebSocket.
+func withUpstreamIdleTimeout(dial proxy.DialFunc, timeout time.Duration) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		if err != nil || ctx.Value(websocketKey) != nil {
+			return conn, err
+		}
+		var onIdle func()
+		if ac, ok := ctx.Value(activeConnKey).(*activeConn); ok && isCONNECT {
+			onIdle = func() {
+				log.Debugf("Closing tunnel from %v after upstream %v was idle for %v", ac.client, addr, timeout)
+				safeClose(ac.conn)
+			}
+		}
+		return idletiming.Conn(conn, timeout, onIdle), nil
+	}
+}
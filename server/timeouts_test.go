@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/pool"
+)
+
+func TestRequestHeaderTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	addr := startTimeoutServer(t, &Opts{RequestHeaderTimeout: 200 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// Waiting before a request is fine
+	time.Sleep(300 * time.Millisecond)
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	if !assert.NoError(t, req.WriteProxy(conn)) {
+		return
+	}
+	resp, err := http.ReadResponse(br, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+
+	// And so is waiting between requests, but not trickling a header
+	time.Sleep(300 * time.Millisecond)
+	start := time.Now()
+	for _, line := range []string{"GET " + origin.URL + " HTTP/1.1\r\n", "Host: " + origin.Listener.Addr().String() + "\r\n", "X-Slow: 1\r\n"} {
+		if _, err := conn.Write([]byte(line)); err != nil {
+			break
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = br.ReadByte()
+	assert.Equal(t, io.EOF, err, "connection should have been closed")
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// A slow body is fine
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	addr := startTimeoutServer(t, &Opts{ResponseHeaderTimeout: 200 * time.Millisecond})
+
+	resp := proxyGet(t, addr, origin.URL+"/fast")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp = proxyGet(t, addr, origin.URL+"/slow")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	addr := startTimeoutServer(t, &Opts{
+		DialTimeout: 100 * time.Millisecond,
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	start := time.Now()
+	resp := proxyGet(t, addr, "http://origin.test/")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	}
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+}
+
+func TestTunnelTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	for _, opts := range []*Opts{{MaxTunnelLifetime: 300 * time.Millisecond}, {UpstreamIdleTimeout: 300 * time.Millisecond}} {
+		addr := startTimeoutServer(t, opts)
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+l.Addr().String(), nil)
+		req.Write(conn)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+
+		start := time.Now()
+		buf := make([]byte, 4)
+		if opts.MaxTunnelLifetime > 0 {
+			// Activity doesn't keep the tunnel open
+			for i := 0; i < 3; i++ {
+				conn.Write([]byte("ping"))
+				_, err := io.ReadFull(br, buf)
+				assert.NoError(t, err)
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = br.Read(buf)
+		assert.Equal(t, io.EOF, err, "tunnel should have been closed")
+		elapsed := time.Since(start)
+		assert.True(t, elapsed > 200*time.Millisecond && elapsed < time.Second, "took %v", elapsed)
+		conn.Close()
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	opts := &Opts{TLSHandshakeTimeout: 200 * time.Millisecond, UpstreamPool: &pool.Opts{}}
+	srv := New(opts)
+	defer srv.Pool().Close()
+	assert.Equal(t, 200*time.Millisecond, opts.UpstreamPool.TLSHandshakeTimeout, "the pool should default to the server's timeout")
+	ready := make(chan string)
+	go srv.ListenAndServeHTTPS("localhost:0", keyFile, certFile, func(addr string) { ready <- addr })
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "connection should be closed without a handshake")
+	assert.True(t, time.Since(start) < time.Second, "took %v", time.Since(start))
+
+	// Handshakes completed in time are fine
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if assert.NoError(t, err) {
+		tlsConn.Close()
+	}
+}
+
+func startTimeoutServer(t *testing.T, opts *Opts) string {
+	srv := New(opts)
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	return <-ready
+}
+
+func proxyGet(t *testing.T, addr, url string) *http.Response {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if !assert.NoError(t, req.WriteProxy(conn)) {
+		return nil
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/transparent"
+)
+
+// sniffTimeout limits how long redirected clients may take to send their
+// first bytes before their connection is tunneled to its original destination
+// without knowing its protocol, as needed for protocols where servers speak
+// first.
+const sniffTimeout = 2 * time.Second
+
+// ListenAndServeTransparent listens on the given address for connections
+// redirected by iptables, see transparent.Listen, and proxies them without
+// clients being configured to use the proxy. HTTP requests are proxied like
+// any other. Other connections are tunneled as if the client had sent a
+// CONNECT to the server name in their TLS ClientHello, or if there is none,
+// the original destination. Either way, requests go through the filters.
+func (s *Server) ListenAndServeTransparent(addr string, tproxy bool, readyCb func(addr string)) error {
+	l, err := transparent.Listen(addr, tproxy)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Listen transparent on %s", addr)
+	return s.serve(s.wrapListenerIfNecessary(l), readyCb)
+}
+
+// handleTransparent handles a redirected connection.
+func (s *Server) handleTransparent(ctx context.Context, ac *activeConn, conn net.Conn, dst *net.TCPAddr) error {
+	in := bufio.NewReaderSize(ac.timeouts, transparent.SniffBufferSize)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	protocol, serverName := transparent.Sniff(in)
+	conn.SetReadDeadline(time.Time{})
+	log.Tracef("Sniffed %v to %v from %v, server name %q", protocol, dst, conn.RemoteAddr(), serverName)
+
+	if protocol == transparent.HTTP {
+		// The header timeout applies once the client has started a request
+		ac.timeouts.awaitRequest()
+		sniffed := &sniffedConn{Conn: conn, in: in}
+		return s.proxy.Handle(ctx, sniffed, sniffed)
+	}
+	ac.timeouts.tunnel()
+	host := dst.IP.String()
+	if serverName != "" {
+		host = serverName
+	}
+	return s.tunnelSniffed(ctx, conn, in, net.JoinHostPort(host, strconv.Itoa(dst.Port)))
+}
+
+// tunnelSniffed tunnels a sniffed connection to target as if the client had
+// sent a CONNECT to it.
+func (s *Server) tunnelSniffed(ctx context.Context, conn net.Conn, in io.Reader, target string) error {
+	connect := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", target, target)
+	tunnel := &sniffedConn{Conn: conn, in: io.MultiReader(strings.NewReader(connect), in), awaitingResponse: true}
+	return s.proxy.Handle(ctx, tunnel, tunnel)
+}
+
+// sniffedConn reads from a redirected connection through the reader that
+// sniffed it, since tunnels read from the connection itself. For tunnels, the
+// reader starts with a synthesized CONNECT request, and the response to it is
+// kept from the client, closing the connection unless it's 200 OK.
+type sniffedConn struct {
+	net.Conn
+	in               io.Reader
+	awaitingResponse bool
+	response         []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *sniffedConn) Write(b []byte) (int, error) {
+	if !c.awaitingResponse {
+		return c.Conn.Write(b)
+	}
+	c.response = append(c.response, b...)
+	end := bytes.Index(c.response, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	c.awaitingResponse = false
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.response[:end+4])), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		c.Conn.Close()
+		return 0, errors.New("Tunnel from %v refused: %v", c.RemoteAddr(), string(c.response[:bytes.IndexByte(c.response, '\r')]))
+	}
+	if rest := c.response[end+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.response = nil
+	return len(b), nil
+}
+
+func (c *sniffedConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// fillTransparentHost makes plain HTTP requests on redirected connections go
+// to their original destination if they don't name a host, and to its port
+// if they name a host without one.
+func (s *Server) fillTransparentHost(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	dst, ok := transparent.OriginalDst(ctx.DownstreamConn())
+	if !ok || req.Method == http.MethodConnect {
+		return next(ctx, req)
+	}
+	port := strconv.Itoa(dst.Port)
+	if req.Host == "" {
+		req.Host = net.JoinHostPort(dst.IP.String(), port)
+	} else if _, _, err := net.SplitHostPort(req.Host); err != nil && port != "80" {
+		req.Host = net.JoinHostPort(strings.Trim(req.Host, "[]"), port)
+	}
+	req.URL.Host = req.Host
+	return next(ctx, req)
+}
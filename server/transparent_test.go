@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/transparent"
+)
+
+func TestTransparent(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello " + req.Host + req.URL.Path))
+	}))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("secure " + req.URL.Path))
+	}))
+	defer tlsOrigin.Close()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	var targets []string
+	srv := New(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			targets = append(targets, req.Method+" "+req.Host)
+			return next(ctx, req)
+		}),
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Stands in for iptables, redirecting connections to the current dst
+	var dst atomic.Value
+	ready := make(chan string)
+	go srv.Serve(&redirectingListener{l, &dst}, func(addr string) { ready <- addr })
+	addr := <-ready
+	dial := func(to string) net.Conn {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", to)
+		dst.Store(tcpAddr)
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return conn
+	}
+
+	// Plain HTTP, without a port in the Host header
+	originAddr := origin.Listener.Addr().String()
+	conn := dial(originAddr)
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /plain HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello "+originAddr+"/plain", string(body))
+	}
+	_, err = conn.Write([]byte("GET /healthz HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "hello "+originAddr+"/healthz", string(body), "the proxy's own endpoints shouldn't shadow the original destination's")
+	}
+
+	// TLS, addressed by its server name
+	_, port, _ := net.SplitHostPort(tlsOrigin.Listener.Addr().String())
+	conn = dial(tlsOrigin.Listener.Addr().String())
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+	req, _ := http.NewRequest(http.MethodGet, "https://localhost:"+port+"/secret", nil)
+	if !assert.NoError(t, req.Write(tlsConn)) {
+		return
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "secure /secret", string(body))
+	}
+
+	// Anything else goes to the original destination
+	conn = dial(echo.Addr().String())
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("\x00ping"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "\x00ping", string(buf))
+
+	assert.Equal(t, []string{
+		"GET " + originAddr,
+		"GET " + originAddr,
+		"CONNECT localhost:" + port,
+		"CONNECT " + echo.Addr().String(),
+	}, targets)
+}
+
+type redirectingListener struct {
+	net.Listener
+	dst *atomic.Value
+}
+
+func (l *redirectingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return transparent.NewConn(conn, l.dst.Load().(*net.TCPAddr)), nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/utils"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+// Keys of the measured context under which the number of WebSocket messages
+// sent to and received from the client are recorded.
+const (
+	WebSocketMessagesSentKey = "websocket_messages_sent"
+	WebSocketMessagesRecvKey = "websocket_messages_recv"
+)
+
+const (
+	websocketKey = ctxKey("websocket")
+
+	// websocketStatsInterval is how often message counts are recorded while a
+	// WebSocket is open
+	websocketStatsInterval = time.Second
+)
+
+// forwardWebSocket handles WebSocket handshakes itself rather than passing
+// them on, since the connection has to be relayed frame by frame once it's
+// upgraded (see websocket.Relay). Requests for other protocols and HTTP/2
+// streams are passed on.
+func (s *Server) forwardWebSocket(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	if req.Method == http.MethodConnect || req.ProtoMajor != 1 || !websocket.IsUpgrade(req) {
+		return next(ctx, req)
+	}
+	if err := websocket.ValidateHandshake(req); err != nil {
+		log.Debugf("Invalid WebSocket handshake from %v: %v", req.RemoteAddr, err)
+		page := &utils.ErrorPage{
+			Status:    http.StatusBadRequest,
+			Reason:    "bad_websocket_handshake",
+			RequestID: utils.RequestID(ctx),
+		}
+		if err == websocket.ErrUnsupportedVersion {
+			page.Status = http.StatusUpgradeRequired
+		}
+		resp := s.errorPages.Response(req, page)
+		if err == websocket.ErrUnsupportedVersion {
+			resp.Header.Set("Sec-WebSocket-Version", websocket.Version)
+		}
+		return resp, ctx, nil
+	}
+
+	upstream, err := s.dial(ctx.WithValue(websocketKey, true), false, "tcp", destination(req))
+	if err != nil {
+		return nil, ctx, err
+	}
+	if req.URL.Scheme == "https" {
+		host, _, _ := net.SplitHostPort(destination(req))
+		upstream = tls.Client(upstream, &tls.Config{ServerName: host})
+	}
+	upstreamIn := bufio.NewReader(upstream)
+	resp, err := websocketHandshake(upstream, upstreamIn, req)
+	if err != nil {
+		upstream.Close()
+		return nil, ctx, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The upstream declined, so its response is passed on and the client
+		// connection remains usable for further requests.
+		resp.Body = &closingBody{resp.Body, upstream}
+		return resp, ctx, nil
+	}
+	if err := websocket.ValidateResponse(req, resp); err != nil {
+		upstream.Close()
+		return nil, ctx, err
+	}
+
+	downstream := ctx.DownstreamConn()
+	if err := resp.Write(downstream); err != nil {
+		upstream.Close()
+		req.Close = true
+		return nil, ctx, nil
+	}
+	// The relay enforces its own idle timeout, which counts frames rather than
+	// bytes and is usually longer since WebSockets are long-lived.
+	ControlConn(ctx, listeners.SetIdleTimeout{Timeout: 0})
+
+	// Clients wait for the handshake to complete before sending frames, so
+	// nothing is left buffered from reading the request.
+	opts := *s.websocket
+	var relay *websocket.Relay
+	// The final counts have to be recorded before the client connection is
+	// closed, since closing it reports its measured stats for the last time.
+	client := &closeHookConn{Conn: downstream, beforeClose: func() {
+		recordWebSocketStats(ctx, relay.Stats())
+	}}
+	relay = websocket.NewRelay(client, nil, upstream, upstreamIn, &opts)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(websocketStatsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				recordWebSocketStats(ctx, relay.Stats())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	if err := relay.Run(); err != nil {
+		log.Debugf("Closed WebSocket from %v to %v: %v", req.RemoteAddr, req.Host, err)
+	}
+	close(stop)
+	wg.Wait()
+
+	// The connection has been taken over, so don't read further requests
+	req.Close = true
+	return nil, ctx, nil
+}
+
+// websocketHandshake sends the opening handshake req to upstream and reads
+// its response.
+func websocketHandshake(upstream net.Conn, upstreamIn *bufio.Reader, req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.Body = nil
+	for _, name := range []string{"Proxy-Connection", "Proxy-Authorization", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding"} {
+		out.Header.Del(name)
+	}
+	// Connection may list other headers than Upgrade, which are hop-by-hop
+	out.Header.Set("Connection", "Upgrade")
+	if err := out.Write(upstream); err != nil {
+		return nil, errors.New("Unable to send WebSocket handshake to %v: %v", req.Host, err)
+	}
+	resp, err := http.ReadResponse(upstreamIn, out)
+	if err != nil {
+		return nil, errors.New("Unable to read WebSocket handshake response from %v: %v", req.Host, err)
+	}
+	return resp, nil
+}
+
+func recordWebSocketStats(ctx filters.Context, stats websocket.Stats) {
+	updateMeasuredContext(ctx, listeners.UpdateMeasuredContext{
+		WebSocketMessagesSentKey: stats.MessagesSent,
+		WebSocketMessagesRecvKey: stats.MessagesRecv,
+	})
+}
+
+// closingBody closes the upstream connection along with the body read from
+// it.
+type closingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// closeHookConn calls beforeClose before closing the connection.
+type closeHookConn struct {
+	net.Conn
+	beforeClose func()
+}
+
+func (c *closeHookConn) Close() error {
+	c.beforeClose()
+	return c.Conn.Close()
+}
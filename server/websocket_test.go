@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer origin.Close()
+	go serveWebSocketEcho(origin)
+
+	var reportedMx sync.Mutex
+	var reportedSent, reportedRecv interface{}
+	final := make(chan bool, 1)
+	srv := New(&Opts{
+		UpstreamIdleTimeout: 100 * time.Millisecond,
+		WebSocket: &websocket.Opts{
+			MaxMessageSize: 100,
+			IdleTimeout:    time.Minute,
+		},
+	})
+	srv.AddListenerWrappers(
+		func(ls net.Listener) net.Listener {
+			return listeners.NewIdleConnListener(ls, 100*time.Millisecond)
+		},
+		func(ls net.Listener) net.Listener {
+			return listeners.NewMeasuredListener(ls, 10*time.Millisecond, func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, isFinal bool) {
+				if _, ok := ctx[WebSocketMessagesSentKey]; !ok {
+					return
+				}
+				reportedMx.Lock()
+				reportedSent, reportedRecv = ctx[WebSocketMessagesSentKey], ctx[WebSocketMessagesRecvKey]
+				reportedMx.Unlock()
+				if isFinal {
+					final <- true
+				}
+			})
+		},
+	)
+	ready := make(chan string)
+	go srv.ListenAndServeHTTP("localhost:0", func(addr string) { ready <- addr })
+	addr := <-ready
+
+	handshake := func(path, version string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil, nil, nil
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://"+origin.Addr().String()+path, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", version)
+		br := bufio.NewReader(conn)
+		if !assert.NoError(t, req.WriteProxy(conn)) {
+			conn.Close()
+			return nil, nil, nil
+		}
+		resp, err := http.ReadResponse(br, req)
+		if !assert.NoError(t, err) {
+			conn.Close()
+			return nil, nil, nil
+		}
+		return conn, br, resp
+	}
+
+	conn, _, resp := handshake("/chat", "8")
+	if assert.NotNil(t, conn) {
+		conn.Close()
+		assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+		assert.Equal(t, websocket.Version, resp.Header.Get("Sec-WebSocket-Version"))
+	}
+
+	conn, _, resp = handshake("/declined", websocket.Version)
+	if assert.NotNil(t, conn) {
+		conn.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	conn, br, resp := handshake("/chat", websocket.Version)
+	if !assert.NotNil(t, conn) {
+		return
+	}
+	defer conn.Close()
+	if !assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	for _, msg := range []string{"hello", "world"} {
+		// Longer than both the connection's and the upstream's idle timeouts
+		time.Sleep(200 * time.Millisecond)
+		if !assert.NoError(t, websocket.WriteFrame(conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Masked: true, Payload: []byte(msg)})) {
+			return
+		}
+		f, err := websocket.ReadFrame(br, 0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, msg, string(f.Payload))
+	}
+
+	websocket.WriteFrame(conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Masked: true, Payload: []byte(strings.Repeat("x", 101))})
+	f, err := websocket.ReadFrame(br, 0)
+	if assert.NoError(t, err) && assert.Equal(t, websocket.OpClose, f.Opcode) {
+		assert.Equal(t, []byte{0x03, 0xF1}, f.Payload[:2])
+	}
+
+	select {
+	case <-final:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "connection should have been closed")
+		return
+	}
+	reportedMx.Lock()
+	assert.EqualValues(t, 2, reportedSent)
+	assert.EqualValues(t, 2, reportedRecv)
+	reportedMx.Unlock()
+}
+
+// serveWebSocketEcho accepts WebSocket handshakes to /chat and echoes
+// messages, declining all other handshakes.
+func serveWebSocketEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.URL.Path != "/chat" || !websocket.IsUpgrade(req) {
+				conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+				return
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header: http.Header{
+					"Upgrade":              {"websocket"},
+					"Connection":           {"Upgrade"},
+					"Sec-Websocket-Accept": {websocket.AcceptKey(req.Header.Get("Sec-WebSocket-Key"))},
+				},
+			}
+			if resp.Write(conn) != nil {
+				return
+			}
+			for {
+				f, err := websocket.ReadFrame(br, 0)
+				if err != nil {
+					return
+				}
+				f.Masked = false
+				if websocket.WriteFrame(conn, f) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
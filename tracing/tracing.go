@@ -0,0 +1,277 @@
+// Package tracing provides OpenTelemetry tracing for proxied requests. Until
+// Init is called, spans are created using the global no-op tracer provider and
+// cost next to nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/getlantern/http-proxy/utils"
+)
+
+const (
+	instrumentationName = "github.com/getlantern/http-proxy"
+)
+
+var (
+	log = golog.LoggerFor("tracing")
+
+	propagator = propagation.TraceContext{}
+
+	// funcSuffix matches the suffix the runtime adds to the names of closures
+	funcSuffix = regexp.MustCompile(`(\.func\d+|-fm)+$`)
+
+	enabled int32
+)
+
+// Opts configures the export of traces.
+type Opts struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector.
+	Endpoint string
+
+	// URLPath overrides the default /v1/traces path on the collector.
+	URLPath string
+
+	// Insecure uses plain HTTP rather than HTTPS to talk to the collector.
+	Insecure bool
+
+	// Headers are added to every export request (e.g. for authentication).
+	Headers map[string]string
+
+	// ServiceName identifies this proxy in traces. Defaults to "http-proxy".
+	ServiceName string
+
+	// SampleRatio is the fraction of root spans to sample, between 0 and 1.
+	// Defaults to 1 (sample everything).
+	SampleRatio float64
+
+	// BatchTimeout is the maximum delay before spans are exported. Defaults to
+	// 5 seconds.
+	BatchTimeout time.Duration
+}
+
+// Init starts exporting traces via OTLP/HTTP to the configured collector and
+// installs the W3C trace context propagator. The returned function flushes
+// pending spans and stops the exporter.
+func Init(opts *Opts) (shutdown func(context.Context) error, err error) {
+	clientOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.URLPath != "" {
+		clientOpts = append(clientOpts, otlptracehttp.WithURLPath(opts.URLPath))
+	}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+	}
+	if len(opts.Headers) > 0 {
+		clientOpts = append(clientOpts, otlptracehttp.WithHeaders(opts.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = "http-proxy"
+	}
+	sampleRatio := opts.SampleRatio
+	if sampleRatio <= 0 {
+		sampleRatio = 1
+	}
+	batchTimeout := opts.BatchTimeout
+	if batchTimeout <= 0 {
+		batchTimeout = 5 * time.Second
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(batchTimeout)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	atomic.StoreInt32(&enabled, 1)
+	log.Debugf("Exporting traces to %v", opts.Endpoint)
+	return tp.Shutdown, nil
+}
+
+// Enabled tells whether Init has been called, i.e. whether traces are
+// exported at all.
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Tracer returns the tracer used for all proxy spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a new span as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, recording err if it's not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handshake performs the server-side TLS handshake on conn (if it is a TLS
+// connection) inside a span, so that handshake time shows up in traces.
+func Handshake(ctx context.Context, conn net.Conn) error {
+	var tlsConn *tls.Conn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		tlsConn, _ = wrapped.(*tls.Conn)
+		return tlsConn == nil
+	})
+	if tlsConn == nil {
+		return nil
+	}
+	_, span := Start(ctx, "tls_handshake")
+	err := tlsConn.HandshakeContext(ctx)
+	if err == nil {
+		state := tlsConn.ConnectionState()
+		span.SetAttributes(
+			attribute.String("tls.version", tls.VersionName(state.Version)),
+			attribute.String("tls.server_name", state.ServerName),
+			attribute.String("tls.alpn", state.NegotiatedProtocol),
+		)
+	}
+	End(span, err)
+	return err
+}
+
+// Chain wraps every filter in the given filter (or in each element of it, if
+// it's a filters.Chain) in its own span, and appends a final filter that
+// records the upstream round trip and propagates the trace context upstream.
+// The spans are children of a span for the whole request, which continues the
+// client's trace if the request carries a trace context.
+func Chain(filter filters.Filter) filters.Chain {
+	result := filters.Chain{filters.FilterFunc(request)}
+	if chain, ok := filter.(filters.Chain); ok {
+		for _, f := range chain {
+			result = append(result, Filter(f))
+		}
+	} else if filter != nil {
+		result = append(result, Filter(filter))
+	}
+	return result.Append(filters.FilterFunc(upstream))
+}
+
+// Filter wraps the given filter so that its processing is recorded in a span.
+// The span covers only the filter itself, not the filters that follow it.
+func Filter(filter filters.Filter) filters.Filter {
+	name := "filter " + filterName(filter)
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		parent := trace.SpanFromContext(ctx)
+		spanCtx, span := Start(ctx, name)
+		ended := false
+		resp, nextCtx, err := filter.Apply(filters.AdaptContext(spanCtx), req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+			// Hand the parent span back to the remaining filters so that they
+			// don't nest under this one.
+			span.End()
+			ended = true
+			return next(filters.AdaptContext(trace.ContextWithSpan(ctx, parent)), req)
+		})
+		if !ended {
+			span.SetAttributes(attribute.Bool("short_circuit", true))
+			if resp != nil {
+				span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			}
+			End(span, err)
+		}
+		return resp, nextCtx, err
+	})
+}
+
+// request records the request in a span. If the client sent a trace context
+// that the configured propagator can extract, the span continues that trace
+// and links to the span of the connection instead.
+func request(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	parent := context.Context(ctx)
+	var opts []trace.SpanStartOption
+	extracted := otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+	if remote := trace.SpanContextFromContext(extracted); remote.IsValid() && remote.IsRemote() {
+		parent = extracted
+		opts = append(opts, trace.WithLinks(trace.LinkFromContext(ctx)))
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.String("http.method", req.Method),
+		attribute.String("net.peer.name", req.Host)))
+	spanCtx, span := Tracer().Start(parent, "request", opts...)
+	resp, nextCtx, err := next(filters.AdaptContext(spanCtx), req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	End(span, err)
+	return resp, nextCtx, err
+}
+
+func upstream(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	name := "upstream"
+	if req.Method == http.MethodConnect {
+		name = "upstream CONNECT"
+	}
+	spanCtx, span := Start(ctx, name,
+		attribute.String("http.method", req.Method),
+		attribute.String("net.peer.name", req.Host),
+		attribute.String("request_id", utils.RequestID(ctx)))
+	if req.Method != http.MethodConnect {
+		propagator.Inject(spanCtx, propagation.HeaderCarrier(req.Header))
+	}
+	resp, nextCtx, err := next(filters.AdaptContext(spanCtx), req)
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	End(span, err)
+	return resp, nextCtx, err
+}
+
+// Dial wraps the given dial function so that connecting upstream is recorded
+// as a span.
+func Dial(dial proxy.DialFunc) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		ctx, span := Start(ctx, "dial", attribute.String("net.peer.addr", addr))
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		End(span, err)
+		return conn, err
+	}
+}
+
+func filterName(filter filters.Filter) string {
+	v := reflect.ValueOf(filter)
+	if v.Kind() == reflect.Func {
+		if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+			name := fn.Name()
+			name = name[strings.LastIndex(name, "/")+1:]
+			return funcSuffix.ReplaceAllString(name, "")
+		}
+	}
+	return reflect.TypeOf(filter).String()
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracing(t *testing.T) {
+	// Local stand-in for an OTLP collector
+	var mx sync.Mutex
+	spanNames := make(map[string]bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		exportReq := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, exportReq); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mx.Lock()
+		for _, rs := range exportReq.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spanNames[span.Name] = true
+				}
+			}
+		}
+		mx.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Write(resp)
+	}))
+	defer collector.Close()
+
+	shutdown, err := Init(&Opts{
+		Endpoint: collector.Listener.Addr().String(),
+		Insecure: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var traceparent string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	pl, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pl.Close()
+
+	noop := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		return next(ctx, req)
+	})
+	p, _ := proxy.New(&proxy.Opts{
+		Filter: Chain(filters.Join(noop)),
+		Dial: Dial(func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}),
+	})
+	go func() {
+		for {
+			conn, err := pl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ctx, span := Start(context.Background(), "accept")
+				p.Handle(ctx, conn, conn)
+				span.End()
+			}()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", pl.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil)
+	req.Close = true
+	// The client's trace is continued
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !assert.NoError(t, req.Write(conn)) {
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	conn.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Regexp(t, "^00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01$", traceparent)
+	assert.NotContains(t, traceparent, "b7ad6b7169203331", "the proxy's own span should be the parent upstream")
+
+	if !assert.NoError(t, shutdown(context.Background())) {
+		return
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	for _, name := range []string{"request", "filter tracing.TestTracing", "upstream", "dial"} {
+		assert.True(t, spanNames[name], "missing span %v in %v", name, spanNames)
+	}
+}
@@ -0,0 +1,97 @@
+package transparent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// Protocol is what clients speak on a redirected connection.
+type Protocol string
+
+const (
+	// HTTP is plain HTTP/1.x, whose requests carry their host in the Host
+	// header.
+	HTTP Protocol = "http"
+	// TLS is TLS, whose ClientHello may carry the server name (SNI).
+	TLS Protocol = "tls"
+	// Unknown is any other protocol, including ones where servers speak first.
+	Unknown Protocol = "unknown"
+)
+
+const (
+	// SniffBufferSize is the smallest buffer that Sniff can read a complete
+	// TLS record with the ClientHello into.
+	SniffBufferSize = recordHeaderLen + maxRecordLen
+
+	recordHeaderLen  = 5
+	maxRecordLen     = 16384
+	recordHandshake  = 0x16
+	handshakeMessage = 0x01
+)
+
+var errSniffed = errors.New("sniffed")
+
+// Sniff peeks at the first bytes sent by the client to determine its
+// protocol, and for TLS, the server name it asks for, if any. Nothing is
+// consumed from in, which should be at least SniffBufferSize large. Any
+// deadline for the client to start sending has to be set on the underlying
+// connection, and if it expires, the protocol is Unknown.
+func Sniff(in *bufio.Reader) (Protocol, string) {
+	first, err := in.Peek(1)
+	if err != nil {
+		return Unknown, ""
+	}
+	switch {
+	case first[0] == recordHandshake:
+		return TLS, sniffServerName(in)
+	case first[0] >= 'A' && first[0] <= 'Z':
+		// HTTP requests start with an upper case method
+		return HTTP, ""
+	default:
+		return Unknown, ""
+	}
+}
+
+// sniffServerName gets the server name from a ClientHello contained in the
+// first TLS record, letting crypto/tls do the parsing.
+func sniffServerName(in *bufio.Reader) string {
+	header, err := in.Peek(recordHeaderLen)
+	if err != nil {
+		return ""
+	}
+	length := int(header[3])<<8 | int(header[4])
+	if length > maxRecordLen {
+		return ""
+	}
+	record, err := in.Peek(recordHeaderLen + length)
+	if err != nil || len(record) <= recordHeaderLen || record[recordHeaderLen] != handshakeMessage {
+		return ""
+	}
+	var serverName string
+	tls.Server(&replayConn{Reader: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSniffed
+		},
+	}).Handshake()
+	return serverName
+}
+
+// replayConn replays bytes that have been peeked at to crypto/tls, discarding
+// anything it writes.
+type replayConn struct {
+	*bytes.Reader
+}
+
+func (c *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return nil }
+func (c *replayConn) RemoteAddr() net.Addr               { return nil }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
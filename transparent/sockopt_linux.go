@@ -0,0 +1,86 @@
+//go:build linux
+
+package transparent
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which shares
+// its value with IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+func listen(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				} else {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst gets the destination of a connection before it was rewritten by
+// the REDIRECT target.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isIPv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if isIPv6 {
+			// IPv6MTUInfo starts with a sockaddr_in6 and is large enough for it
+			var info *unix.IPv6MTUInfo
+			info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if sockErr == nil {
+				dst = &net.TCPAddr{
+					IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+					Port: int(ntohs(info.Addr.Port)),
+				}
+			}
+			return
+		}
+		// IPv6Mreq is large enough for a sockaddr_in
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if sockErr == nil {
+			// sockaddr_in is the family, the port and the address
+			raw := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(binary.BigEndian.Uint16(raw[2:4])),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+// ntohs converts a port in network byte order, as stored in a sockaddr, to a
+// number.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return binary.BigEndian.Uint16(b[:])
+}
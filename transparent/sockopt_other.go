@@ -0,0 +1,19 @@
+//go:build !linux
+
+package transparent
+
+import (
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+var errUnsupported = errors.New("Transparent proxying is only supported on Linux")
+
+func listen(addr string, tproxy bool) (net.Listener, error) {
+	return nil, errUnsupported
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errUnsupported
+}
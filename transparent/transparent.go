@@ -0,0 +1,101 @@
+// Package transparent accepts connections that iptables redirected to the
+// proxy, so that clients need no proxy configuration. It recovers where
+// connections were originally headed, with SO_ORIGINAL_DST for the REDIRECT
+// target or from the local address of transparent sockets for the TPROXY
+// target, and sniffs the first bytes sent by clients to tell HTTP requests
+// from TLS connections and learn their server name. Transparent proxying is
+// only supported on Linux.
+package transparent
+
+import (
+	"net"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
+)
+
+var (
+	log = golog.LoggerFor("transparent")
+)
+
+// Listen listens on the given TCP address for redirected connections. If
+// tproxy is true, the socket is made transparent (IP_TRANSPARENT) for use
+// with the TPROXY target, which requires CAP_NET_ADMIN. Otherwise connections
+// are expected to be redirected with the REDIRECT target. Accepted
+// connections are *Conns.
+func Listen(addr string, tproxy bool) (net.Listener, error) {
+	l, err := listen(addr, tproxy)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{l, tproxy}, nil
+}
+
+type listener struct {
+	net.Listener
+	tproxy bool
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		var dst *net.TCPAddr
+		if l.tproxy {
+			// Transparent sockets take on the original destination as their
+			// local address
+			dst, _ = conn.LocalAddr().(*net.TCPAddr)
+		} else {
+			dst, err = originalDst(conn.(*net.TCPConn))
+			if err == nil && dst.String() == conn.LocalAddr().String() {
+				// Proxying a connection that wasn't redirected would loop
+				err = errors.New("Connection wasn't redirected")
+			}
+		}
+		if dst == nil || err != nil {
+			log.Debugf("Unable to determine original destination of connection from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		return NewConn(conn, dst), nil
+	}
+}
+
+// Conn is a redirected connection.
+type Conn struct {
+	net.Conn
+	originalDst *net.TCPAddr
+}
+
+// NewConn wraps a connection that was originally headed to originalDst.
+func NewConn(conn net.Conn, originalDst *net.TCPAddr) *Conn {
+	return &Conn{conn, originalDst}
+}
+
+// OriginalDst returns the address that the connection was originally headed
+// to.
+func (c *Conn) OriginalDst() *net.TCPAddr {
+	return c.originalDst
+}
+
+// Wrapped implements netx.WrappedConn.
+func (c *Conn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// OriginalDst returns the original destination of conn if it, or any
+// connection it wraps, is a *Conn.
+func OriginalDst(conn net.Conn) (*net.TCPAddr, bool) {
+	var dst *net.TCPAddr
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		if c, ok := wrapped.(*Conn); ok {
+			dst = c.originalDst
+			return false
+		}
+		return true
+	})
+	return dst, dst != nil
+}
@@ -0,0 +1,82 @@
+package transparent
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniff(t *testing.T) {
+	sniff := func(write func(conn net.Conn)) (Protocol, string, []byte) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			write(client)
+			client.Close()
+		}()
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		in := bufio.NewReaderSize(server, SniffBufferSize)
+		protocol, serverName := Sniff(in)
+		server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		first, _ := in.Peek(1)
+		return protocol, serverName, first
+	}
+
+	protocol, serverName, first := sniff(func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+	})
+	assert.Equal(t, TLS, protocol)
+	assert.Equal(t, "example.com", serverName)
+	assert.Equal(t, []byte{recordHandshake}, first, "sniffing shouldn't consume the ClientHello")
+
+	protocol, serverName, _ = sniff(func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	})
+	assert.Equal(t, TLS, protocol)
+	assert.Empty(t, serverName)
+
+	protocol, _, first = sniff(func(conn net.Conn) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Write(conn)
+	})
+	assert.Equal(t, HTTP, protocol)
+	assert.Equal(t, []byte("G"), first)
+
+	protocol, _, _ = sniff(func(conn net.Conn) {
+		io.Copy(conn, strings.NewReader("\x00\x01binary"))
+	})
+	assert.Equal(t, Unknown, protocol)
+
+	protocol, _, _ = sniff(func(conn net.Conn) {
+		// Waits for the server to speak first
+		time.Sleep(time.Second)
+	})
+	assert.Equal(t, Unknown, protocol)
+}
+
+func TestOriginalDst(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server, dst)
+	actual, ok := OriginalDst(&wrappingConn{conn})
+	assert.True(t, ok)
+	assert.Equal(t, dst, actual)
+	_, ok = OriginalDst(server)
+	assert.False(t, ok)
+}
+
+type wrappingConn struct {
+	net.Conn
+}
+
+func (c *wrappingConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -20,6 +20,8 @@ var (
 )
 
 type StdHandler struct {
+	// Pages renders the error response. If nil, DefaultErrorPages is used.
+	Pages *ErrorPages
 }
 
 func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err error) {
@@ -29,18 +31,35 @@ func (e *StdHandler) ServeHTTP(w http.ResponseWriter, req *http.Request, err err
 		cause = structured.RootCause()
 	}
 	statusCode := http.StatusInternalServerError
+	reason := "internal_error"
 	if e, ok := cause.(net.Error); ok {
 		if e.Timeout() {
 			statusCode = http.StatusGatewayTimeout
+			reason = "upstream_timeout"
 		} else {
 			statusCode = http.StatusBadGateway
+			reason = "upstream_error"
 		}
 	} else if cause == io.EOF {
 		statusCode = http.StatusBadGateway
+		reason = "upstream_closed"
 	}
 	log.Errorf("Responding with %d due to %v: %v", statusCode, cause, desc)
-	w.WriteHeader(statusCode)
-	w.Write([]byte(http.StatusText(statusCode)))
+	pages := e.Pages
+	if pages == nil {
+		pages = DefaultErrorPages
+	}
+	requestID := RequestID(req.Context())
+	if requestID == "" {
+		// The client's own request ID isn't trusted, since it could be
+		// anything
+		requestID = NewRequestID()
+	}
+	pages.ServeError(w, req, &ErrorPage{
+		Status:    statusCode,
+		Reason:    reason,
+		RequestID: requestID,
+	})
 }
 
 type ErrorHandlerFunc func(http.ResponseWriter, *http.Request, error)
@@ -0,0 +1,307 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const errorPagesKey = ctxKey("errorPages")
+
+const (
+	contentTypeHTML = "text/html; charset=utf-8"
+	contentTypeJSON = "application/json"
+	contentTypeText = "text/plain; charset=utf-8"
+
+	defaultHTMLTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>Reason: {{.Reason}}</p>
+{{if .Host}}<p>Host: {{.Host}}</p>
+{{end}}{{if .RequestID}}<p>Request ID: {{.RequestID}}</p>
+{{end}}<p>Time: {{.Time.Format "2006-01-02T15:04:05Z07:00"}}</p>
+</body>
+</html>
+`
+	defaultJSONTemplate = `{"status":{{.Status}},"status_text":{{json .StatusText}},"reason":{{json .Reason}},"request_id":{{json .RequestID}},"host":{{json .Host}},"time":{{json .Time}}}
+`
+	defaultTextTemplate = `{{.Status}} {{.StatusText}}
+Reason: {{.Reason}}
+{{if .Host}}Host: {{.Host}}
+{{end}}{{if .RequestID}}Request ID: {{.RequestID}}
+{{end}}Time: {{.Time.Format "2006-01-02T15:04:05Z07:00"}}
+`
+)
+
+var (
+	// DefaultErrorPages are the error pages used by the proxy filters, the
+	// server and StdHandler unless configured otherwise.
+	DefaultErrorPages = NewErrorPages()
+
+	templateFuncs = map[string]interface{}{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+)
+
+// ErrorPage holds the fields available to error page templates.
+type ErrorPage struct {
+	// Status is the HTTP status code
+	Status int
+	// Reason is a short machine-readable code describing why the request
+	// failed, like "port_not_allowed".
+	Reason string
+	// RequestID identifies the request that failed, if known
+	RequestID string
+	// Host is the target host of the request that failed, if known
+	Host string
+	// Time is when the error occurred
+	Time time.Time
+}
+
+// StatusText returns the standard text for the page's Status.
+func (p *ErrorPage) StatusText() string {
+	return http.StatusText(p.Status)
+}
+
+// ErrorTemplates are the templates used to render an error page for each of
+// the supported content types. Any nil template falls back to the default for
+// that content type.
+type ErrorTemplates struct {
+	HTML *htmltemplate.Template
+	JSON *texttemplate.Template
+	Text *texttemplate.Template
+}
+
+// ParseErrorTemplates parses the given templates. Templates may use all fields
+// of ErrorPage, and the json function to encode values as JSON. Empty
+// templates are left nil.
+func ParseErrorTemplates(html, jsonText, text string) (*ErrorTemplates, error) {
+	t := &ErrorTemplates{}
+	var err error
+	if html != "" {
+		t.HTML, err = htmltemplate.New("html").Funcs(templateFuncs).Parse(html)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if jsonText != "" {
+		t.JSON, err = texttemplate.New("json").Funcs(templateFuncs).Parse(jsonText)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if text != "" {
+		t.Text, err = texttemplate.New("text").Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// ErrorPages renders error responses to clients, choosing between HTML, JSON
+// and plain text based on the client's Accept header. Templates can be
+// configured per status code.
+type ErrorPages struct {
+	defaults *ErrorTemplates
+	byStatus map[int]*ErrorTemplates
+	mx       sync.RWMutex
+}
+
+// NewErrorPages constructs ErrorPages using the built-in templates.
+func NewErrorPages() *ErrorPages {
+	defaults, err := ParseErrorTemplates(defaultHTMLTemplate, defaultJSONTemplate, defaultTextTemplate)
+	if err != nil {
+		panic(err)
+	}
+	return &ErrorPages{
+		defaults: defaults,
+		byStatus: make(map[int]*ErrorTemplates),
+	}
+}
+
+// SetDefaultTemplates overrides the templates used for status codes that
+// don't have their own templates.
+func (p *ErrorPages) SetDefaultTemplates(t *ErrorTemplates) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.defaults = &ErrorTemplates{
+		HTML: orHTML(t.HTML, p.defaults.HTML),
+		JSON: orText(t.JSON, p.defaults.JSON),
+		Text: orText(t.Text, p.defaults.Text),
+	}
+}
+
+// SetTemplates sets the templates used for the given status code.
+func (p *ErrorPages) SetTemplates(status int, t *ErrorTemplates) {
+	p.mx.Lock()
+	p.byStatus[status] = t
+	p.mx.Unlock()
+}
+
+// Render renders the given page in the format best matching accept, returning
+// the content type and body.
+func (p *ErrorPages) Render(accept string, page *ErrorPage) (string, []byte) {
+	if page.Time.IsZero() {
+		page.Time = time.Now()
+	}
+
+	p.mx.RLock()
+	t := p.byStatus[page.Status]
+	defaults := p.defaults
+	p.mx.RUnlock()
+	if t == nil {
+		t = defaults
+	}
+
+	var buf bytes.Buffer
+	var err error
+	contentType := negotiateContentType(accept)
+	switch contentType {
+	case contentTypeHTML:
+		err = orHTML(t.HTML, defaults.HTML).Execute(&buf, page)
+	case contentTypeJSON:
+		err = orText(t.JSON, defaults.JSON).Execute(&buf, page)
+	default:
+		err = orText(t.Text, defaults.Text).Execute(&buf, page)
+	}
+	if err != nil {
+		log.Errorf("Unable to render error page: %v", err)
+		return contentTypeText, []byte(strconv.Itoa(page.Status) + " " + page.StatusText())
+	}
+	return contentType, buf.Bytes()
+}
+
+// Response builds an http.Response with the rendered page for the given
+// request. req may be nil.
+func (p *ErrorPages) Response(req *http.Request, page *ErrorPage) *http.Response {
+	accept := ""
+	if req != nil {
+		accept = req.Header.Get("Accept")
+		if page.Host == "" {
+			page.Host = req.Host
+		}
+	}
+	contentType, body := p.Render(accept, page)
+	resp := &http.Response{
+		Request:       req,
+		StatusCode:    page.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	if req != nil {
+		resp.Proto = req.Proto
+		resp.ProtoMajor = req.ProtoMajor
+		resp.ProtoMinor = req.ProtoMinor
+	}
+	resp.Header.Set("Content-Type", contentType)
+	if page.RequestID != "" {
+		resp.Header.Set(RequestIDHeader, page.RequestID)
+	}
+	return resp
+}
+
+// ServeError writes the rendered page to w.
+func (p *ErrorPages) ServeError(w http.ResponseWriter, req *http.Request, page *ErrorPage) {
+	accept := ""
+	if req != nil {
+		accept = req.Header.Get("Accept")
+		if page.Host == "" {
+			page.Host = req.Host
+		}
+	}
+	contentType, body := p.Render(accept, page)
+	w.Header().Set("Content-Type", contentType)
+	if page.RequestID != "" {
+		w.Header().Set(RequestIDHeader, page.RequestID)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(page.Status)
+	w.Write(body)
+}
+
+// negotiateContentType picks the supported content type with the highest
+// quality in the given Accept header, defaulting to plain text.
+// WithErrorPages returns a copy of ctx carrying the error pages that filters
+// should render failures with.
+func WithErrorPages(ctx filters.Context, pages *ErrorPages) filters.Context {
+	return ctx.WithValue(errorPagesKey, pages)
+}
+
+// ErrorPagesFor returns the error pages stored in ctx, or DefaultErrorPages if
+// there are none.
+func ErrorPagesFor(ctx context.Context) *ErrorPages {
+	if ctx != nil {
+		if pages, ok := ctx.Value(errorPagesKey).(*ErrorPages); ok && pages != nil {
+			return pages
+		}
+	}
+	return DefaultErrorPages
+}
+
+func negotiateContentType(accept string) string {
+	best := contentTypeText
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+		var contentType string
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			contentType = contentTypeHTML
+		case "application/json":
+			contentType = contentTypeJSON
+		case "text/plain":
+			contentType = contentTypeText
+		default:
+			continue
+		}
+		if q > bestQ {
+			best = contentType
+			bestQ = q
+		}
+	}
+	return best
+}
+
+func orHTML(t *htmltemplate.Template, fallback *htmltemplate.Template) *htmltemplate.Template {
+	if t == nil {
+		return fallback
+	}
+	return t
+}
+
+func orText(t *texttemplate.Template, fallback *texttemplate.Template) *texttemplate.Template {
+	if t == nil {
+		return fallback
+	}
+	return t
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorPagesNegotiation(t *testing.T) {
+	pages := NewErrorPages()
+	page := &ErrorPage{
+		Status:    http.StatusForbidden,
+		Reason:    "port_not_allowed",
+		RequestID: "abc",
+		Host:      "example.com:25",
+		Time:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	contentType, body := pages.Render("text/html,application/xhtml+xml;q=0.9,*/*;q=0.8", page)
+	assert.Equal(t, contentTypeHTML, contentType)
+	assert.Contains(t, string(body), "<h1>403 Forbidden</h1>")
+
+	contentType, body = pages.Render("application/json", page)
+	assert.Equal(t, contentTypeJSON, contentType)
+	var decoded map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(body, &decoded)) {
+		assert.EqualValues(t, 403, decoded["status"])
+		assert.Equal(t, "port_not_allowed", decoded["reason"])
+		assert.Equal(t, "abc", decoded["request_id"])
+		assert.Equal(t, "example.com:25", decoded["host"])
+		assert.Equal(t, "2020-01-02T03:04:05Z", decoded["time"])
+	}
+
+	contentType, body = pages.Render("", page)
+	assert.Equal(t, contentTypeText, contentType)
+	assert.Contains(t, string(body), "Reason: port_not_allowed")
+}
+
+func TestErrorPagesPerStatus(t *testing.T) {
+	pages := NewErrorPages()
+	templates, err := ParseErrorTemplates("", "", "custom {{.Status}} {{.Reason}}")
+	if !assert.NoError(t, err) {
+		return
+	}
+	pages.SetTemplates(http.StatusBadGateway, templates)
+
+	_, body := pages.Render("text/plain", &ErrorPage{Status: http.StatusBadGateway, Reason: "bad_gateway"})
+	assert.Equal(t, "custom 502 bad_gateway", string(body))
+
+	// Content types without a custom template use the defaults
+	contentType, _ := pages.Render("application/json", &ErrorPage{Status: http.StatusBadGateway})
+	assert.Equal(t, contentTypeJSON, contentType)
+
+	_, body = pages.Render("text/plain", &ErrorPage{Status: http.StatusForbidden, Reason: "nope"})
+	assert.Contains(t, string(body), "403 Forbidden")
+}
+
+func TestStdHandlerHidesError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	w := httptest.NewRecorder()
+	DefaultHandler.ServeHTTP(w, req, &opaqueNetError{})
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Contains(t, string(body), "Reason: upstream_error")
+	assert.NotContains(t, string(body), "secret internal detail")
+}
+
+func TestStdHandlerIgnoresClientRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	req.Header.Set(RequestIDHeader, "<script>spoofed</script>")
+	w := httptest.NewRecorder()
+	DefaultHandler.ServeHTTP(w, req, &opaqueNetError{})
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.NotContains(t, string(body), "spoofed")
+	assert.Contains(t, string(body), "Request ID: ")
+}
+
+type opaqueNetError struct{}
+
+func (e *opaqueNetError) Error() string   { return "secret internal detail" }
+func (e *opaqueNetError) Timeout() bool   { return false }
+func (e *opaqueNetError) Temporary() bool { return false }
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// RequestIDHeader is the header used to propagate request IDs to upstream
+// servers and back to clients.
+const RequestIDHeader = "X-Request-Id"
+
+type ctxKey string
+
+const requestIDKey = ctxKey("requestID")
+
+// NewRequestID generates a new random request ID.
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Errorf("Unable to generate request ID: %v", err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// WithRequestID returns a copy of ctx carrying the given request ID.
+func WithRequestID(ctx filters.Context, requestID string) filters.Context {
+	return ctx.WithValue(requestIDKey, requestID)
+}
+
+// RequestID returns the request ID stored in ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection and aren't forwarded between
+// connections
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// proxyAuthHeaders are hop-by-hop too, but are exchanged between clients and
+// the proxy, so they're only removed from requests sent upstream
+var proxyAuthHeaders = []string{
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+}
+
+// RemoveHopByHopHeaders removes the headers that only apply to the connection
+// they were received on from header, including the ones named in its
+// Connection header. Proxy authentication headers are kept, since they may be
+// for the proxy itself.
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// PrepareRequest prepares a request received from a client to be sent
+// upstream over HTTP/1.1, without hop-by-hop and proxy authentication headers.
+// It's sent to target if specified, otherwise to the request's Host.
+func PrepareRequest(req *http.Request, target *url.URL) *http.Request {
+	out := req.Clone(req.Context())
+	out.Proto, out.ProtoMajor, out.ProtoMinor = "HTTP/1.1", 1, 1
+	out.Close = false
+	out.RequestURI = ""
+	if target != nil {
+		out.URL.Scheme = target.Scheme
+		out.URL.Host = target.Host
+	} else {
+		if out.URL.Scheme == "" {
+			out.URL.Scheme = "http"
+		}
+		out.URL.Host = req.Host
+	}
+	RemoveHopByHopHeaders(out.Header)
+	for _, name := range proxyAuthHeaders {
+		out.Header.Del(name)
+	}
+	if _, found := out.Header["User-Agent"]; !found {
+		// Don't let the transport add its own
+		out.Header.Set("User-Agent", "")
+	}
+	return out
+}
+
+// IsUpgrade determines whether req asks to upgrade its connection to another
+// protocol, like WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
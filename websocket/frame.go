@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/getlantern/errors"
+)
+
+// Opcodes of WebSocket frames (RFC 6455 section 5.2).
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xA
+)
+
+// maxControlPayload is the largest payload of a control frame
+const maxControlPayload = 125
+
+// Frame is a single WebSocket frame.
+type Frame struct {
+	Fin    bool
+	RSV    byte
+	Opcode byte
+	Masked bool
+	// MaskKey is the key that masks the payload of frames sent by clients.
+	MaskKey [4]byte
+	// Payload is the unmasked payload.
+	Payload []byte
+}
+
+// IsControl reports whether f is a control frame (close, ping or pong).
+func (f *Frame) IsControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// errFrameTooBig is returned by ReadFrame when a frame's payload exceeds the
+// given maximum. The payload isn't read.
+var errFrameTooBig = errors.New("frame too big")
+
+// ReadFrame reads a frame from r, unmasking its payload. If maxPayload is
+// positive, frames with larger payloads are rejected without reading their
+// payload.
+func ReadFrame(r io.Reader, maxPayload int64) (*Frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	f := &Frame{
+		Fin:    header[0]&0x80 != 0,
+		RSV:    (header[0] >> 4) & 0x7,
+		Opcode: header[0] & 0xF,
+		Masked: header[1]&0x80 != 0,
+	}
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+		if length < 0 {
+			return nil, errors.New("Invalid payload length")
+		}
+	}
+	if maxPayload > 0 && length > maxPayload {
+		return f, errFrameTooBig
+	}
+	if f.Masked {
+		if _, err := io.ReadFull(r, f.MaskKey[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, err
+	}
+	if f.Masked {
+		mask(f.Payload, f.MaskKey)
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w, masking its payload with f.MaskKey if f.Masked.
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf := make([]byte, 0, 14+len(f.Payload))
+	b0 := f.RSV<<4 | f.Opcode&0xF
+	if f.Fin {
+		b0 |= 0x80
+	}
+	var maskBit byte
+	if f.Masked {
+		maskBit = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length <= 125:
+		buf = append(buf, b0, maskBit|byte(length))
+	case length <= 0xFFFF:
+		buf = append(buf, b0, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b0, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+	if f.Masked {
+		buf = append(buf, f.MaskKey[:]...)
+		start := len(buf)
+		buf = append(buf, f.Payload...)
+		mask(buf[start:], f.MaskKey)
+	} else {
+		buf = append(buf, f.Payload...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// CloseFrame builds a close frame with the given status code and reason.
+// Frames sent to servers have to be masked, so a random mask key is used if
+// masked is true.
+func CloseFrame(code uint16, reason string, masked bool) *Frame {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	f := &Frame{Fin: true, Opcode: OpClose, Masked: masked, Payload: payload}
+	if masked {
+		rand.Read(f.MaskKey[:])
+	}
+	return f
+}
+
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
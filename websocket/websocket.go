@@ -0,0 +1,385 @@
+// Package websocket forwards WebSocket connections (RFC 6455) frame by frame
+// instead of as opaque streams, which lets the proxy validate the handshake,
+// limit the size and rate of messages, inspect frames for policy and count
+// messages.
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	// Version is the only WebSocket version supported, see
+	// Sec-WebSocket-Version.
+	Version = "13"
+
+	defaultMaxMessageSize = 16 * 1024 * 1024
+
+	// closeTimeout limits how long sending close frames may take
+	closeTimeout = 5 * time.Second
+
+	// acceptGUID is appended to the client's key to compute the server's
+	// Sec-WebSocket-Accept (RFC 6455 section 1.3)
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Status codes of close frames (RFC 6455 section 7.4.1).
+const (
+	CloseGoingAway       uint16 = 1001
+	CloseProtocolError   uint16 = 1002
+	ClosePolicyViolation uint16 = 1008
+	CloseMessageTooBig   uint16 = 1009
+)
+
+var (
+	log = golog.LoggerFor("websocket")
+
+	// ErrUnsupportedVersion is returned by ValidateHandshake for handshakes
+	// that don't ask for Version. Clients should be answered with 426 Upgrade
+	// Required and the supported version in Sec-WebSocket-Version.
+	ErrUnsupportedVersion = errors.New("Unsupported WebSocket version")
+)
+
+// IsUpgrade reports whether req asks to upgrade the connection to WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+// ValidateHandshake checks that req is a valid opening handshake (RFC 6455
+// section 4.2.1).
+func ValidateHandshake(req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errors.New("WebSocket handshake has to be a GET, not %v", req.Method)
+	}
+	if !req.ProtoAtLeast(1, 1) {
+		return errors.New("WebSocket handshake has to be at least HTTP/1.1, not %v", req.Proto)
+	}
+	if !IsUpgrade(req) {
+		return errors.New("WebSocket handshake is missing the upgrade headers")
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Header.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return errors.New("Invalid Sec-WebSocket-Key %v", req.Header.Get("Sec-WebSocket-Key"))
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != Version {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+// ValidateResponse checks that resp accepts the opening handshake req.
+func ValidateResponse(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return errors.New("Unexpected status %v", resp.Status)
+	}
+	if !headerHasToken(resp.Header, "Upgrade", "websocket") {
+		return errors.New("Response doesn't upgrade to WebSocket")
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != AcceptKey(req.Header.Get("Sec-WebSocket-Key")) {
+		return errors.New("Unexpected Sec-WebSocket-Accept %v", accept)
+	}
+	return nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept with which servers accept the
+// given Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Opts configures Relay.
+type Opts struct {
+	// MaxMessageSize is the largest message, in bytes of payload across all
+	// of its frames, that may be sent in either direction. Larger messages
+	// close the connection with status 1009. Defaults to 16 MiB.
+	MaxMessageSize int64
+
+	// MessagesPerSecond, if positive, limits the rate of messages in each
+	// direction. Messages beyond the limit are held back, which in turn slows
+	// down the sender.
+	MessagesPerSecond float64
+
+	// Burst is how many messages may be sent in a row before
+	// MessagesPerSecond applies. Defaults to MessagesPerSecond, rounded up.
+	Burst int
+
+	// IdleTimeout, if positive, closes connections that haven't carried any
+	// frames, including pings, for this long.
+	IdleTimeout time.Duration
+
+	// Inspect, if specified, is called with every frame before it's
+	// forwarded. If it returns an error, the connection is closed with status
+	// 1008 (policy violation).
+	Inspect func(f *Frame, fromClient bool) error
+}
+
+// Stats counts the messages relayed over a connection. As in measured stats,
+// sent is towards the client and received is from it.
+type Stats struct {
+	MessagesSent int64 `json:"messages_sent"`
+	MessagesRecv int64 `json:"messages_recv"`
+}
+
+// CloseError is returned by Relay.Run when the relay closed the connection
+// because of a violation.
+type CloseError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return e.Reason
+}
+
+// Relay forwards frames between a client and an upstream whose handshake has
+// completed.
+type Relay struct {
+	opts     *Opts
+	client   net.Conn
+	upstream net.Conn
+	// The readers may hold data read along with the handshake
+	clientIn   io.Reader
+	upstreamIn io.Reader
+
+	messagesSent int64
+	messagesRecv int64
+	lastActivity int64
+	clientMx     sync.Mutex
+	upstreamMx   sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewRelay creates a relay between client and upstream, reading from
+// clientIn and upstreamIn if not nil.
+func NewRelay(client net.Conn, clientIn io.Reader, upstream net.Conn, upstreamIn io.Reader, opts *Opts) *Relay {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = int(math.Ceil(opts.MessagesPerSecond))
+	}
+	if clientIn == nil {
+		clientIn = client
+	}
+	if upstreamIn == nil {
+		upstreamIn = upstream
+	}
+	return &Relay{
+		opts:         opts,
+		client:       client,
+		upstream:     upstream,
+		clientIn:     clientIn,
+		upstreamIn:   upstreamIn,
+		lastActivity: time.Now().UnixNano(),
+		closed:       make(chan struct{}),
+	}
+}
+
+// Run relays frames until either side closes its connection or the relay
+// closes both because of a violation, which is returned as a *CloseError.
+func (r *Relay) Run() error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- r.pump(r.clientIn, true)
+	}()
+	go func() {
+		errs <- r.pump(r.upstreamIn, false)
+	}()
+	if r.opts.IdleTimeout > 0 {
+		go r.watchIdle()
+	}
+	err := <-errs
+	r.close()
+	<-errs
+	if _, ok := err.(*CloseError); ok {
+		return err
+	}
+	return nil
+}
+
+// Stats returns the messages relayed so far.
+func (r *Relay) Stats() Stats {
+	return Stats{
+		MessagesSent: atomic.LoadInt64(&r.messagesSent),
+		MessagesRecv: atomic.LoadInt64(&r.messagesRecv),
+	}
+}
+
+// pump forwards frames read from src, which come from the client if
+// fromClient is true.
+func (r *Relay) pump(src io.Reader, fromClient bool) error {
+	var limiter *limiter
+	if r.opts.MessagesPerSecond > 0 {
+		limiter = newLimiter(r.opts.MessagesPerSecond, r.opts.Burst)
+	}
+	messages := &r.messagesSent
+	if fromClient {
+		messages = &r.messagesRecv
+	}
+	inMessage := false
+	var messageSize int64
+	for {
+		// Control frames may be interleaved with the frames of a message
+		maxPayload := r.opts.MaxMessageSize - messageSize
+		if maxPayload < maxControlPayload {
+			maxPayload = maxControlPayload
+		}
+		f, err := ReadFrame(src, maxPayload)
+		if err == errFrameTooBig {
+			if f.IsControl() {
+				return r.violation(CloseProtocolError, "invalid control frame")
+			}
+			return r.violation(CloseMessageTooBig, "message too big")
+		}
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&r.lastActivity, time.Now().UnixNano())
+		if f.Masked != fromClient {
+			return r.violation(CloseProtocolError, "frame masked incorrectly")
+		}
+		if f.IsControl() {
+			if !f.Fin || len(f.Payload) > maxControlPayload {
+				return r.violation(CloseProtocolError, "invalid control frame")
+			}
+		} else {
+			if (f.Opcode == OpContinuation) != inMessage {
+				return r.violation(CloseProtocolError, "unexpected continuation")
+			}
+			messageSize += int64(len(f.Payload))
+			if messageSize > r.opts.MaxMessageSize {
+				return r.violation(CloseMessageTooBig, "message too big")
+			}
+			if !inMessage {
+				atomic.AddInt64(messages, 1)
+				if limiter != nil {
+					limiter.wait(r.closed)
+				}
+			}
+			inMessage = !f.Fin
+			if !inMessage {
+				messageSize = 0
+			}
+		}
+		if r.opts.Inspect != nil {
+			if err := r.opts.Inspect(f, fromClient); err != nil {
+				return r.violation(ClosePolicyViolation, err.Error())
+			}
+		}
+		if err := r.write(!fromClient, f); err != nil {
+			return err
+		}
+	}
+}
+
+// write writes f to the client if toClient is true and to the upstream
+// otherwise.
+func (r *Relay) write(toClient bool, f *Frame) error {
+	if toClient {
+		r.clientMx.Lock()
+		defer r.clientMx.Unlock()
+		return WriteFrame(r.client, f)
+	}
+	r.upstreamMx.Lock()
+	defer r.upstreamMx.Unlock()
+	return WriteFrame(r.upstream, f)
+}
+
+// violation closes both sides with the given status.
+func (r *Relay) violation(code uint16, reason string) error {
+	log.Debugf("Closing WebSocket from %v with status %d: %v", r.client.RemoteAddr(), code, reason)
+	r.sendClose(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
+
+// sendClose sends close frames to both sides, giving up on sides that don't
+// accept them within closeTimeout.
+func (r *Relay) sendClose(code uint16, reason string) {
+	deadline := time.Now().Add(closeTimeout)
+	r.client.SetWriteDeadline(deadline)
+	r.upstream.SetWriteDeadline(deadline)
+	r.write(true, CloseFrame(code, reason, false))
+	r.write(false, CloseFrame(code, reason, true))
+}
+
+func (r *Relay) close() {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+		r.client.Close()
+		r.upstream.Close()
+	})
+}
+
+func (r *Relay) watchIdle() {
+	timeout := r.opts.IdleTimeout
+	for {
+		idleFor := time.Since(time.Unix(0, atomic.LoadInt64(&r.lastActivity)))
+		if idleFor >= timeout {
+			log.Debugf("Closing WebSocket from %v after being idle for %v", r.client.RemoteAddr(), idleFor)
+			r.sendClose(CloseGoingAway, "idle")
+			r.close()
+			return
+		}
+		timer := time.NewTimer(timeout - idleFor)
+		select {
+		case <-timer.C:
+		case <-r.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// limiter is a token bucket of messages.
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait waits for a token, unless done is closed first.
+func (l *limiter) wait(done <-chan struct{}) {
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return
+	}
+	timer := time.NewTimer(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
@@ -0,0 +1,233 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrames(t *testing.T) {
+	for _, size := range []int{1, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte("x"), size)
+		for _, masked := range []bool{false, true} {
+			var buf bytes.Buffer
+			f := &Frame{Fin: true, Opcode: OpBinary, Masked: masked, Payload: append([]byte(nil), payload...)}
+			if masked {
+				f.MaskKey = [4]byte{1, 2, 3, 4}
+			}
+			if !assert.NoError(t, WriteFrame(&buf, f)) {
+				return
+			}
+			assert.Equal(t, payload, f.Payload, "writing shouldn't mask the frame's own payload")
+			read, err := ReadFrame(&buf, 0)
+			if assert.NoError(t, err) {
+				assert.Equal(t, f, read)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	WriteFrame(&buf, &Frame{Fin: true, Opcode: OpText, Payload: []byte("too big")})
+	f, err := ReadFrame(&buf, 6)
+	assert.Equal(t, errFrameTooBig, err)
+	assert.Equal(t, OpText, f.Opcode)
+
+	close := CloseFrame(CloseMessageTooBig, strings.Repeat("x", 200), true)
+	assert.True(t, close.IsControl())
+	assert.Len(t, close.Payload, maxControlPayload)
+	assert.Equal(t, []byte{0x03, 0xF1}, close.Payload[:2])
+}
+
+func TestHandshake(t *testing.T) {
+	req := handshake()
+	assert.True(t, IsUpgrade(req))
+	assert.NoError(t, ValidateHandshake(req))
+
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header: http.Header{
+			"Upgrade":              {"websocket"},
+			"Connection":           {"Upgrade"},
+			"Sec-Websocket-Accept": {"s3pPLMBiTxaQ9kYGzzhZRbK+xOo="},
+		},
+	}
+	assert.NoError(t, ValidateResponse(req, resp), "should accept the example of RFC 6455")
+	resp.Header.Set("Sec-WebSocket-Accept", "wrong")
+	assert.Error(t, ValidateResponse(req, resp))
+
+	req = handshake()
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	assert.Equal(t, ErrUnsupportedVersion, ValidateHandshake(req))
+
+	req = handshake()
+	req.Header.Set("Sec-WebSocket-Key", "dG9vIHNob3J0")
+	assert.Error(t, ValidateHandshake(req))
+
+	req = handshake()
+	req.Method = http.MethodPost
+	assert.Error(t, ValidateHandshake(req))
+
+	req = handshake()
+	req.Header.Del("Upgrade")
+	assert.False(t, IsUpgrade(req))
+	assert.Error(t, ValidateHandshake(req))
+}
+
+func TestRelay(t *testing.T) {
+	inspected := 0
+	client, upstream, relay, done := startRelay(&Opts{
+		MaxMessageSize: 10,
+		Inspect: func(f *Frame, fromClient bool) error {
+			inspected++
+			return nil
+		},
+	})
+
+	// A fragmented message with a ping in between
+	for _, f := range []*Frame{
+		{Opcode: OpText, Masked: true, Payload: []byte("hello ")},
+		{Fin: true, Opcode: OpPing, Masked: true, Payload: []byte("ping")},
+		{Fin: true, Opcode: OpContinuation, Masked: true, Payload: []byte("you")},
+	} {
+		expected := string(f.Payload)
+		send(t, client, f)
+		f := receive(t, upstream)
+		if assert.NotNil(t, f) {
+			assert.True(t, f.Masked)
+			assert.Equal(t, expected, string(f.Payload))
+		}
+	}
+	send(t, upstream, &Frame{Fin: true, Opcode: OpText, Payload: []byte("hi")})
+	if f := receive(t, client); assert.NotNil(t, f) {
+		assert.Equal(t, "hi", string(f.Payload))
+	}
+	assert.Equal(t, Stats{MessagesSent: 1, MessagesRecv: 1}, relay.Stats())
+	assert.Equal(t, 4, inspected)
+
+	// Messages are limited across their frames
+	send(t, client, &Frame{Opcode: OpBinary, Masked: true, Payload: []byte("123456")})
+	receive(t, upstream)
+	send(t, client, &Frame{Fin: true, Opcode: OpContinuation, Masked: true, Payload: []byte("789012")})
+	expectClose(t, client, CloseMessageTooBig)
+	expectClose(t, upstream, CloseMessageTooBig)
+	err := <-done
+	if assert.IsType(t, &CloseError{}, err) {
+		assert.Equal(t, CloseMessageTooBig, err.(*CloseError).Code)
+	}
+}
+
+func TestRelayViolations(t *testing.T) {
+	client, upstream, _, done := startRelay(&Opts{})
+	send(t, client, &Frame{Fin: true, Opcode: OpText, Payload: []byte("unmasked")})
+	expectClose(t, client, CloseProtocolError)
+	expectClose(t, upstream, CloseProtocolError)
+	assert.Error(t, <-done)
+
+	client, upstream, _, done = startRelay(&Opts{})
+	send(t, upstream, &Frame{Fin: true, Opcode: OpContinuation, Payload: []byte("unexpected")})
+	expectClose(t, client, CloseProtocolError)
+	expectClose(t, upstream, CloseProtocolError)
+	assert.Error(t, <-done)
+
+	client, upstream, _, done = startRelay(&Opts{
+		Inspect: func(f *Frame, fromClient bool) error {
+			if bytes.Contains(f.Payload, []byte("forbidden")) {
+				return errors.New("forbidden content")
+			}
+			return nil
+		},
+	})
+	send(t, client, &Frame{Fin: true, Opcode: OpText, Masked: true, Payload: []byte("forbidden")})
+	if f := expectClose(t, client, ClosePolicyViolation); f != nil {
+		assert.Equal(t, "forbidden content", string(f.Payload[2:]))
+	}
+	expectClose(t, upstream, ClosePolicyViolation)
+	assert.Error(t, <-done)
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	client, upstream, _, _ := startRelay(&Opts{MessagesPerSecond: 10, Burst: 2})
+	go func() {
+		for i := 0; i < 4; i++ {
+			send(t, client, &Frame{Fin: true, Opcode: OpText, Masked: true, Payload: []byte("x")})
+		}
+	}()
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		receive(t, upstream)
+	}
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "messages beyond the burst should be held back")
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, upstream, _, done := startRelay(&Opts{IdleTimeout: 200 * time.Millisecond})
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		send(t, client, &Frame{Fin: true, Opcode: OpPing, Masked: true})
+		receive(t, upstream)
+	}
+	select {
+	case <-done:
+		assert.Fail(t, "pings should keep the connection open")
+	default:
+	}
+	expectClose(t, client, CloseGoingAway)
+	expectClose(t, upstream, CloseGoingAway)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "idle connection should have been closed")
+	}
+}
+
+func handshake() *http.Request {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	return req
+}
+
+// startRelay relays between two pipes, returning the ends of the client and
+// the upstream.
+func startRelay(opts *Opts) (client, upstream net.Conn, relay *Relay, done chan error) {
+	client, proxyClient := net.Pipe()
+	upstream, proxyUpstream := net.Pipe()
+	relay = NewRelay(proxyClient, nil, proxyUpstream, nil, opts)
+	done = make(chan error, 1)
+	go func() {
+		done <- relay.Run()
+	}()
+	return client, upstream, relay, done
+}
+
+func send(t *testing.T, conn net.Conn, f *Frame) {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	assert.NoError(t, WriteFrame(conn, f))
+}
+
+func receive(t *testing.T, conn net.Conn) *Frame {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := ReadFrame(conn, 0)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	return f
+}
+
+func expectClose(t *testing.T, conn net.Conn, code uint16) *Frame {
+	f := receive(t, conn)
+	if !assert.NotNil(t, f) || !assert.Equal(t, OpClose, f.Opcode) {
+		return nil
+	}
+	assert.Equal(t, []byte{byte(code >> 8), byte(code)}, f.Payload[:2])
+	return f
+}